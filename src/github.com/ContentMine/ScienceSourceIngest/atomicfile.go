@@ -0,0 +1,140 @@
+//   Copyright 2018 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Everything we write into a paper's folder is used to decide what to do on the next run, so a
+// half written file is worse than no file. AtomicFile writes to a temporary file next to the
+// target, and only renames it into place once it has been completely written and synced.
+
+const atomicTempPrefix string = ".tmp-"
+
+type AtomicFile struct {
+	*os.File
+	target string
+	done   bool
+}
+
+func CreateAtomic(filename string) (*AtomicFile, error) {
+
+	f, err := ioutil.TempFile(filepath.Dir(filename), atomicTempPrefix+filepath.Base(filename)+"-")
+	if err != nil {
+		return nil, err
+	}
+
+	return &AtomicFile{File: f, target: filename}, nil
+}
+
+// Commit moves the file into place. After this Abort does nothing, so it is safe to defer an
+// Abort straight after creating the file.
+func (f *AtomicFile) Commit() error {
+
+	if f.done {
+		return fmt.Errorf("File %s already committed or aborted", f.target)
+	}
+	f.done = true
+
+	err := f.File.Sync()
+	if err != nil {
+		f.File.Close()
+		os.Remove(f.File.Name())
+		return err
+	}
+	err = f.File.Close()
+	if err != nil {
+		os.Remove(f.File.Name())
+		return err
+	}
+	err = os.Chmod(f.File.Name(), 0644)
+	if err != nil {
+		os.Remove(f.File.Name())
+		return err
+	}
+	err = os.Rename(f.File.Name(), f.target)
+	if err != nil {
+		os.Remove(f.File.Name())
+		return err
+	}
+
+	// Make sure the rename itself is on disk
+	if dir, err := os.Open(filepath.Dir(f.target)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	return nil
+}
+
+func (f *AtomicFile) Abort() {
+	if f.done {
+		return
+	}
+	f.done = true
+	f.File.Close()
+	os.Remove(f.File.Name())
+}
+
+func WriteFileAtomic(filename string, data []byte) error {
+
+	f, err := CreateAtomic(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Abort()
+
+	_, err = f.Write(data)
+	if err != nil {
+		return err
+	}
+
+	return f.Commit()
+}
+
+// removeStaleTempFiles tidies up after any writes that were interrupted by a crash
+func removeStaleTempFiles(directory string) error {
+
+	files, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), atomicTempPrefix) {
+			// RemoveAll as well as files this catches interrupted unpacking of archives
+			err := os.RemoveAll(path.Join(directory, f.Name()))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// quarantineFile moves a file we don't trust out of the way, keeping it for a human to look at,
+// and returns the new name
+func quarantineFile(filename string) (string, error) {
+	quarantined := fmt.Sprintf("%s.corrupt-%s", filename, time.Now().UTC().Format("20060102T150405"))
+	return quarantined, os.Rename(filename, quarantined)
+}
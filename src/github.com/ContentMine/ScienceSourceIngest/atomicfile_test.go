@@ -0,0 +1,116 @@
+//   Copyright 2018 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+)
+
+func TestAtomicFileAbortLeavesNothing(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "sciencesourceingest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	target := path.Join(dir, "paper.xml")
+	err = ioutil.WriteFile(target, []byte("old"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := CreateAtomic(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("half written"))
+	f.Abort()
+
+	data, err := ioutil.ReadFile(target)
+	if err != nil || string(data) != "old" {
+		t.Errorf("Expected original file to be untouched, got %q, %v", data, err)
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("Expected only the original file, got %d files", len(files))
+	}
+
+	err = WriteFileAtomic(target, []byte("new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = ioutil.ReadFile(target)
+	if err != nil || string(data) != "new" {
+		t.Errorf("Expected new contents, got %q, %v", data, err)
+	}
+}
+
+func TestStaleTempFilesRemoved(t *testing.T) {
+
+	processor, cleanup := newTestProcessor(t)
+	defer cleanup()
+
+	// Simulate a crash part way through a write
+	f, err := CreateAtomic(processor.targetHTMLFileName())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.File.Close()
+
+	err = processor.createFolderIfRequired()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(f.File.Name()); !os.IsNotExist(err) {
+		t.Errorf("Expected stale temp file to be removed")
+	}
+}
+
+func TestCorruptStateQuarantined(t *testing.T) {
+
+	processor, cleanup := newTestProcessor(t)
+	defer cleanup()
+
+	for _, contents := range []string{`{"science_source_title": "Trunc`, ``, `{"annotations": []}`} {
+
+		err := ioutil.WriteFile(processor.targetScienceSourceStateFileName(), []byte(contents), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = LoadScienceSourceArticle(processor.targetScienceSourceStateFileName())
+		if !IsCorruptState(err) {
+			t.Errorf("Expected %q to be reported as corrupt, got %v", contents, err)
+		}
+
+		err = processor.AnnotatePaper(nil, false)
+		if err == nil {
+			t.Errorf("Expected annotate to fail on corrupt state %q", contents)
+		}
+		if fileExists(processor.targetScienceSourceStateFileName()) {
+			t.Errorf("Expected corrupt state %q to be moved aside", contents)
+		}
+	}
+
+	matches, err := filepath.Glob(processor.targetScienceSourceStateFileName() + ".corrupt-*")
+	if err != nil || len(matches) == 0 {
+		t.Errorf("Expected quarantined state files, got %v, %v", matches, err)
+	}
+}
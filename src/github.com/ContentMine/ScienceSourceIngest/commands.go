@@ -0,0 +1,684 @@
+//   Copyright 2018 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ContentMine/wikibase"
+)
+
+// Each command is one stage (or all stages) of the pipeline run over every paper in the feed. All
+// the commands share the same output directory layout, so for instance you can fetch on one
+// machine and upload from another by copying the output directory between them.
+
+type command struct {
+	Description string
+	Run         func(ctx context.Context, args []string) error
+}
+
+const defaultCommand string = "run"
+
+var commands = map[string]command{
+	"run":        {"Fetch, convert, annotate, and upload every paper in the feed", runCommand},
+	"fetch":      {"Fetch the XML for every paper in the feed", fetchCommand},
+	"convert":    {"Convert fetched paper XML to HTML and text", convertCommand},
+	"annotate":   {"Find dictionary terms in converted papers", annotateCommand},
+	"reannotate": {"Find annotations again in papers annotated with older dictionaries", reannotateCommand},
+	"upload":     {"Upload annotated papers to the wikibase server", uploadCommand},
+	"status":     {"Report how far each paper in the feed has got", statusCommand},
+	"verify":     {"Check the state stored in the output directory is consistent", verifyCommand},
+	"report":     {"Report which dictionary entries were found across the output directory", reportCommand},
+	"migrate":    {"Convert the offsets in annotated papers to another unit", migrateCommand},
+	"dictionary": {"Work with dictionaries, see dictionary help", dictionaryCommand},
+}
+
+// Command line options, registered on demand by each command
+
+type ingestOptions struct {
+	FeedPath           string
+	TargetPath         string
+	DictionariesPath   string
+	URLBase            string
+	OAuthTokensPath    string
+	XSLTProcPath       string
+	XSLDirectory       string
+	ConverterName      string
+	Force              bool
+	Apply              bool
+	DryRun             bool
+	DryRunReportPath   string
+	EuropePMCURL       string
+	RecordPath         string
+	ReplayPath         string
+	FetchRetries       int
+	FetchBackoff       time.Duration
+	FetchRate          float64
+	FetchWorkers       int
+	ProcessWorkers     int
+	UploadWorkers      int
+	OverlapPolicy      string
+	DictionaryPriority string
+	PhraseMaxLength    int
+	OffsetUnit         string
+	ExcludeSections    string
+	Supplementary      bool
+	SupplementaryMax   int64
+	SupplementaryFiles int
+
+	europePMC  *EuropePMCClient
+	annotation AnnotationOptions
+}
+
+func (options *ingestOptions) addFeedFlags(flags *flag.FlagSet) {
+	flags.StringVar(&options.FeedPath, "feed", "", "JSON feed of papers, required")
+	flags.StringVar(&options.TargetPath, "output", ".", "Directory to store the results, required")
+}
+
+func (options *ingestOptions) addFetchFlags(flags *flag.FlagSet) {
+	flags.StringVar(&options.EuropePMCURL, "europepmc", DefaultEuropePMCBaseURL, "Base URL for the Europe PMC REST API.")
+	flags.StringVar(&options.RecordPath, "record", "", "Directory to record Europe PMC responses into as fixtures.")
+	flags.StringVar(&options.ReplayPath, "replay", "", "Directory of recorded Europe PMC responses to use instead of the network.")
+	flags.IntVar(&options.FetchRetries, "retries", DefaultEuropePMCRetries, "How many times to retry failed Europe PMC requests.")
+	flags.DurationVar(&options.FetchBackoff, "retry-backoff", DefaultEuropePMCInitialBackoff, "How long to wait before the first retry, doubling on each subsequent retry.")
+	flags.Float64Var(&options.FetchRate, "rate", DefaultEuropePMCRequestRate, "Maximum Europe PMC requests per second across all workers, 0 for no limit.")
+	flags.BoolVar(&options.Supplementary, "supplementary", false, "Also fetch and unpack each paper's supplementary files.")
+	flags.Int64Var(&options.SupplementaryMax, "supplementary-max-size", DefaultSupplementaryMaxSize, "Most bytes a paper's supplementary files can unpack to.")
+	flags.IntVar(&options.SupplementaryFiles, "supplementary-max-files", DefaultSupplementaryMaxFiles, "Most files a paper's supplementary archive can contain.")
+}
+
+func (options *ingestOptions) addFetchWorkerFlags(flags *flag.FlagSet) {
+	flags.IntVar(&options.FetchWorkers, "fetch-workers", DefaultFetchWorkers, "How many papers to fetch at once.")
+}
+
+func (options *ingestOptions) addProcessWorkerFlags(flags *flag.FlagSet) {
+	flags.IntVar(&options.ProcessWorkers, "workers", DefaultProcessWorkers, "How many papers to convert and annotate at once.")
+}
+
+func (options *ingestOptions) addUploadWorkerFlags(flags *flag.FlagSet) {
+	flags.IntVar(&options.UploadWorkers, "upload-workers", DefaultUploadWorkers, "How many papers to upload to the wiki at once.")
+}
+
+func (options *ingestOptions) addConverterFlags(flags *flag.FlagSet) {
+	flags.StringVar(&options.XSLTProcPath, "xsltproc", "/usr/bin/xsltproc", "Location off xsltproc tool.")
+	flags.StringVar(&options.XSLDirectory, "xsl-dir", "", "Directory of custom XSL files to use instead of the built in ones.")
+	flags.StringVar(&options.ConverterName, "converter", ConverterNative, "How to convert papers from JATS XML: native, or xslt to compare against the original stylesheets.")
+}
+
+func (options *ingestOptions) addDictionaryFlags(flags *flag.FlagSet) {
+	flags.StringVar(&options.DictionariesPath, "dictionaries", "", "Directory of dictionaries to load.")
+	flags.StringVar(&options.OverlapPolicy, "overlaps", string(DefaultOverlapPolicy), "How to resolve overlapping matches: keep-all, merge, longest, or priority.")
+	flags.StringVar(&options.DictionaryPriority, "dictionary-priority", "", "Comma separated dictionary IDs, highest priority first, for resolving overlapping matches.")
+	flags.IntVar(&options.PhraseMaxLength, "phrase-length", DefaultPhraseMaxLength, "Most characters of context to record either side of each term found.")
+	flags.StringVar(&options.ExcludeSections, "exclude-sections", "", "Comma separated section types, such as methods or table, not to look for terms in.")
+	options.addOffsetUnitFlag(flags)
+}
+
+func (options *ingestOptions) addOffsetUnitFlag(flags *flag.FlagSet) {
+	flags.StringVar(&options.OffsetUnit, "offset-unit", string(DefaultOffsetUnit), "What to count character offsets and lengths in: codepoint, utf16, or byte.")
+}
+
+func (options *ingestOptions) addWikibaseFlags(flags *flag.FlagSet) {
+	flags.StringVar(&options.URLBase, "urlbase", "http://localhost:8181", "Base URL for science source.")
+	flags.StringVar(&options.OAuthTokensPath, "oauth", "oauth.json", "JSON file with oauth credentials in.")
+	flags.BoolVar(&options.DryRun, "dry-run", false, "Don't talk to the wikibase server, just report what would have been uploaded.")
+	flags.StringVar(&options.DryRunReportPath, "dry-run-report", "dry-run-report.json", "Where to write the dry run report, relative to the output directory.")
+}
+
+func (options *ingestOptions) addForceFlag(flags *flag.FlagSet, usage string) {
+	flags.BoolVar(&options.Force, "force", false, usage)
+}
+
+// Shared set up
+
+func (options ingestOptions) loadLibrary() ([]Paper, error) {
+
+	log.Printf("Feed to parse: %s", options.FeedPath)
+
+	feed, err := LoadFeedFromFile(options.FeedPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// the SPARQL seems to have duplicates in, so let's check
+	seen := make(map[string]bool)
+	library := make([]Paper, 0, len(feed.Results.Papers))
+	for _, paper := range feed.Results.Papers {
+		if seen[paper.ID()] {
+			log.Printf("Found a duplicate paper: %v", paper.ID())
+		} else {
+			seen[paper.ID()] = true
+			library = append(library, paper)
+		}
+	}
+	log.Printf("We have %d papers to process", len(library))
+
+	return library, nil
+}
+
+func (options ingestOptions) europePMCClient() (*EuropePMCClient, error) {
+
+	var transport http.RoundTripper
+	switch {
+	case len(options.RecordPath) > 0 && len(options.ReplayPath) > 0:
+		return nil, fmt.Errorf("Can not both record and replay Europe PMC responses")
+	case len(options.RecordPath) > 0:
+		log.Printf("Recording Europe PMC responses to %s", options.RecordPath)
+		transport = &RecordReplayTransport{Mode: RecordMode, Directory: options.RecordPath}
+	case len(options.ReplayPath) > 0:
+		log.Printf("Replaying Europe PMC responses from %s", options.ReplayPath)
+		transport = &RecordReplayTransport{Mode: ReplayMode, Directory: options.ReplayPath}
+	}
+
+	client := NewEuropePMCClient(options.EuropePMCURL, transport)
+	client.MaxRetries = options.FetchRetries
+	client.InitialBackoff = options.FetchBackoff
+	client.Limiter = NewRateLimiter(options.FetchRate)
+
+	return client, nil
+}
+
+func (options ingestOptions) loadConverter() (PaperConverter, error) {
+	return NewPaperConverter(options.ConverterName, options.XSLTProcPath, options.XSLDirectory)
+}
+
+func (options ingestOptions) loadDictionaries() ([]Dictionary, error) {
+
+	// Load the dictionaries of terms we want to create annotations for
+	dictionaries, err := LoadDictionariesFromDirectory(options.DictionariesPath)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("We have loaded %d dictionaries", len(dictionaries))
+	for _, dict := range dictionaries {
+		log.Printf("Dict %s has %d entries", dict.Identifier, len(dict.Entries))
+		if warnings := dict.Validate().Warnings(); len(warnings) > 0 {
+			log.Printf("Dict %s has %d warnings, run dictionary lint for details", dict.Identifier, len(warnings))
+		}
+	}
+
+	return dictionaries, nil
+}
+
+func (options ingestOptions) annotationOptions(dictionaries []Dictionary) (AnnotationOptions, error) {
+
+	policy, err := ParseOverlapPolicy(options.OverlapPolicy)
+	if err != nil {
+		return AnnotationOptions{}, err
+	}
+
+	if options.PhraseMaxLength <= 0 {
+		return AnnotationOptions{}, fmt.Errorf("Phrase length must be positive, got %d", options.PhraseMaxLength)
+	}
+
+	unit, err := ParseOffsetUnit(options.OffsetUnit)
+	if err != nil {
+		return AnnotationOptions{}, err
+	}
+
+	res := AnnotationOptions{Overlaps: policy, PhraseMaxLength: options.PhraseMaxLength, OffsetUnit: unit}
+	if len(options.DictionaryPriority) > 0 {
+		known := make(map[string]bool)
+		for _, dictionary := range dictionaries {
+			known[dictionary.Identifier] = true
+		}
+		for _, identifier := range strings.Split(options.DictionaryPriority, ",") {
+			identifier = strings.TrimSpace(identifier)
+			if !known[identifier] {
+				return AnnotationOptions{}, fmt.Errorf("Dictionary %s in priority list was not loaded", identifier)
+			}
+			res.DictionaryPriority = append(res.DictionaryPriority, identifier)
+		}
+	}
+	if len(options.ExcludeSections) > 0 {
+		for _, sectionType := range strings.Split(options.ExcludeSections, ",") {
+			sectionType = strings.TrimSpace(sectionType)
+			if len(sectionType) == 0 {
+				return AnnotationOptions{}, fmt.Errorf("Empty section type in %q", options.ExcludeSections)
+			}
+			res.ExcludeSections = append(res.ExcludeSections, sectionType)
+		}
+	}
+
+	return res, nil
+}
+
+func (options ingestOptions) connectToScienceSource() (*ScienceSourceClient, error) {
+
+	if options.DryRun {
+		log.Printf("Dry run, so not connecting to %s", options.URLBase)
+		sciSourceClient := NewScienceSourceClientWithWikibase(NewDryRunWikibase())
+		return sciSourceClient, sciSourceClient.GetConfigurationFromServer()
+	}
+
+	// Connect to Science Source instance and get any information we need
+	oauthInfo, err := wikibase.LoadOauthInformation(options.OAuthTokensPath)
+	if err != nil {
+		return nil, err
+	}
+	sciSourceClient := NewScienceSourceClient(oauthInfo, options.URLBase)
+	err = sciSourceClient.GetConfigurationFromServer()
+	if err != nil {
+		return nil, err
+	}
+
+	return sciSourceClient, nil
+}
+
+func (options ingestOptions) processor(paper Paper, converter PaperConverter) PaperProcessor {
+	return PaperProcessor{
+		Paper:           paper,
+		TargetDirectory: options.TargetPath,
+		Converter:       converter,
+		EuropePMC:       options.europePMC,
+		DryRun:          options.DryRun,
+		Annotation:      options.annotation,
+		Supplementary:   SupplementaryOptions{Fetch: options.Supplementary, MaxSize: options.SupplementaryMax, MaxFiles: options.SupplementaryFiles},
+	}
+}
+
+// finishDryRun writes out the report of what the dry run wikibase was asked to do
+func (options ingestOptions) finishDryRun(sciSourceClient *ScienceSourceClient) error {
+
+	dryRun, ok := sciSourceClient.wikiBaseClient.(*DryRunWikibase)
+	if !ok {
+		return nil
+	}
+
+	reportPath := options.DryRunReportPath
+	if !filepath.IsAbs(reportPath) {
+		reportPath = path.Join(options.TargetPath, reportPath)
+	}
+	err := dryRun.SaveReport(reportPath)
+	if err != nil {
+		return err
+	}
+	log.Printf("Dry run: %s. Full report written to %s", dryRun.Summary(), reportPath)
+
+	return nil
+}
+
+// processLibrary runs a single stage function over every paper, logging rather than stopping on
+// failures, and returns a summary of how it went.
+func processLibrary(ctx context.Context, library []Paper, stage string, workers int, f func(paper Paper) error) PipelineSummary {
+	return runPipeline(ctx, library, []PipelineStage{{Name: stage, Workers: workers, Run: f}})
+}
+
+func summaryToError(summary PipelineSummary) error {
+	log.Printf("Processed %v", summary)
+	if summary.Interrupted > 0 {
+		return fmt.Errorf("Interrupted with %d of %d papers unfinished, re-run to carry on", summary.Interrupted, summary.Total)
+	}
+	if summary.Failed > 0 {
+		return fmt.Errorf("%d of %d papers failed", summary.Failed, summary.Total)
+	}
+	return nil
+}
+
+// The commands
+
+func runCommand(ctx context.Context, args []string) error {
+
+	var options ingestOptions
+	flags := flag.NewFlagSet("run", flag.ExitOnError)
+	options.addFeedFlags(flags)
+	options.addFetchFlags(flags)
+	options.addConverterFlags(flags)
+	options.addDictionaryFlags(flags)
+	options.addWikibaseFlags(flags)
+	options.addFetchWorkerFlags(flags)
+	options.addProcessWorkerFlags(flags)
+	options.addUploadWorkerFlags(flags)
+	flags.Parse(args)
+
+	library, err := options.loadLibrary()
+	if err != nil {
+		return err
+	}
+	options.europePMC, err = options.europePMCClient()
+	if err != nil {
+		return err
+	}
+	converter, err := options.loadConverter()
+	if err != nil {
+		return err
+	}
+	defer closeConverter(converter)
+	dictionaries, err := options.loadDictionaries()
+	if err != nil {
+		return err
+	}
+	options.annotation, err = options.annotationOptions(dictionaries)
+	if err != nil {
+		return err
+	}
+	sciSourceClient, err := options.connectToScienceSource()
+	if err != nil {
+		return err
+	}
+
+	summary := runPipeline(ctx, library, []PipelineStage{
+		{Name: "Fetch", Workers: options.FetchWorkers, Run: func(paper Paper) error {
+			return options.processor(paper, converter).fetchIfNotAnnotated(ctx)
+		}},
+		{Name: "Convert and annotate", Workers: options.ProcessWorkers, Run: func(paper Paper) error {
+			return options.processor(paper, converter).annotateIfNotAnnotated(dictionaries)
+		}},
+		{Name: "Upload", Workers: options.UploadWorkers, Run: func(paper Paper) error {
+			return options.processor(paper, converter).UploadPaper(ctx, sciSourceClient)
+		}},
+	})
+	err = options.finishDryRun(sciSourceClient)
+	if err != nil {
+		return err
+	}
+	return summaryToError(summary)
+}
+
+func fetchCommand(ctx context.Context, args []string) error {
+
+	var options ingestOptions
+	flags := flag.NewFlagSet("fetch", flag.ExitOnError)
+	options.addFeedFlags(flags)
+	options.addFetchFlags(flags)
+	options.addFetchWorkerFlags(flags)
+	flags.Parse(args)
+
+	library, err := options.loadLibrary()
+	if err != nil {
+		return err
+	}
+	options.europePMC, err = options.europePMCClient()
+	if err != nil {
+		return err
+	}
+
+	summary := processLibrary(ctx, library, "Fetch", options.FetchWorkers, func(paper Paper) error {
+		return options.processor(paper, nil).FetchPaper(ctx)
+	})
+	return summaryToError(summary)
+}
+
+func convertCommand(ctx context.Context, args []string) error {
+
+	var options ingestOptions
+	flags := flag.NewFlagSet("convert", flag.ExitOnError)
+	options.addFeedFlags(flags)
+	options.addConverterFlags(flags)
+	options.addProcessWorkerFlags(flags)
+	options.addForceFlag(flags, "Convert papers even if they have already been converted.")
+	flags.Parse(args)
+
+	library, err := options.loadLibrary()
+	if err != nil {
+		return err
+	}
+	converter, err := options.loadConverter()
+	if err != nil {
+		return err
+	}
+	defer closeConverter(converter)
+
+	summary := processLibrary(ctx, library, "Convert", options.ProcessWorkers, func(paper Paper) error {
+		return options.processor(paper, converter).ConvertPaper(options.Force)
+	})
+	return summaryToError(summary)
+}
+
+func annotateCommand(ctx context.Context, args []string) error {
+
+	var options ingestOptions
+	flags := flag.NewFlagSet("annotate", flag.ExitOnError)
+	options.addFeedFlags(flags)
+	options.addDictionaryFlags(flags)
+	options.addProcessWorkerFlags(flags)
+	options.addForceFlag(flags, "Annotate papers again even if they have already been annotated, so long as they've not been uploaded.")
+	flags.Parse(args)
+
+	library, err := options.loadLibrary()
+	if err != nil {
+		return err
+	}
+	dictionaries, err := options.loadDictionaries()
+	if err != nil {
+		return err
+	}
+	options.annotation, err = options.annotationOptions(dictionaries)
+	if err != nil {
+		return err
+	}
+
+	summary := processLibrary(ctx, library, "Annotate", options.ProcessWorkers, func(paper Paper) error {
+		return options.processor(paper, nil).AnnotatePaper(dictionaries, options.Force)
+	})
+	return summaryToError(summary)
+}
+
+func reannotateCommand(ctx context.Context, args []string) error {
+
+	var options ingestOptions
+	flags := flag.NewFlagSet("reannotate", flag.ExitOnError)
+	options.addFeedFlags(flags)
+	options.addDictionaryFlags(flags)
+	options.addProcessWorkerFlags(flags)
+	flags.BoolVar(&options.Apply, "apply", false, "Update the state of stale papers to match the new annotations, ready to be uploaded again. Otherwise just write out what would change.")
+	flags.Parse(args)
+
+	library, err := options.loadLibrary()
+	if err != nil {
+		return err
+	}
+	dictionaries, err := options.loadDictionaries()
+	if err != nil {
+		return err
+	}
+	options.annotation, err = options.annotationOptions(dictionaries)
+	if err != nil {
+		return err
+	}
+
+	var stale, changed int64
+	summary := processLibrary(ctx, library, "Reannotate", options.ProcessWorkers, func(paper Paper) error {
+		processor := options.processor(paper, nil)
+		// Papers that haven't been annotated yet will be annotated with the current dictionaries
+		if annotated, err := processor.isAnnotated(); err != nil || !annotated {
+			return err
+		}
+		diff, err := processor.ReannotatePaper(dictionaries, options.Apply)
+		if err != nil || diff == nil {
+			return err
+		}
+		atomic.AddInt64(&stale, 1)
+		if !diff.IsEmpty() {
+			atomic.AddInt64(&changed, 1)
+		}
+		return nil
+	})
+
+	log.Printf("Found %d papers annotated with older dictionaries, %d of which have different annotations", stale, changed)
+	if changed > 0 && !options.Apply {
+		log.Printf("See annotation-diff.json in each paper's folder, and run again with -apply to update them")
+	}
+	return summaryToError(summary)
+}
+
+func migrateCommand(ctx context.Context, args []string) error {
+
+	var options ingestOptions
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	options.addFeedFlags(flags)
+	options.addOffsetUnitFlag(flags)
+	options.addProcessWorkerFlags(flags)
+	flags.Parse(args)
+
+	unit, err := ParseOffsetUnit(options.OffsetUnit)
+	if err != nil {
+		return err
+	}
+	library, err := options.loadLibrary()
+	if err != nil {
+		return err
+	}
+
+	var changed int64
+	summary := processLibrary(ctx, library, "Migrate", options.ProcessWorkers, func(paper Paper) error {
+		processor := options.processor(paper, nil)
+		if annotated, err := processor.isAnnotated(); err != nil || !annotated {
+			return err
+		}
+		migrated, err := processor.MigrateOffsets(unit)
+		if migrated {
+			atomic.AddInt64(&changed, 1)
+		}
+		return err
+	})
+
+	log.Printf("Offsets changed in %d papers, any already uploaded will have their claims updated by the next upload", changed)
+	return summaryToError(summary)
+}
+
+func uploadCommand(ctx context.Context, args []string) error {
+
+	var options ingestOptions
+	flags := flag.NewFlagSet("upload", flag.ExitOnError)
+	options.addFeedFlags(flags)
+	options.addWikibaseFlags(flags)
+	options.addUploadWorkerFlags(flags)
+	flags.Parse(args)
+
+	library, err := options.loadLibrary()
+	if err != nil {
+		return err
+	}
+	sciSourceClient, err := options.connectToScienceSource()
+	if err != nil {
+		return err
+	}
+
+	summary := processLibrary(ctx, library, "Upload", options.UploadWorkers, func(paper Paper) error {
+		return options.processor(paper, nil).UploadPaper(ctx, sciSourceClient)
+	})
+	err = options.finishDryRun(sciSourceClient)
+	if err != nil {
+		return err
+	}
+	return summaryToError(summary)
+}
+
+func statusCommand(ctx context.Context, args []string) error {
+
+	var options ingestOptions
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	options.addFeedFlags(flags)
+	flags.Parse(args)
+
+	library, err := options.loadLibrary()
+	if err != nil {
+		return err
+	}
+
+	counts := make(map[PaperStage]int)
+	for _, paper := range library {
+		status := options.processor(paper, nil).Status()
+		counts[status.Stage] += 1
+		fmt.Println(status)
+	}
+
+	fmt.Println()
+	for stage := PaperStageNew; stage <= PaperStageComplete; stage++ {
+		fmt.Printf("%-10s %d\n", stage, counts[stage])
+	}
+
+	return nil
+}
+
+func verifyCommand(ctx context.Context, args []string) error {
+
+	var options ingestOptions
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	options.addFeedFlags(flags)
+	flags.Parse(args)
+
+	library, err := options.loadLibrary()
+	if err != nil {
+		return err
+	}
+
+	problems := 0
+	for _, paper := range library {
+		for _, problem := range options.processor(paper, nil).Verify() {
+			fmt.Printf("%s: %s\n", paper.ID(), problem)
+			problems += 1
+		}
+	}
+
+	if problems > 0 {
+		return fmt.Errorf("Found %d problems", problems)
+	}
+	log.Printf("No problems found")
+	return nil
+}
+
+func reportCommand(ctx context.Context, args []string) error {
+
+	var options ingestOptions
+	var format, reportPath string
+	var minCooccurrence int
+	flags := flag.NewFlagSet("report", flag.ExitOnError)
+	flags.StringVar(&options.TargetPath, "output", ".", "Directory the papers were processed into.")
+	flags.StringVar(&format, "format", "json", "Report format: json, or csv for a file each for dictionaries, entries, and co-occurrences.")
+	flags.StringVar(&reportPath, "report", "", "Where to write the report, without the extension. Defaults to hit-report in the output directory.")
+	flags.IntVar(&minCooccurrence, "min-cooccurrence", DefaultMinCooccurrence, "Only report pairs of entries found together in at least this many papers.")
+	flags.Parse(args)
+
+	if len(reportPath) == 0 {
+		reportPath = defaultHitReportPrefix(options.TargetPath)
+	}
+	if format != "json" && format != "csv" {
+		return fmt.Errorf("Unknown report format %s, expected json or csv", format)
+	}
+
+	articles, err := loadStateFiles(options.TargetPath)
+	if err != nil {
+		return err
+	}
+	report := BuildHitReport(articles, minCooccurrence)
+	log.Printf("Found %d entries from %d dictionaries in %d papers", len(report.Entries), len(report.Dictionaries), report.Papers)
+
+	if format == "json" {
+		err = report.SaveJSON(reportPath + ".json")
+		if err != nil {
+			return err
+		}
+		log.Printf("Report written to %s.json", reportPath)
+		return nil
+	}
+
+	filenames, err := report.SaveCSV(reportPath)
+	if err != nil {
+		return err
+	}
+	log.Printf("Report written to %s", strings.Join(filenames, ", "))
+	return nil
+}
@@ -0,0 +1,282 @@
+//   Copyright 2018 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"embed"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+
+	"github.com/hashicorp/errwrap"
+)
+
+// A PaperConverter turns the JATS XML we fetch from Europe PMC into the HTML body we upload
+// to the wiki and the plain text we run the dictionaries over.
+type PaperConverter interface {
+	ConvertToHTML(xmlFileName string, w io.Writer) error
+	ConvertToText(xmlFileName string, w io.Writer) error
+}
+
+// A TextHTMLMapper is a PaperConverter that can also say where the text it makes ends up in
+// the HTML it makes. The XSLT converter can't, as xsltproc doesn't tell us.
+type TextHTMLMapper interface {
+	MapTextToHTML(xmlFileName string) (TextHTMLMap, error)
+}
+
+// A TextSectioner is a PaperConverter that can also say which part of the paper each bit of the
+// text it makes came from.
+type TextSectioner interface {
+	SectionText(xmlFileName string) (TextSections, error)
+}
+
+const (
+	ConverterNative string = "native"
+	ConverterXSLT   string = "xslt"
+)
+
+const (
+	xslHTMLStylesheet string = "jats-parsoid.xsl"
+	xslTextStylesheet string = "jats-text.xsl"
+)
+
+var xsl_file_list = []string{xslTextStylesheet, xslHTMLStylesheet, "jats-common.xsl"}
+
+// The stylesheets are built into the binary so that the tool can be run from anywhere
+//
+//go:embed xsl/*.xsl
+var embeddedStylesheets embed.FS
+
+func NewPaperConverter(name string, xsltProcPath string, xslDirectory string) (PaperConverter, error) {
+	switch name {
+	case ConverterNative:
+		return NativeConverter{}, nil
+	case ConverterXSLT:
+		return NewXSLTConverter(xsltProcPath, xslDirectory)
+	default:
+		return nil, fmt.Errorf("Unknown converter %s, expected %s or %s", name, ConverterNative, ConverterXSLT)
+	}
+}
+
+// closeConverter tidies up after converters that leave things on disk
+func closeConverter(converter PaperConverter) {
+	if closer, ok := converter.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+// XSLTConverter is the original conversion path, which shells out to xsltproc. It is kept so
+// that we can diff its output against the NativeConverter.
+type XSLTConverter struct {
+	ProcPath      string
+	StylesheetDir string
+
+	// set if StylesheetDir is a temporary copy of the embedded stylesheets
+	extracted bool
+}
+
+// NewXSLTConverter makes a converter using the XSL files in xslDirectory, or if that is empty
+// a copy of the stylesheets built into the program. The stylesheets include each other by
+// relative path, which is why they're written out to a directory rather than fed to xsltproc
+// on stdin.
+func NewXSLTConverter(procPath string, xslDirectory string) (*XSLTConverter, error) {
+
+	fullProcPath, err := exec.LookPath(procPath)
+	if err != nil {
+		return nil, errwrap.Wrapf("Failed to find xsltproc: {{err}}", err)
+	}
+
+	converter := &XSLTConverter{ProcPath: fullProcPath, StylesheetDir: xslDirectory}
+
+	if len(xslDirectory) == 0 {
+		converter.StylesheetDir, err = extractEmbeddedStylesheets()
+		if err != nil {
+			return nil, errwrap.Wrapf("Failed to extract XSL files: {{err}}", err)
+		}
+		converter.extracted = true
+	}
+
+	// Check we can find the required XSL files up front, just to ensure better error reporting
+	// to the humans.
+	for _, xsl_file := range xsl_file_list {
+		if _, err := os.Stat(path.Join(converter.StylesheetDir, xsl_file)); os.IsNotExist(err) {
+			converter.Close()
+			return nil, fmt.Errorf("XSL file %s does not exist in %s.", xsl_file, converter.StylesheetDir)
+		}
+	}
+
+	return converter, nil
+}
+
+func extractEmbeddedStylesheets() (string, error) {
+
+	dir, err := ioutil.TempDir("", "sciencesourceingest-xsl")
+	if err != nil {
+		return "", err
+	}
+
+	for _, xsl_file := range xsl_file_list {
+		data, err := embeddedStylesheets.ReadFile("xsl/" + xsl_file)
+		if err == nil {
+			err = ioutil.WriteFile(path.Join(dir, xsl_file), data, 0644)
+		}
+		if err != nil {
+			os.RemoveAll(dir)
+			return "", err
+		}
+	}
+
+	return dir, nil
+}
+
+// Close removes the stylesheets if we extracted them
+func (converter *XSLTConverter) Close() error {
+	if !converter.extracted {
+		return nil
+	}
+	converter.extracted = false
+	return os.RemoveAll(converter.StylesheetDir)
+}
+
+func (converter *XSLTConverter) command(stylesheet string, xmlFileName string) *exec.Cmd {
+	return &exec.Cmd{
+		Path: converter.ProcPath,
+		Args: []string{"xsltproc", path.Join(converter.StylesheetDir, stylesheet), xmlFileName},
+	}
+}
+
+func (converter *XSLTConverter) ConvertToHTML(xmlFileName string, w io.Writer) error {
+
+	cmd := converter.command(xslHTMLStylesheet, xmlFileName)
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return errwrap.Wrapf("Error generating output handle for xsltproc: {{err}}", err)
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return errwrap.Wrapf("Error generating error handle for xsltproc: {{err}}", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return errwrap.Wrapf("Error running xsltproc: {{err}}", err)
+	}
+
+	// We need to ditch the '<!DOCTYPE html>' (15 characters) from the start of the XSLT
+	c := 0
+	for count := len("<!DOCTYPE html>"); count > 0; count -= c {
+		stash := make([]byte, count)
+		c, err = stdout.Read(stash)
+		if err != nil {
+			errprose, _ := ioutil.ReadAll(stderr)
+			errtext := fmt.Sprintf("Error typing to find DOCTYPE tag: {{err}}. Error output from xsltproc: %s", errprose)
+			return errwrap.Wrapf(errtext, err)
+		}
+	}
+
+	_, err = io.Copy(w, stdout)
+	if err != nil {
+		return errwrap.Wrapf("Error copying file contents: {{err}}", err)
+	}
+
+	if err := cmd.Wait(); err != nil {
+		errprose, _ := ioutil.ReadAll(stderr)
+		errtext := fmt.Sprintf("Error when waiting for xsltproc: {{err}}. Error output from xsltproc: %s", errprose)
+		return errwrap.Wrapf(errtext, err)
+	}
+
+	return nil
+}
+
+func (converter *XSLTConverter) ConvertToText(xmlFileName string, w io.Writer) error {
+
+	cmd := converter.command(xslTextStylesheet, xmlFileName)
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return errwrap.Wrapf("Error generating file handles for xsltproc: {{err}}", err)
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return errwrap.Wrapf("Error generating error handle for xsltproc: {{err}}", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return errwrap.Wrapf("Error running xsltproc: {{err}}", err)
+	}
+
+	_, copy_err := io.Copy(w, stdout)
+	if copy_err != nil {
+		return errwrap.Wrapf("Error copying file contents: {{err}}", copy_err)
+	}
+
+	if err := cmd.Wait(); err != nil {
+		errprose, _ := ioutil.ReadAll(stderr)
+		errtext := fmt.Sprintf("Error when waiting for xsltproc: {{err}}. Error output from xsltproc: %s", errprose)
+		return errwrap.Wrapf(errtext, err)
+	}
+
+	return nil
+}
+
+// NativeConverter does the same job as the XSL files but in process, so we don't need
+// xsltproc installed.
+type NativeConverter struct{}
+
+func (converter NativeConverter) ConvertToHTML(xmlFileName string, w io.Writer) error {
+
+	doc, err := loadJATSDocument(xmlFileName)
+	if err != nil {
+		return errwrap.Wrapf("Error parsing JATS XML: {{err}}", err)
+	}
+
+	result := newJATSTransformer(doc, false).transform()
+	return writeResultAsHTML(w, result)
+}
+
+func (converter NativeConverter) ConvertToText(xmlFileName string, w io.Writer) error {
+
+	doc, err := loadJATSDocument(xmlFileName)
+	if err != nil {
+		return errwrap.Wrapf("Error parsing JATS XML: {{err}}", err)
+	}
+
+	result := newJATSTransformer(doc, true).transform()
+	_, err = io.WriteString(w, result.textContent())
+	return err
+}
+
+func (converter NativeConverter) MapTextToHTML(xmlFileName string) (TextHTMLMap, error) {
+
+	doc, err := loadJATSDocument(xmlFileName)
+	if err != nil {
+		return TextHTMLMap{}, errwrap.Wrapf("Error parsing JATS XML: {{err}}", err)
+	}
+
+	text := newJATSTransformer(doc, true).transform()
+	html := newJATSTransformer(doc, false).transform()
+	return buildTextHTMLMap(text, html), nil
+}
+
+func (converter NativeConverter) SectionText(xmlFileName string) (TextSections, error) {
+
+	doc, err := loadJATSDocument(xmlFileName)
+	if err != nil {
+		return TextSections{}, errwrap.Wrapf("Error parsing JATS XML: {{err}}", err)
+	}
+
+	return buildTextSections(newJATSTransformer(doc, true).transform()), nil
+}
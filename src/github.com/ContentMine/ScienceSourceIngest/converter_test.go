@@ -0,0 +1,245 @@
+//   Copyright 2018 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestEmbeddedStylesheetsExtracted(t *testing.T) {
+
+	dir, err := extractEmbeddedStylesheets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, xsl_file := range xsl_file_list {
+		data, err := ioutil.ReadFile(path.Join(dir, xsl_file))
+		if err != nil {
+			t.Errorf("Failed to read extracted %s: %v", xsl_file, err)
+		} else if !bytes.Contains(data, []byte("xsl:stylesheet")) {
+			t.Errorf("Extracted %s does not look like a stylesheet", xsl_file)
+		}
+	}
+}
+
+func TestXSLTConverterChecksStylesheetDirectory(t *testing.T) {
+
+	procPath, err := exec.LookPath("xsltproc")
+	if err != nil {
+		t.Skip("xsltproc not installed")
+	}
+
+	dir, err := ioutil.TempDir("", "sciencesourceingest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, err = NewXSLTConverter(procPath, dir)
+	if err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Errorf("Expected missing XSL files to be reported, got %v", err)
+	}
+
+	converter, err := NewXSLTConverter(procPath, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stylesheets := converter.StylesheetDir
+	defer converter.Close()
+
+	var text bytes.Buffer
+	err = converter.ConvertToText(path.Join("testdata", "PMC1234567.xml"), &text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(text.String(), "cholera") {
+		t.Errorf("Expected converted text to contain the paper body")
+	}
+
+	converter.Close()
+	if _, err := os.Stat(stylesheets); !os.IsNotExist(err) {
+		t.Errorf("Expected extracted stylesheets to be removed on close")
+	}
+}
+
+func TestXSLTConverterMissingProc(t *testing.T) {
+	_, err := NewXSLTConverter("/nonexistent/xsltproc", "")
+	if err == nil {
+		t.Errorf("Expected an error for a missing xsltproc")
+	}
+}
+
+// The golden files are the output of the XSLT converter for the test paper, made with xsltproc
+// (libxslt 1.1.35). The native converter must make the same text byte for byte, and the same
+// HTML apart from layout: xsltproc puts line breaks after the HTML 4 block elements it knows
+// about, and single quotes round attributes containing double quotes, neither of which change
+// the page.
+
+const goldenPaper string = "PMC1234567"
+
+func readGoldenFile(t *testing.T, suffix string) []byte {
+	t.Helper()
+	data, err := ioutil.ReadFile(path.Join("testdata", goldenPaper+".xslt"+suffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// htmlTokens turns HTML into a list of tags and text for comparison, dropping the whitespace
+// serialisers add between elements
+func htmlTokens(t *testing.T, data []byte) []string {
+	t.Helper()
+
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	decoder.Strict = false
+	decoder.AutoClose = xml.HTMLAutoClose
+	decoder.Entity = xml.HTMLEntity
+
+	tokens := make([]string, 0)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to parse HTML: %v", err)
+		}
+		switch token := token.(type) {
+		case xml.StartElement:
+			tag := "<" + token.Name.Local
+			for _, attr := range token.Attr {
+				tag += fmt.Sprintf(" %s=%q", attr.Name.Local, attr.Value)
+			}
+			tokens = append(tokens, tag+">")
+		case xml.EndElement:
+			tokens = append(tokens, "</"+token.Name.Local+">")
+		case xml.CharData:
+			text := string(token)
+			if strings.TrimSpace(text) == "" && strings.Contains(text, "\n") {
+				continue
+			}
+			tokens = append(tokens, text)
+		}
+	}
+	return tokens
+}
+
+func compareHTMLTokens(t *testing.T, expected []string, actual []string) {
+	t.Helper()
+	for i := 0; i < len(expected) && i < len(actual); i++ {
+		if expected[i] != actual[i] {
+			t.Fatalf("HTML differs at token %d: expected %q, got %q", i, expected[i], actual[i])
+		}
+	}
+	if len(expected) != len(actual) {
+		t.Fatalf("Expected %d HTML tokens, got %d", len(expected), len(actual))
+	}
+}
+
+func checkConverterMatchesGolden(t *testing.T, converter PaperConverter) {
+	t.Helper()
+
+	xmlFileName := path.Join("testdata", goldenPaper+".xml")
+
+	var text bytes.Buffer
+	if err := converter.ConvertToText(xmlFileName, &text); err != nil {
+		t.Fatal(err)
+	}
+	if expected := readGoldenFile(t, ".txt"); !bytes.Equal(text.Bytes(), expected) {
+		t.Errorf("Text differs from XSLT output:\n%q\n%q", expected, text.Bytes())
+	}
+
+	var html bytes.Buffer
+	if err := converter.ConvertToHTML(xmlFileName, &html); err != nil {
+		t.Fatal(err)
+	}
+	compareHTMLTokens(t, htmlTokens(t, readGoldenFile(t, ".html")), htmlTokens(t, html.Bytes()))
+}
+
+func TestNativeConverterMatchesXSLT(t *testing.T) {
+	checkConverterMatchesGolden(t, NativeConverter{})
+}
+
+// If xsltproc is around, check the golden files are still what the stylesheets make
+func TestXSLTConverterMatchesGolden(t *testing.T) {
+
+	procPath, err := exec.LookPath("xsltproc")
+	if err != nil {
+		t.Skip("xsltproc not installed")
+	}
+	converter, err := NewXSLTConverter(procPath, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer converter.Close()
+
+	checkConverterMatchesGolden(t, converter)
+}
+
+func findResultElement(n *resultNode, tag string) *resultNode {
+	if n.Tag == tag {
+		return n
+	}
+	for _, child := range n.Children {
+		if found := findResultElement(child, tag); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+func TestReferenceDataMWIsJSON(t *testing.T) {
+
+	doc, err := parseJATSDocument(strings.NewReader(`<article><body><p>See <xref ref-type="bibr" rid="B&quot;1\">1</xref>.</p></body></article>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sup := findResultElement(newJATSTransformer(doc, false).transform(), "sup")
+	if sup == nil {
+		t.Fatal("Expected a reference")
+	}
+
+	var data struct {
+		Attrs struct {
+			Name string `json:"name"`
+		} `json:"attrs"`
+		Body struct {
+			ID string `json:"id"`
+		} `json:"body"`
+	}
+	for _, attr := range sup.Attr {
+		if attr.Name == "data-mw" {
+			if err := json.Unmarshal([]byte(attr.Value), &data); err != nil {
+				t.Fatalf("Reference data-mw is not JSON: %v", err)
+			}
+		}
+	}
+	if data.Attrs.Name != `B"1\` || data.Body.ID != `mw-reference-text-cite_note-B"1\` {
+		t.Errorf("Unexpected reference data %v", data)
+	}
+}
@@ -15,13 +15,22 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
 
 	"github.com/ContentMine/ahocorasick"
+	"github.com/hashicorp/errwrap"
 )
 
 type DictionaryLog struct {
@@ -38,23 +47,75 @@ type DictionaryEntryIdentifiers struct {
 type DictionaryEntry struct {
 	Name        string                     `json:"name"`
 	Term        string                     `json:"term"`
+	Synonyms    []string                   `json:"synonyms,omitempty"`
 	Identifiers DictionaryEntryIdentifiers `json:"identifiers"`
+
+	// A regular expression for things that can't be listed as terms, such as accession numbers.
+	// It is matched against the paper text as is, rather than normalised.
+	Pattern string `json:"pattern,omitempty"`
+}
+
+// PreferredLabel is the canonical name for the entry, whichever of its terms was found
+func (entry DictionaryEntry) PreferredLabel() string {
+	if len(entry.Name) > 0 {
+		return entry.Name
+	}
+	return entry.Term
 }
 
 type Dictionary struct {
-	Identifier string            `json:"id"`
-	Log        []DictionaryLog   `json:"log"`
-	Entries    []DictionaryEntry `json:"entries"`
+	Identifier string                 `json:"id"`
+	Log        []DictionaryLog        `json:"log"`
+	Options    DictionaryMatchOptions `json:"options"`
+	Entries    []DictionaryEntry      `json:"entries"`
+
+	Matcher *ahocorasick.Matcher `json:"-"`
+	// Match updates counters inside the matcher as it goes, so only one paper can use it at once
+	matcherLock *sync.Mutex
 
-	Matcher *ahocorasick.Matcher
+	// The terms as given to the matcher, indexed by the matcher's hit key
+	matchTerms []matchTerm
+	// The compiled patterns of any entries that have them
+	matchPatterns []matchPattern
+	// Hash of everything that affects what the dictionary matches
+	fingerprint string
 }
 
+// matchTerm is one of an entry's term or synonyms
+type matchTerm struct {
+	// What we give the matcher, after any normalisation
+	Text string
+	// The term or synonym as it is in the dictionary
+	Term  string
+	Entry int
+	// Set for acronyms when folding case, which must still match the case in the dictionary
+	// so that "AIDS" isn't found in every paper that "aids" something
+	CaseSensitive bool
+	CaseText      string
+}
+
+type matchPattern struct {
+	Regexp *regexp.Regexp
+	Entry  int
+}
+
+// DictionaryMatch is a hit in the original text, so Length may differ from the length of the
+// entry's term if the dictionary normalises text before matching.
 type DictionaryMatch struct {
 	Offset     int
+	Length     int
+	Term       string
 	Entry      DictionaryEntry
 	Dictionary *Dictionary
 }
 
+// DictionaryMatchStats counts what the matcher found in a paper before we filtered it
+type DictionaryMatchStats struct {
+	Hits                int
+	RejectedWithinWords int
+	RejectedCase        int
+}
+
 // Sorting interface for hits using the ahocorasick Matcher
 
 type DictionaryMatchesByOffset []DictionaryMatch
@@ -65,28 +126,178 @@ func (a DictionaryMatchesByOffset) Less(i, j int) bool { return a[i].Offset < a[
 
 // Parsing
 
+// dictionaryLoaders reads each of the dictionary formats we support, by file extension. All but
+// the ContentMine JSON format are in dictionaryformats.go.
+var dictionaryLoaders = map[string]func(filename string) (Dictionary, error){
+	".json": loadJSONDictionary,
+	".csv":  loadCSVDictionary,
+	".tsv":  loadTSVDictionary,
+	".ttl":  loadTurtleDictionary,
+	".rdf":  loadRDFXMLDictionary,
+	".obo":  loadOBODictionary,
+}
+
+func isDictionaryFile(filename string) bool {
+	_, prs := dictionaryLoaders[strings.ToLower(filepath.Ext(filename))]
+	return prs
+}
+
+// LoadDictionaryFromFile loads and validates a dictionary, failing if it has any errors. Warnings
+// are left for the caller to report.
 func LoadDictionaryFromFile(path string) (Dictionary, error) {
+
+	dict, err := loadDictionary(path)
+	if err != nil {
+		return Dictionary{}, err
+	}
+
+	invalid := dict.Validate().Errors()
+	if len(invalid) > 0 {
+		return Dictionary{}, fmt.Errorf("Dictionary %s has %d errors, the first being %v. Run dictionary lint for the full list", path, len(invalid), invalid[0])
+	}
+
+	return dict, nil
+}
+
+// loadDictionary loads a dictionary of any format without validating it
+func loadDictionary(path string) (Dictionary, error) {
+
+	loader, prs := dictionaryLoaders[strings.ToLower(filepath.Ext(path))]
+	if !prs {
+		return Dictionary{}, fmt.Errorf("Unrecognised dictionary format for %s", path)
+	}
+
+	dict, err := loader(path)
+	if err != nil {
+		return Dictionary{}, errwrap.Wrapf(fmt.Sprintf("Failed to load dictionary %s: {{err}}", path), err)
+	}
+
+	err = dict.prepareMatcher()
+	if err != nil {
+		return Dictionary{}, errwrap.Wrapf(fmt.Sprintf("Failed to load dictionary %s: {{err}}", path), err)
+	}
+
+	return dict, nil
+}
+
+func loadJSONDictionary(path string) (Dictionary, error) {
 	var dict Dictionary
 
 	f, err := os.Open(path)
 	if err != nil {
 		return Dictionary{}, err
 	}
+	defer f.Close()
 
 	err = json.NewDecoder(f).Decode(&dict)
 	if err != nil {
 		return Dictionary{}, err
 	}
 
-	raw := make([]string, len(dict.Entries))
+	return dict, nil
+}
+
+// prepareMatcher sets up the matcher for all the entries' terms and synonyms, and compiles any
+// patterns
+func (dict *Dictionary) prepareMatcher() error {
+
+	dict.matchTerms = make([]matchTerm, 0, len(dict.Entries))
+	dict.matchPatterns = make([]matchPattern, 0)
 
 	for idx, entry := range dict.Entries {
-		raw[idx] = entry.Term
+		if len(entry.Pattern) > 0 {
+			// There's no term to fall back on for the preferred label
+			if len(entry.Name) == 0 {
+				return fmt.Errorf("Entry %d has a pattern but no name", idx)
+			}
+			pattern := entry.Pattern
+			if dict.Options.FoldCase {
+				pattern = "(?i)" + pattern
+			}
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return errwrap.Wrapf(fmt.Sprintf("Entry %d (%s) has a bad pattern: {{err}}", idx, entry.Name), err)
+			}
+			dict.matchPatterns = append(dict.matchPatterns, matchPattern{Regexp: re, Entry: idx})
+		}
+
+		seen := make(map[string]bool)
+		for _, term := range append([]string{entry.Term}, entry.Synonyms...) {
+			text := dict.matchText(term)
+			// Synonyms often only differ from the term in ways normalisation removes
+			if len(text) == 0 || seen[text] {
+				continue
+			}
+			seen[text] = true
+			match := matchTerm{Text: text, Term: term, Entry: idx}
+			if dict.Options.FoldCase && isAcronym(term) {
+				match.CaseSensitive = true
+				match.CaseText = dict.caseText(term)
+			}
+			dict.matchTerms = append(dict.matchTerms, match)
+		}
+	}
+
+	raw := make([]string, len(dict.matchTerms))
+	for idx, term := range dict.matchTerms {
+		raw[idx] = term.Text
 	}
 
 	dict.Matcher = ahocorasick.NewStringMatcher(raw)
+	dict.matcherLock = &sync.Mutex{}
+	dict.fingerprint = dict.computeFingerprint()
 
-	return dict, nil
+	return nil
+}
+
+// matchText is the term as we give it to the matcher
+func (dict Dictionary) matchText(term string) string {
+	if dict.Options.normalises() {
+		return string(normaliseText([]byte(term), dict.Options).Text)
+	}
+	return term
+}
+
+// caseText is the term normalised as for the matcher but with its case left alone
+func (dict Dictionary) caseText(term string) string {
+	options := dict.Options
+	options.FoldCase = false
+	return string(normaliseText([]byte(term), options).Text)
+}
+
+// isAcronym is true for terms with more than one letter and no lower case ones, such as "AIDS" or
+// "HIV-1"
+func isAcronym(term string) bool {
+	letters := 0
+	for _, r := range term {
+		if unicode.IsLower(r) {
+			return false
+		}
+		if unicode.IsLetter(r) {
+			letters += 1
+		}
+	}
+	return letters > 1
+}
+
+// Fingerprint identifies the version of the dictionary, so that we can tell which papers were
+// annotated with an older one. The log is left out, as it doesn't change what is matched.
+func (dict Dictionary) Fingerprint() string {
+	if len(dict.fingerprint) == 0 {
+		return dict.computeFingerprint()
+	}
+	return dict.fingerprint
+}
+
+func (dict Dictionary) computeFingerprint() string {
+	// This can't fail, as everything in a dictionary was unmarshalled from JSON
+	data, _ := json.Marshal(struct {
+		Identifier string                 `json:"id"`
+		Options    DictionaryMatchOptions `json:"options"`
+		Entries    []DictionaryEntry      `json:"entries"`
+	}{dict.Identifier, dict.Options, dict.Entries})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
 }
 
 func LoadDictionariesFromDirectory(directory_path string) ([]Dictionary, error) {
@@ -100,7 +311,7 @@ func LoadDictionariesFromDirectory(directory_path string) ([]Dictionary, error)
 
 	for _, f := range files {
 		p := path.Join(directory_path, f.Name())
-		if filepath.Ext(p) == ".json" {
+		if !f.IsDir() && isDictionaryFile(p) {
 			dict, err := LoadDictionaryFromFile(p)
 			if err != nil {
 				return nil, err
@@ -114,19 +325,72 @@ func LoadDictionariesFromDirectory(directory_path string) ([]Dictionary, error)
 
 // Helper functions
 
-func (d Dictionary) FindMatches(prose []byte) []DictionaryMatch {
+func (d Dictionary) FindMatches(prose []byte) ([]DictionaryMatch, DictionaryMatchStats) {
 
-	hits := d.Matcher.Match(prose)
+	var normalised normalisedText
+	text := prose
+	if d.Options.normalises() {
+		normalised = normaliseText(prose, d.Options)
+		text = normalised.Text
+	}
 
-	res := make([]DictionaryMatch, len(hits))
+	d.matcherLock.Lock()
+	hits := d.Matcher.Match(text)
+	d.matcherLock.Unlock()
+	stats := DictionaryMatchStats{Hits: len(hits)}
+
+	res := make([]DictionaryMatch, 0, len(hits))
 	for i := 0; i < len(hits); i++ {
 		hit := hits[i]
-		res[i] = DictionaryMatch{
-			Offset:     hit.Position,
-			Entry:      d.Entries[hit.Key],
+		term := d.matchTerms[hit.Key]
+		start, end := hit.Position, hit.Position+len(term.Text)
+		if d.Options.normalises() {
+			start, end = normalised.originalSpan(hit.Position, len(term.Text))
+		}
+
+		if !d.Options.MatchWithinWords && !isWholeWord(prose, start, end) {
+			stats.RejectedWithinWords += 1
+			continue
+		}
+		if term.CaseSensitive && d.caseText(string(prose[start:end])) != term.CaseText {
+			stats.RejectedCase += 1
+			continue
+		}
+
+		res = append(res, DictionaryMatch{
+			Offset:     start,
+			Length:     end - start,
+			Term:       term.Term,
+			Entry:      d.Entries[term.Entry],
 			Dictionary: &d,
+		})
+	}
+
+	// Patterns are matched on the original text, so the offsets need no mapping, and we know
+	// exactly how much of the text each one matched
+	if len(d.matchPatterns) > 0 {
+		for _, pattern := range d.matchPatterns {
+			for _, loc := range pattern.Regexp.FindAllIndex(prose, -1) {
+				start, end := loc[0], loc[1]
+				if start == end {
+					continue
+				}
+				stats.Hits += 1
+				if !d.Options.MatchWithinWords && !isWholeWord(prose, start, end) {
+					stats.RejectedWithinWords += 1
+					continue
+				}
+				res = append(res, DictionaryMatch{
+					Offset:     start,
+					Length:     end - start,
+					Term:       d.Entries[pattern.Entry].Pattern,
+					Entry:      d.Entries[pattern.Entry],
+					Dictionary: &d,
+				})
+			}
 		}
+		sort.Stable(DictionaryMatchesByOffset(res))
 	}
 
-	return res
+	return res, stats
 }
@@ -0,0 +1,265 @@
+//   Copyright 2018 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// loadTestDictionary writes the dictionary out and loads it back, so that it goes through the
+// same set up as a dictionary on disk
+func loadTestDictionary(t *testing.T, dictionary Dictionary) Dictionary {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "sciencesourceingest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data, err := json.Marshal(dictionary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := path.Join(dir, dictionary.Identifier+".json")
+	err = ioutil.WriteFile(filename, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := LoadDictionaryFromFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func testEntries(terms ...string) []DictionaryEntry {
+	entries := make([]DictionaryEntry, len(terms))
+	for i, term := range terms {
+		entries[i] = DictionaryEntry{Name: term, Term: term}
+	}
+	return entries
+}
+
+func matchedText(prose []byte, matches []DictionaryMatch) []string {
+	res := make([]string, len(matches))
+	for i, match := range matches {
+		res[i] = string(prose[match.Offset : match.Offset+match.Length])
+	}
+	return res
+}
+
+func TestNormaliseTextOffsets(t *testing.T) {
+
+	options := DictionaryMatchOptions{FoldCase: true, NormaliseUnicode: true, CollapseWhitespace: true, EquateDashes: true, EquateQuotes: true}
+	original := []byte("Café  Au‐Lait’s ﬁne")
+	normalised := normaliseText(original, options)
+
+	if string(normalised.Text) != "café au-lait's fine" {
+		t.Errorf("Unexpected normalised text %q", normalised.Text)
+	}
+	if len(normalised.starts) != len(normalised.Text) || len(normalised.ends) != len(normalised.Text) {
+		t.Fatalf("Offset map doesn't cover normalised text")
+	}
+
+	// "au-lait's" in the normalised text should map back to the original spelling
+	start, end := normalised.originalSpan(6, len("au-lait's"))
+	if string(original[start:end]) != "Au‐Lait’s" {
+		t.Errorf("Expected span to map back to original, got %q", original[start:end])
+	}
+	// a ligature maps back as a whole
+	start, end = normalised.originalSpan(16, len("fi"))
+	if string(original[start:end]) != "ﬁ" {
+		t.Errorf("Expected ligature to map back whole, got %q", original[start:end])
+	}
+}
+
+func TestFindMatchesNormalised(t *testing.T) {
+
+	prose := []byte("Malaria and yellow\n fever. Non‑steroidal drugs, and MALARIA again.")
+
+	exact := loadTestDictionary(t, Dictionary{Identifier: "exact", Entries: testEntries("malaria", "yellow fever", "non-steroidal")})
+	if matches, _ := exact.FindMatches(prose); len(matches) != 0 {
+		t.Errorf("Expected no exact matches, got %v", matchedText(prose, matches))
+	}
+
+	normalising := loadTestDictionary(t, Dictionary{
+		Identifier: "normalising",
+		Options:    DictionaryMatchOptions{FoldCase: true, NormaliseUnicode: true, CollapseWhitespace: true, EquateDashes: true},
+		Entries:    testEntries("malaria", "Yellow Fever", "non-steroidal"),
+	})
+	matches, _ := normalising.FindMatches(prose)
+	sort.Sort(DictionaryMatchesByOffset(matches))
+	found := matchedText(prose, matches)
+	expected := []string{"Malaria", "yellow\n fever", "Non‑steroidal", "MALARIA"}
+	if len(found) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, found)
+	}
+	for i := range expected {
+		if found[i] != expected[i] {
+			t.Errorf("Expected match %d to be %q, got %q", i, expected[i], found[i])
+		}
+	}
+}
+
+func TestFindMatchesSynonyms(t *testing.T) {
+
+	prose := []byte("Varicella, also called chickenpox or chicken pox, is not the same as smallpox.")
+
+	dictionary := loadTestDictionary(t, Dictionary{
+		Identifier: "synonyms",
+		Options:    DictionaryMatchOptions{FoldCase: true},
+		Entries: []DictionaryEntry{
+			{Name: "chickenpox", Term: "chickenpox", Synonyms: []string{"varicella", "chicken pox", "Chickenpox"}},
+			{Name: "smallpox", Term: "smallpox"},
+		},
+	})
+
+	matches, _ := dictionary.FindMatches(prose)
+	sort.Sort(DictionaryMatchesByOffset(matches))
+
+	expected := []struct {
+		found string
+		term  string
+		label string
+	}{
+		{"Varicella", "varicella", "chickenpox"},
+		{"chickenpox", "chickenpox", "chickenpox"},
+		{"chicken pox", "chicken pox", "chickenpox"},
+		{"smallpox", "smallpox", "smallpox"},
+	}
+	found := matchedText(prose, matches)
+	if len(found) != len(expected) {
+		t.Fatalf("Expected %d matches, got %v", len(expected), found)
+	}
+	for i, e := range expected {
+		if found[i] != e.found || matches[i].Term != e.term || matches[i].Entry.PreferredLabel() != e.label {
+			t.Errorf("Expected %s from %s for %s, got %s from %s for %s", e.found, e.term, e.label,
+				found[i], matches[i].Term, matches[i].Entry.PreferredLabel())
+		}
+	}
+}
+
+func TestFindMatchesAcronyms(t *testing.T) {
+
+	prose := []byte("Treatment aids recovery from AIDS and Aids, and from Malaria and HIV‑1.")
+
+	dictionary := loadTestDictionary(t, Dictionary{
+		Identifier: "acronyms",
+		Options:    DictionaryMatchOptions{FoldCase: true, EquateDashes: true},
+		Entries:    testEntries("AIDS", "malaria", "HIV-1"),
+	})
+
+	matches, stats := dictionary.FindMatches(prose)
+	sort.Sort(DictionaryMatchesByOffset(matches))
+	if found := matchedText(prose, matches); !reflect.DeepEqual(found, []string{"AIDS", "Malaria", "HIV‑1"}) {
+		t.Errorf("Unexpected matches %v", found)
+	}
+	if stats.Hits != 5 || stats.RejectedCase != 2 {
+		t.Errorf("Unexpected stats %v", stats)
+	}
+
+	for term, acronym := range map[string]bool{"AIDS": true, "HIV-1": true, "Aids": false, "A": false, "1918": false, "TB drug": false} {
+		if isAcronym(term) != acronym {
+			t.Errorf("Expected isAcronym(%q) to be %v", term, acronym)
+		}
+	}
+}
+
+func TestFindMatchesPatterns(t *testing.T) {
+
+	prose := []byte("Expression data are in GSE12345 and gse678, but not in the XGSE1 series, see GEO.")
+
+	dictionary := loadTestDictionary(t, Dictionary{
+		Identifier: "patterns",
+		Entries: []DictionaryEntry{
+			{Name: "GEO series", Pattern: `GSE[0-9]+`},
+			{Name: "Gene Expression Omnibus", Term: "GEO"},
+		},
+	})
+
+	matches, stats := dictionary.FindMatches(prose)
+	found := matchedText(prose, matches)
+	if !reflect.DeepEqual(found, []string{"GSE12345", "GEO"}) {
+		t.Fatalf("Unexpected matches %v", found)
+	}
+	if matches[0].Length != len("GSE12345") || matches[0].Term != `GSE[0-9]+` || matches[0].Entry.PreferredLabel() != "GEO series" {
+		t.Errorf("Unexpected match %v", matches[0])
+	}
+	if stats.Hits != 3 || stats.RejectedWithinWords != 1 {
+		t.Errorf("Unexpected stats %v", stats)
+	}
+
+	// Folding case applies to patterns too
+	dictionary.Options.FoldCase = true
+	dictionary = loadTestDictionary(t, dictionary)
+	matches, _ = dictionary.FindMatches(prose)
+	if found := matchedText(prose, matches); !reflect.DeepEqual(found, []string{"GSE12345", "gse678", "GEO"}) {
+		t.Errorf("Unexpected case folded matches %v", found)
+	}
+}
+
+func TestBadPatternsRejected(t *testing.T) {
+
+	for _, entry := range []DictionaryEntry{
+		{Name: "unbalanced", Pattern: `GSE([0-9]+`},
+		{Pattern: `GSE[0-9]+`},
+	} {
+		dictionary := Dictionary{Identifier: "bad", Entries: []DictionaryEntry{entry}}
+		if err := dictionary.prepareMatcher(); err == nil {
+			t.Errorf("Expected %v to be rejected", entry)
+		}
+	}
+}
+
+// Papers are annotated by several workers at once, all sharing the loaded dictionaries. Run with
+// -race to check they don't trip over each other.
+func TestFindMatchesConcurrently(t *testing.T) {
+
+	dictionary, err := LoadDictionaryFromFile(path.Join("testdata", "dictionaries", "infectiousdiseases.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	prose := []byte("Cases of malaria, cholera, and pneumonia.")
+	expected, _ := dictionary.FindMatches(prose)
+
+	var wg sync.WaitGroup
+	results := make([]int, 8)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				matches, _ := dictionary.FindMatches(prose)
+				results[i] = len(matches)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i, count := range results {
+		if count != len(expected) {
+			t.Errorf("Worker %d found %d matches, expected %d", i, count, len(expected))
+		}
+	}
+}
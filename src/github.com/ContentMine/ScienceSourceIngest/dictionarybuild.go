@@ -0,0 +1,230 @@
+//   Copyright 2018 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+)
+
+// Building dictionaries from Wikidata. The query should return one row per item, or per item
+// and label/alias language, with the item's URI, its label, and optionally its aliases. Those
+// are the item, itemLabel, and itemAltLabel variables you get from the wikibase label service,
+// though the variable names can be changed.
+
+const DefaultSPARQLEndpoint string = "https://query.wikidata.org/sparql"
+
+type SPARQLResults struct {
+	Header  Header `json:"head"`
+	Results struct {
+		Bindings []map[string]DataValue `json:"bindings"`
+	} `json:"results"`
+}
+
+type DictionaryBuildOptions struct {
+	Identifier string
+	// Languages to take labels and aliases from, with the first being used for the entry name
+	Languages []string
+
+	ItemVariable  string
+	LabelVariable string
+	AliasVariable string
+	// The label service gives all an item's aliases in one value, separated by ", "
+	AliasSeparator string
+}
+
+func LoadSPARQLResultsFromFile(filename string) (SPARQLResults, error) {
+
+	var results SPARQLResults
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return results, err
+	}
+	err = json.Unmarshal(data, &results)
+	return results, err
+}
+
+func FetchSPARQLResults(endpoint string, query string) (SPARQLResults, error) {
+
+	var results SPARQLResults
+
+	req, err := http.NewRequest("GET", endpoint+"?"+url.Values{"query": {query}, "format": {"json"}}.Encode(), nil)
+	if err != nil {
+		return results, err
+	}
+	req.Header.Set("Accept", "application/sparql-results+json")
+	req.Header.Set("User-Agent", fmt.Sprintf("ScienceSourceIngest/%s (%s)", Version, Remote))
+
+	client := &http.Client{Timeout: 5 * time.Minute}
+	resp, err := client.Do(req)
+	if err != nil {
+		return results, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return results, fmt.Errorf("Query failed with status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&results)
+	if err != nil {
+		return results, errwrap.Wrapf("Failed to decode query results: {{err}}", err)
+	}
+	return results, nil
+}
+
+func wikidataIDFromURI(uri string) string {
+	parts := strings.Split(uri, "/")
+	return parts[len(parts)-1]
+}
+
+func valueLanguage(value DataValue) string {
+	if value.Language == nil {
+		return ""
+	}
+	return *value.Language
+}
+
+type dictionaryBuildItem struct {
+	id      string
+	labels  map[string]string
+	aliases map[string][]string
+}
+
+// BuildDictionary turns query results into dictionary entries, one per item
+func BuildDictionary(results SPARQLResults, options DictionaryBuildOptions) (Dictionary, error) {
+
+	if len(options.Languages) == 0 {
+		return Dictionary{}, fmt.Errorf("No languages given")
+	}
+	wanted := make(map[string]bool)
+	for _, language := range options.Languages {
+		wanted[language] = true
+	}
+	// Values without a language tag are assumed to be in the main language
+	language := func(value DataValue) string {
+		if l := valueLanguage(value); len(l) > 0 {
+			return l
+		}
+		return options.Languages[0]
+	}
+
+	items := make([]*dictionaryBuildItem, 0)
+	byID := make(map[string]*dictionaryBuildItem)
+
+	for i, binding := range results.Results.Bindings {
+		itemValue, prs := binding[options.ItemVariable]
+		if !prs {
+			return Dictionary{}, fmt.Errorf("Result %d has no %s", i, options.ItemVariable)
+		}
+		id := wikidataIDFromURI(itemValue.Value)
+
+		item, prs := byID[id]
+		if !prs {
+			item = &dictionaryBuildItem{id: id, labels: make(map[string]string), aliases: make(map[string][]string)}
+			byID[id] = item
+			items = append(items, item)
+		}
+
+		// The label service falls back to the item ID if there's no label
+		if label, prs := binding[options.LabelVariable]; prs && len(label.Value) > 0 && label.Value != id {
+			if wanted[language(label)] {
+				item.labels[language(label)] = label.Value
+			}
+		}
+
+		if alias, prs := binding[options.AliasVariable]; prs && wanted[language(alias)] {
+			values := []string{alias.Value}
+			if len(options.AliasSeparator) > 0 {
+				values = strings.Split(alias.Value, options.AliasSeparator)
+			}
+			for _, value := range values {
+				value = strings.TrimSpace(value)
+				if len(value) > 0 {
+					item.aliases[language(alias)] = append(item.aliases[language(alias)], value)
+				}
+			}
+		}
+	}
+
+	dictionary := Dictionary{
+		Identifier: options.Identifier,
+		Log:        make([]DictionaryLog, 0),
+		Entries:    make([]DictionaryEntry, 0, len(items)),
+	}
+
+	for _, item := range items {
+
+		// The name comes from the first language we have a label for, and every other label and
+		// alias is a synonym
+		terms := make([]string, 0)
+		seen := make(map[string]bool)
+		add := func(term string) {
+			if !seen[term] {
+				seen[term] = true
+				terms = append(terms, term)
+			}
+		}
+		for _, language := range options.Languages {
+			if label, prs := item.labels[language]; prs {
+				add(label)
+			}
+		}
+		for _, language := range options.Languages {
+			for _, alias := range item.aliases[language] {
+				add(alias)
+			}
+		}
+
+		if len(terms) == 0 {
+			continue
+		}
+
+		entry := DictionaryEntry{
+			Name: terms[0],
+			Term: terms[0],
+			Identifiers: DictionaryEntryIdentifiers{
+				ContentMine: contentMineID(options.Identifier, len(dictionary.Entries)),
+				WikiData:    item.id,
+			},
+		}
+		if len(terms) > 1 {
+			entry.Synonyms = terms[1:]
+		}
+		dictionary.Entries = append(dictionary.Entries, entry)
+	}
+
+	return dictionary, nil
+}
+
+// Save writes the dictionary in the same layout as the ones in the repository
+func (dict Dictionary) Save(filename string) error {
+
+	data, err := json.MarshalIndent(dict, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	return WriteFileAtomic(filename, append(data, '\n'))
+}
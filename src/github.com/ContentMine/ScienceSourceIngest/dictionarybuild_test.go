@@ -0,0 +1,179 @@
+//   Copyright 2018 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+// Results as the label service gives them, with one row per item and label language
+const testSPARQLResults = `{
+  "head": {"vars": ["item", "itemLabel", "itemAltLabel"]},
+  "results": {"bindings": [
+    {
+      "item": {"type": "uri", "value": "http://www.wikidata.org/entity/Q44727"},
+      "itemLabel": {"xml:lang": "en", "type": "literal", "value": "chickenpox"},
+      "itemAltLabel": {"xml:lang": "en", "type": "literal", "value": "varicella, chicken pox"}
+    },
+    {
+      "item": {"type": "uri", "value": "http://www.wikidata.org/entity/Q44727"},
+      "itemLabel": {"xml:lang": "fr", "type": "literal", "value": "varicelle"}
+    },
+    {
+      "item": {"type": "uri", "value": "http://www.wikidata.org/entity/Q12214"},
+      "itemLabel": {"xml:lang": "en", "type": "literal", "value": "smallpox"}
+    },
+    {
+      "item": {"type": "uri", "value": "http://www.wikidata.org/entity/Q99999999"},
+      "itemLabel": {"type": "literal", "value": "Q99999999"}
+    }
+  ]}
+}`
+
+func TestBuildDictionary(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "sciencesourceingest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := path.Join(dir, "results.json")
+	err = ioutil.WriteFile(filename, []byte(testSPARQLResults), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := LoadSPARQLResultsFromFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	options := DictionaryBuildOptions{
+		Identifier:     "diseases",
+		Languages:      []string{"en", "fr"},
+		ItemVariable:   "item",
+		LabelVariable:  "itemLabel",
+		AliasVariable:  "itemAltLabel",
+		AliasSeparator: ", ",
+	}
+	dictionary, err := BuildDictionary(results, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The item with no label is dropped
+	if len(dictionary.Entries) != 2 {
+		t.Fatalf("Expected 2 entries, got %v", dictionary.Entries)
+	}
+
+	chickenpox := dictionary.Entries[0]
+	if chickenpox.Name != "chickenpox" || chickenpox.Term != "chickenpox" {
+		t.Errorf("Unexpected name %q and term %q", chickenpox.Name, chickenpox.Term)
+	}
+	if !reflect.DeepEqual(chickenpox.Synonyms, []string{"varicelle", "varicella", "chicken pox"}) {
+		t.Errorf("Unexpected synonyms %v", chickenpox.Synonyms)
+	}
+	if chickenpox.Identifiers.WikiData != "Q44727" || chickenpox.Identifiers.ContentMine != "CM.diseases0" {
+		t.Errorf("Unexpected identifiers %v", chickenpox.Identifiers)
+	}
+
+	smallpox := dictionary.Entries[1]
+	if smallpox.Name != "smallpox" || len(smallpox.Synonyms) != 0 || smallpox.Identifiers.WikiData != "Q12214" {
+		t.Errorf("Unexpected entry %v", smallpox)
+	}
+
+	// Only asking for French takes the name from the French label
+	options.Languages = []string{"fr"}
+	dictionary, err = BuildDictionary(results, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dictionary.Entries) != 1 || dictionary.Entries[0].Name != "varicelle" {
+		t.Errorf("Unexpected French entries %v", dictionary.Entries)
+	}
+}
+
+func TestDictionaryBuildCommandQueriesEndpoint(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "sciencesourceingest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	query := "SELECT ?item ?itemLabel ?itemAltLabel WHERE { ?item wdt:P31 wd:Q18123741 . }"
+	queryFilename := path.Join(dir, "query.sparql")
+	err = ioutil.WriteFile(queryFilename, []byte(query), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests += 1
+		if r.URL.Query().Get("query") != query {
+			t.Errorf("Unexpected query %q", r.URL.Query().Get("query"))
+		}
+		w.Header().Set("Content-Type", "application/sparql-results+json")
+		w.Write([]byte(testSPARQLResults))
+	}))
+	defer server.Close()
+
+	// An existing dictionary's history and options should survive being rebuilt
+	outputFilename := path.Join(dir, "diseases.json")
+	existing := Dictionary{
+		Identifier: "diseases",
+		Log:        []DictionaryLog{{Type: "wdqs", Query: "SELECT ?older", Time: 1}},
+		Options:    DictionaryMatchOptions{FoldCase: true},
+		Entries:    testEntries("plague"),
+	}
+	err = existing.Save(outputFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = dictionaryCommand(context.Background(), []string{"build", "-id", "diseases", "-query", queryFilename,
+		"-endpoint", server.URL, "-output", outputFilename})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests != 1 {
+		t.Errorf("Expected one request to the endpoint, got %d", requests)
+	}
+
+	dictionary, err := LoadDictionaryFromFile(outputFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dictionary.Entries) != 2 || dictionary.Entries[0].Name != "chickenpox" {
+		t.Errorf("Unexpected entries %v", dictionary.Entries)
+	}
+	if !dictionary.Options.FoldCase {
+		t.Errorf("Dictionary options were lost")
+	}
+	if len(dictionary.Log) != 2 {
+		t.Fatalf("Expected two log entries, got %v", dictionary.Log)
+	}
+	if dictionary.Log[1].Type != "wdqs" || dictionary.Log[1].Query != query || dictionary.Log[1].Time == 0 {
+		t.Errorf("Unexpected log entry %v", dictionary.Log[1])
+	}
+}
@@ -0,0 +1,220 @@
+//   Copyright 2018 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The dictionary command has its own set of sub commands for working on dictionaries, rather
+// than on the papers in a feed.
+
+var dictionaryCommands = map[string]command{
+	"build": {"Build a dictionary from Wikidata query results", dictionaryBuildCommand},
+	"lint":  {"Check dictionaries for problems", dictionaryLintCommand},
+}
+
+func dictionaryUsage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s dictionary [command] [options]\n\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Commands:\n")
+
+	names := make([]string, 0, len(dictionaryCommands))
+	for name := range dictionaryCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, dictionaryCommands[name].Description)
+	}
+}
+
+func dictionaryCommand(ctx context.Context, args []string) error {
+
+	if len(args) == 0 || args[0] == "help" || args[0] == "-help" || args[0] == "-h" {
+		dictionaryUsage()
+		return nil
+	}
+
+	cmd, prs := dictionaryCommands[args[0]]
+	if !prs {
+		dictionaryUsage()
+		return fmt.Errorf("Unknown dictionary command %s", args[0])
+	}
+
+	return cmd.Run(ctx, args[1:])
+}
+
+func dictionaryBuildCommand(ctx context.Context, args []string) error {
+
+	var options DictionaryBuildOptions
+	var resultsPath, queryPath, endpoint, languages, outputPath string
+
+	flags := flag.NewFlagSet("dictionary build", flag.ExitOnError)
+	flags.StringVar(&options.Identifier, "id", "", "Identifier for the dictionary, required.")
+	flags.StringVar(&resultsPath, "results", "", "Saved SPARQL query results JSON to build from.")
+	flags.StringVar(&queryPath, "query", "", "File containing the SPARQL query. Run against -endpoint unless -results is given, and recorded in the dictionary log.")
+	flags.StringVar(&endpoint, "endpoint", DefaultSPARQLEndpoint, "SPARQL endpoint to run the query against.")
+	flags.StringVar(&languages, "lang", "en", "Comma separated languages to take labels and aliases from, the first is used for entry names.")
+	flags.StringVar(&options.ItemVariable, "item-var", "item", "Query variable with the item URI.")
+	flags.StringVar(&options.LabelVariable, "label-var", "itemLabel", "Query variable with the item label.")
+	flags.StringVar(&options.AliasVariable, "alias-var", "itemAltLabel", "Query variable with the item aliases.")
+	flags.StringVar(&options.AliasSeparator, "alias-separator", ", ", "Separator between aliases in one value, empty if there is one alias per value.")
+	flags.StringVar(&outputPath, "output", "", "Where to write the dictionary, defaults to [id].json.")
+	flags.Parse(args)
+
+	if len(options.Identifier) == 0 {
+		return fmt.Errorf("A dictionary -id is required")
+	}
+	if len(resultsPath) == 0 && len(queryPath) == 0 {
+		return fmt.Errorf("Either -results or -query is required")
+	}
+	for _, language := range strings.Split(languages, ",") {
+		if language = strings.TrimSpace(language); len(language) > 0 {
+			options.Languages = append(options.Languages, language)
+		}
+	}
+	if len(outputPath) == 0 {
+		outputPath = options.Identifier + ".json"
+	}
+	if strings.ToLower(filepath.Ext(outputPath)) != ".json" {
+		return fmt.Errorf("Dictionaries are built as JSON, so -output must end in .json")
+	}
+
+	query := ""
+	if len(queryPath) > 0 {
+		data, err := ioutil.ReadFile(queryPath)
+		if err != nil {
+			return err
+		}
+		query = string(data)
+	}
+
+	var results SPARQLResults
+	var err error
+	if len(resultsPath) > 0 {
+		results, err = LoadSPARQLResultsFromFile(resultsPath)
+	} else {
+		log.Printf("Running query against %s", endpoint)
+		results, err = FetchSPARQLResults(endpoint, query)
+	}
+	if err != nil {
+		return err
+	}
+
+	dictionary, err := BuildDictionary(results, options)
+	if err != nil {
+		return err
+	}
+
+	// If we're rebuilding a dictionary then keep its history and matching options
+	if fileExists(outputPath) {
+		existing, err := LoadDictionaryFromFile(outputPath)
+		if err != nil {
+			return err
+		}
+		dictionary.Log = existing.Log
+		dictionary.Options = existing.Options
+	}
+
+	entry := DictionaryLog{Type: "wdqs", Query: query, Time: time.Now().UnixNano() / int64(time.Millisecond)}
+	if len(query) == 0 {
+		entry.Type = "wdqs-results"
+		entry.Query = filepath.Base(resultsPath)
+	}
+	dictionary.Log = append(dictionary.Log, entry)
+
+	err = dictionary.Save(outputPath)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Wrote %d entries from %d results to %s", len(dictionary.Entries), len(results.Results.Bindings), outputPath)
+	return nil
+}
+
+func dictionaryLintCommand(ctx context.Context, args []string) error {
+
+	var dictionariesPath, corpusPath string
+	var maxFraction float64
+
+	flags := flag.NewFlagSet("dictionary lint", flag.ExitOnError)
+	flags.StringVar(&dictionariesPath, "dictionaries", "", "Directory of dictionaries to check, required.")
+	flags.StringVar(&corpusPath, "corpus", "", "Directory of sample text files to look for over common terms in, such as an output directory.")
+	flags.Float64Var(&maxFraction, "max-document-fraction", DefaultLintMaxDocumentFraction, "Warn about terms found in more than this fraction of the sample documents.")
+	flags.Parse(args)
+
+	if len(dictionariesPath) == 0 {
+		return fmt.Errorf("A -dictionaries directory is required")
+	}
+
+	files, err := ioutil.ReadDir(dictionariesPath)
+	if err != nil {
+		return err
+	}
+
+	// Load the dictionaries without validation, as we want to report every problem rather than
+	// stop at the first bad dictionary
+	dictionaries := make([]Dictionary, 0)
+	problems := make(LintProblems, 0)
+	failed := 0
+	for _, f := range files {
+		filename := filepath.Join(dictionariesPath, f.Name())
+		if f.IsDir() || !isDictionaryFile(filename) {
+			continue
+		}
+		dictionary, err := loadDictionary(filename)
+		if err != nil {
+			fmt.Println(err)
+			failed += 1
+			continue
+		}
+		dictionaries = append(dictionaries, dictionary)
+		problems = append(problems, dictionary.Validate()...)
+	}
+	problems = append(problems, lintAcrossDictionaries(dictionaries)...)
+
+	if len(corpusPath) > 0 {
+		documents, err := findCorpusDocuments(corpusPath)
+		if err != nil {
+			return err
+		}
+		log.Printf("Checking terms against %d sample documents", len(documents))
+		corpusProblems, err := lintCorpus(dictionaries, documents, maxFraction)
+		if err != nil {
+			return err
+		}
+		problems = append(problems, corpusProblems...)
+	}
+
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+
+	errors := len(problems.Errors()) + failed
+	log.Printf("Checked %d dictionaries: %d errors, %d warnings", len(dictionaries)+failed, errors, len(problems.Warnings()))
+	if errors > 0 {
+		return fmt.Errorf("Found %d errors, which will stop the dictionaries being loaded", errors)
+	}
+	return nil
+}
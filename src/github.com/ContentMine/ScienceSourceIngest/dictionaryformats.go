@@ -0,0 +1,372 @@
+//   Copyright 2018 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/errwrap"
+)
+
+// Loaders for dictionaries that curators maintain in other tools. These formats have no id or
+// options, so the dictionary is named after the file, and always matches terms exactly.
+
+func dictionaryIdentifierFromFileName(filename string) string {
+	base := filepath.Base(filename)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+func contentMineID(identifier string, index int) string {
+	return fmt.Sprintf("CM.%s%d", identifier, index)
+}
+
+// wikidataID accepts a bare QID, an entity URI, or a prefixed ID such as wd:Q42
+func wikidataID(value string) string {
+	value = wikidataIDFromURI(strings.TrimSpace(value))
+	if idx := strings.LastIndex(value, ":"); idx != -1 {
+		value = value[idx+1:]
+	}
+	return value
+}
+
+// dictionaryBuilder collects entries, merging those that describe the same thing, so that a
+// concept spread over several rows or with several labels ends up as one entry with synonyms.
+type dictionaryBuilder struct {
+	dictionary Dictionary
+	byKey      map[string]int
+}
+
+func newDictionaryBuilder(identifier string) *dictionaryBuilder {
+	return &dictionaryBuilder{
+		dictionary: Dictionary{
+			Identifier: identifier,
+			Log:        make([]DictionaryLog, 0),
+			Entries:    make([]DictionaryEntry, 0),
+		},
+		byKey: make(map[string]int),
+	}
+}
+
+func (builder *dictionaryBuilder) add(key string, entry DictionaryEntry) {
+
+	idx, prs := builder.byKey[key]
+	if !prs {
+		entry.Identifiers.ContentMine = contentMineID(builder.dictionary.Identifier, len(builder.dictionary.Entries))
+		entry.Synonyms = uniqueTerms(entry.Term, nil, entry.Synonyms)
+		builder.byKey[key] = len(builder.dictionary.Entries)
+		builder.dictionary.Entries = append(builder.dictionary.Entries, entry)
+		return
+	}
+
+	existing := &builder.dictionary.Entries[idx]
+	existing.Synonyms = uniqueTerms(existing.Term, existing.Synonyms, append([]string{entry.Term}, entry.Synonyms...))
+	if len(existing.Identifiers.WikiData) == 0 {
+		existing.Identifiers.WikiData = entry.Identifiers.WikiData
+	}
+}
+
+// uniqueTerms adds the new terms to the synonyms, leaving out blanks and any we already have
+func uniqueTerms(term string, synonyms []string, terms []string) []string {
+	seen := map[string]bool{term: true}
+	for _, synonym := range synonyms {
+		seen[synonym] = true
+	}
+	for _, t := range terms {
+		t = strings.TrimSpace(t)
+		if len(t) > 0 && !seen[t] {
+			seen[t] = true
+			synonyms = append(synonyms, t)
+		}
+	}
+	return synonyms
+}
+
+// CSV and TSV
+
+// A delimited dictionary has a header row naming its columns. Only term is required: name
+// defaults to the term, and rows with the same wikidata ID (or failing that the same name) are
+// merged into one entry, with the later terms as synonyms.
+
+func loadCSVDictionary(filename string) (Dictionary, error) {
+	return loadDelimitedDictionary(filename, ',')
+}
+
+func loadTSVDictionary(filename string) (Dictionary, error) {
+	return loadDelimitedDictionary(filename, '\t')
+}
+
+func loadDelimitedDictionary(filename string, separator rune) (Dictionary, error) {
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return Dictionary{}, err
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	reader.Comma = separator
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	// Spreadsheets export TSV without quoting, so quotes in terms are just part of the term
+	reader.LazyQuotes = separator == '\t'
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return Dictionary{}, fmt.Errorf("File is empty")
+	} else if err != nil {
+		return Dictionary{}, err
+	}
+
+	columns := make(map[string]int)
+	for idx, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		columns[name] = idx
+	}
+	if _, prs := columns["term"]; !prs {
+		return Dictionary{}, fmt.Errorf("No term column in header")
+	}
+
+	builder := newDictionaryBuilder(dictionaryIdentifierFromFileName(filename))
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return Dictionary{}, err
+		}
+
+		field := func(column string) string {
+			idx, prs := columns[column]
+			if !prs || idx >= len(record) {
+				return ""
+			}
+			return strings.TrimSpace(record[idx])
+		}
+
+		term := field("term")
+		if len(term) == 0 {
+			continue
+		}
+		name := field("name")
+		if len(name) == 0 {
+			name = term
+		}
+		wikidata := wikidataID(field("wikidata"))
+
+		key := wikidata
+		if len(key) == 0 {
+			key = name
+		}
+		builder.add(key, DictionaryEntry{
+			Name:        name,
+			Term:        term,
+			Identifiers: DictionaryEntryIdentifiers{WikiData: wikidata},
+		})
+	}
+
+	return builder.dictionary, nil
+}
+
+// OBO
+
+// We take each [Term] stanza's name, its EXACT synonyms (broader, narrower, and related synonyms
+// would give misleading annotations), and any xref to Wikidata. Obsolete terms are skipped.
+
+type oboTerm struct {
+	id       string
+	name     string
+	synonyms []string
+	wikidata string
+	obsolete bool
+}
+
+func loadOBODictionary(filename string) (Dictionary, error) {
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return Dictionary{}, err
+	}
+	defer f.Close()
+
+	builder := newDictionaryBuilder(dictionaryIdentifierFromFileName(filename))
+
+	var current *oboTerm
+	inTerm := false
+	flush := func() {
+		if current != nil && !current.obsolete && len(current.name) > 0 {
+			key := current.id
+			if len(key) == 0 {
+				key = current.name
+			}
+			builder.add(key, DictionaryEntry{
+				Name:        current.name,
+				Term:        current.name,
+				Synonyms:    current.synonyms,
+				Identifiers: DictionaryEntryIdentifiers{WikiData: current.wikidata},
+			})
+		}
+		current = nil
+	}
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line_number := 0
+	for scanner.Scan() {
+		line_number += 1
+		line := strings.TrimSpace(stripOBOComment(scanner.Text()))
+		if len(line) == 0 {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			flush()
+			inTerm = line == "[Term]"
+			if inTerm {
+				current = &oboTerm{}
+			}
+			continue
+		}
+		if !inTerm {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return Dictionary{}, fmt.Errorf("Line %d: expected a tag and value", line_number)
+		}
+		value := strings.TrimSpace(parts[1])
+
+		switch strings.TrimSpace(parts[0]) {
+		case "id":
+			current.id = value
+		case "name":
+			current.name = unescapeOBO(value)
+		case "synonym":
+			text, scope, err := parseOBOSynonym(value)
+			if err != nil {
+				return Dictionary{}, errwrap.Wrapf(fmt.Sprintf("Line %d: {{err}}", line_number), err)
+			}
+			if scope == "EXACT" {
+				current.synonyms = append(current.synonyms, text)
+			}
+		case "xref":
+			if id := oboWikidataXref(value); len(id) > 0 {
+				current.wikidata = id
+			}
+		case "is_obsolete":
+			current.obsolete = value == "true"
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return Dictionary{}, err
+	}
+	flush()
+
+	return builder.dictionary, nil
+}
+
+// stripOBOComment removes anything after an unescaped ! that isn't in a quoted string
+func stripOBOComment(line string) string {
+	quoted := false
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			i += 1
+		case '"':
+			quoted = !quoted
+		case '!':
+			if !quoted {
+				return line[:i]
+			}
+		}
+	}
+	return line
+}
+
+func unescapeOBO(value string) string {
+	if !strings.Contains(value, "\\") {
+		return value
+	}
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\\' && i+1 < len(value) {
+			i += 1
+			switch value[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			default:
+				b.WriteByte(value[i])
+			}
+			continue
+		}
+		b.WriteByte(value[i])
+	}
+	return b.String()
+}
+
+// parseOBOSynonym reads a synonym value of the form "text" SCOPE [TYPE] [xrefs]
+func parseOBOSynonym(value string) (string, string, error) {
+
+	if !strings.HasPrefix(value, "\"") {
+		return "", "", fmt.Errorf("Synonym is not quoted")
+	}
+	end := -1
+	for i := 1; i < len(value); i++ {
+		if value[i] == '\\' {
+			i += 1
+		} else if value[i] == '"' {
+			end = i
+			break
+		}
+	}
+	if end == -1 {
+		return "", "", fmt.Errorf("Synonym has no closing quote")
+	}
+
+	text := unescapeOBO(value[1:end])
+	// The scope is optional, and defaults to related
+	scope := "RELATED"
+	if fields := strings.Fields(value[end+1:]); len(fields) > 0 && !strings.HasPrefix(fields[0], "[") {
+		scope = fields[0]
+	}
+	return text, scope, nil
+}
+
+// oboWikidataXref gets the QID from an xref like Wikidata:Q42, or returns an empty string if
+// the xref is to somewhere else
+func oboWikidataXref(value string) string {
+	fields := strings.Fields(value)
+	if len(fields) == 0 {
+		return ""
+	}
+	xref := fields[0]
+	if strings.Contains(xref, "wikidata.org/") {
+		return wikidataIDFromURI(xref)
+	}
+	parts := strings.SplitN(xref, ":", 2)
+	if len(parts) != 2 || strings.ToLower(parts[0]) != "wikidata" {
+		return ""
+	}
+	return parts[1]
+}
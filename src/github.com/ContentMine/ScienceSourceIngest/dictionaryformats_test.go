@@ -0,0 +1,210 @@
+//   Copyright 2018 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+// Each format describes the same two diseases, so they should all load to the same entries
+var testDictionaryFiles = map[string]string{
+	"diseases.csv": `term,name,wikidata
+chickenpox,chickenpox,Q44727
+varicella,chickenpox,http://www.wikidata.org/entity/Q44727
+# Not in Wikidata, so grouped by name
+"smallpox, major",smallpox,
+`,
+	"diseases.tsv": "Term\tName\tWikidata\nchickenpox\tchickenpox\tQ44727\nvaricella\tchickenpox\tQ44727\nsmallpox, major\tsmallpox\t\n",
+	"diseases.ttl": `@prefix skos: <http://www.w3.org/2004/02/skos/core#> .
+@prefix wd: <http://www.wikidata.org/entity/> .
+PREFIX ex: <http://example.org/diseases/>
+
+ex: a skos:ConceptScheme ; skos:prefLabel "Diseases"@en .
+
+# Labels in several languages, with the English one taking priority
+ex:chickenpox a skos:Concept ;
+    skos:inScheme ex: ;
+    skos:prefLabel "varicelle"@fr, "chickenpox"@en ;
+    skos:altLabel "varicella" ;
+    skos:exactMatch wd:Q44727 ;
+    .
+
+ex:smallpox a skos:Concept ;
+    skos:prefLabel """smallpox, major""" .
+`,
+	"diseases.rdf": `<?xml version="1.0" encoding="UTF-8"?>
+<rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+         xmlns:skos="http://www.w3.org/2004/02/skos/core#">
+  <skos:ConceptScheme rdf:about="http://example.org/diseases/">
+    <skos:prefLabel xml:lang="en">Diseases</skos:prefLabel>
+  </skos:ConceptScheme>
+  <skos:Concept rdf:about="http://example.org/diseases/chickenpox">
+    <skos:prefLabel xml:lang="fr">varicelle</skos:prefLabel>
+    <skos:prefLabel xml:lang="en">chickenpox</skos:prefLabel>
+    <skos:altLabel>varicella</skos:altLabel>
+    <skos:exactMatch rdf:resource="http://www.wikidata.org/entity/Q44727"/>
+  </skos:Concept>
+  <rdf:Description rdf:about="http://example.org/diseases/smallpox" skos:prefLabel="smallpox, major"/>
+</rdf:RDF>
+`,
+	"diseases.obo": `format-version: 1.2
+ontology: diseases
+
+[Term]
+id: DIS:0001
+name: chickenpox
+synonym: "varicelle" EXACT [] ! French
+synonym: "varicella" EXACT []
+synonym: "shingles" RELATED []
+xref: Wikidata:Q44727
+
+[Term]
+id: DIS:0002
+name: smallpox, major
+
+[Term]
+id: DIS:0003
+name: old disease
+is_obsolete: true
+
+[Typedef]
+id: part_of
+name: part of
+`,
+}
+
+func TestDictionaryFormats(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "sciencesourceingest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, contents := range testDictionaryFiles {
+		err = ioutil.WriteFile(path.Join(dir, name), []byte(contents), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Files we don't recognise are left alone
+	err = ioutil.WriteFile(path.Join(dir, "README.txt"), []byte("not a dictionary"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dictionaries, err := LoadDictionariesFromDirectory(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dictionaries) != len(testDictionaryFiles) {
+		t.Fatalf("Expected %d dictionaries, got %d", len(testDictionaryFiles), len(dictionaries))
+	}
+
+	for _, dictionary := range dictionaries {
+		if dictionary.Identifier != "diseases" {
+			t.Errorf("Unexpected identifier %q", dictionary.Identifier)
+		}
+		if len(dictionary.Entries) != 2 {
+			t.Errorf("Expected 2 entries, got %v", dictionary.Entries)
+			continue
+		}
+
+		chickenpox := dictionary.Entries[0]
+		if chickenpox.Name != "chickenpox" || chickenpox.Term != "chickenpox" {
+			t.Errorf("Unexpected name %q and term %q", chickenpox.Name, chickenpox.Term)
+		}
+		if chickenpox.Identifiers.WikiData != "Q44727" || chickenpox.Identifiers.ContentMine != "CM.diseases0" {
+			t.Errorf("Unexpected identifiers %v", chickenpox.Identifiers)
+		}
+
+		smallpox := dictionary.Entries[1]
+		if smallpox.Name != "smallpox" && smallpox.Name != "smallpox, major" {
+			t.Errorf("Unexpected name %q", smallpox.Name)
+		}
+		if smallpox.Term != "smallpox, major" || len(smallpox.Synonyms) != 0 || len(smallpox.Identifiers.WikiData) != 0 {
+			t.Errorf("Unexpected entry %v", smallpox)
+		}
+
+		matches, _ := dictionary.FindMatches([]byte("Cases of varicella and smallpox, major were seen."))
+		if len(matches) != 2 {
+			t.Errorf("Expected 2 matches, got %v", matches)
+		}
+	}
+}
+
+func TestDictionaryFormatSynonyms(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "sciencesourceingest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	expected := map[string][]string{
+		"diseases.csv": {"varicella"},
+		"diseases.ttl": {"varicelle", "varicella"},
+		"diseases.rdf": {"varicelle", "varicella"},
+		"diseases.obo": {"varicelle", "varicella"},
+	}
+	for name, synonyms := range expected {
+		filename := path.Join(dir, name)
+		err = ioutil.WriteFile(filename, []byte(testDictionaryFiles[name]), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dictionary, err := LoadDictionaryFromFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(dictionary.Entries[0].Synonyms, synonyms) {
+			t.Errorf("%s: expected synonyms %v, got %v", name, synonyms, dictionary.Entries[0].Synonyms)
+		}
+	}
+}
+
+func TestDictionaryFormatErrors(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "sciencesourceingest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bad := map[string]string{
+		"noterm.csv":    "name,wikidata\nchickenpox,Q44727\n",
+		"prefix.ttl":    "ex:chickenpox a skos:Concept .\n",
+		"string.ttl":    "@prefix skos: <http://www.w3.org/2004/02/skos/core#> .\n<x> skos:prefLabel \"chickenpox .\n",
+		"escape.ttl":    "ex\\",
+		"escapeobj.ttl": "@prefix ex: <http://example.com/> .\nex:a ex:b ex:c\\",
+		"synonym.obo":   "[Term]\nid: DIS:0001\nsynonym: varicella EXACT []\n",
+		"unclosed.rdf":  "<rdf:RDF xmlns:rdf=\"http://www.w3.org/1999/02/22-rdf-syntax-ns#\">",
+		"diseases.yaml": "chickenpox: Q44727\n",
+	}
+	for name, contents := range bad {
+		filename := path.Join(dir, name)
+		err = ioutil.WriteFile(filename, []byte(contents), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadDictionaryFromFile(filename); err == nil {
+			t.Errorf("Expected %s to fail to load", name)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+//   Copyright 2018 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Checks on dictionary quality. Errors are things that would put bad data on the wiki, and stop
+// the dictionary being loaded. Warnings are things that are likely to give poor annotations, and
+// are for a curator to look at with the dictionary lint command.
+
+type LintSeverity string
+
+const (
+	LintError   LintSeverity = "error"
+	LintWarning LintSeverity = "warning"
+)
+
+// Terms shorter than this, in runes after normalisation, are likely to be abbreviations that
+// match all sorts of things
+const MinLintTermLength int = 3
+
+// Defaults for the sample corpus check. A term found in more than the given fraction of papers
+// is probably a common word rather than the thing the entry describes, though we need enough
+// papers for that to mean anything.
+const (
+	DefaultLintMaxDocumentFraction float64 = 0.5
+	MinLintCorpusSize              int     = 10
+)
+
+var wikidataIDPattern = regexp.MustCompile(`^Q[1-9][0-9]*$`)
+
+type LintProblem struct {
+	Severity   LintSeverity
+	Dictionary string
+	// Entry is -1 for problems with the dictionary as a whole
+	Entry   int
+	Term    string
+	Message string
+}
+
+func (problem LintProblem) String() string {
+	location := problem.Dictionary
+	if problem.Entry >= 0 {
+		location += fmt.Sprintf(" entry %d", problem.Entry)
+	}
+	if len(problem.Term) > 0 {
+		location += fmt.Sprintf(" (%s)", problem.Term)
+	}
+	return fmt.Sprintf("%s: %s: %s", location, problem.Severity, problem.Message)
+}
+
+type LintProblems []LintProblem
+
+func (problems LintProblems) withSeverity(severity LintSeverity) LintProblems {
+	res := make(LintProblems, 0)
+	for _, problem := range problems {
+		if problem.Severity == severity {
+			res = append(res, problem)
+		}
+	}
+	return res
+}
+
+func (problems LintProblems) Errors() LintProblems {
+	return problems.withSeverity(LintError)
+}
+
+func (problems LintProblems) Warnings() LintProblems {
+	return problems.withSeverity(LintWarning)
+}
+
+// Validate checks a single dictionary on its own
+func (dict Dictionary) Validate() LintProblems {
+
+	problems := make(LintProblems, 0)
+	add := func(severity LintSeverity, entry int, term string, format string, args ...interface{}) {
+		problems = append(problems, LintProblem{
+			Severity:   severity,
+			Dictionary: dict.Identifier,
+			Entry:      entry,
+			Term:       term,
+			Message:    fmt.Sprintf(format, args...),
+		})
+	}
+
+	if len(dict.Identifier) == 0 {
+		add(LintError, -1, "", "Dictionary has no id")
+	}
+	if len(dict.Entries) == 0 {
+		add(LintWarning, -1, "", "Dictionary has no entries")
+	}
+
+	terms := make(map[string]int)
+	contentMineIDs := make(map[string]int)
+
+	for idx, entry := range dict.Entries {
+
+		label := entry.PreferredLabel()
+		if len(strings.TrimSpace(entry.Term)) == 0 && len(entry.Pattern) == 0 {
+			add(LintError, idx, label, "Entry has no term or pattern")
+		}
+
+		switch wikidata := entry.Identifiers.WikiData; {
+		case len(wikidata) == 0:
+			add(LintWarning, idx, label, "Entry has no Wikidata ID")
+		case !wikidataIDPattern.MatchString(wikidata):
+			add(LintError, idx, label, "Wikidata ID %q is not of the form Q123", wikidata)
+		}
+
+		if id := entry.Identifiers.ContentMine; len(id) > 0 {
+			if other, prs := contentMineIDs[id]; prs {
+				add(LintWarning, idx, label, "ContentMine ID %s is also used by entry %d", id, other)
+			} else {
+				contentMineIDs[id] = idx
+			}
+		}
+
+		for i, term := range append([]string{entry.Term}, entry.Synonyms...) {
+			if len(strings.TrimSpace(term)) == 0 {
+				// A missing main term is reported above
+				if i > 0 {
+					add(LintWarning, idx, label, "Entry has an empty synonym")
+				}
+				continue
+			}
+
+			text := dict.matchText(term)
+			if utf8.RuneCountInString(text) < MinLintTermLength {
+				add(LintWarning, idx, term, "Term is shorter than %d characters", MinLintTermLength)
+			}
+			if other, prs := terms[text]; prs && other != idx {
+				add(LintWarning, idx, term, "Term is also in entry %d", other)
+			} else if !prs {
+				terms[text] = idx
+			}
+		}
+	}
+
+	return problems
+}
+
+// lintAcrossDictionaries finds terms that are in more than one dictionary, which the overlap
+// policy will have to choose between
+func lintAcrossDictionaries(dictionaries []Dictionary) LintProblems {
+
+	type location struct {
+		dictionary string
+		entry      int
+	}
+	seen := make(map[string]location)
+	problems := make(LintProblems, 0)
+
+	for _, dict := range dictionaries {
+		for idx, entry := range dict.Entries {
+			for _, term := range append([]string{entry.Term}, entry.Synonyms...) {
+				if len(strings.TrimSpace(term)) == 0 {
+					continue
+				}
+				// Compare as loosely as any dictionary matches, so we catch terms that can match
+				// the same text
+				text := string(normaliseText([]byte(term), DictionaryMatchOptions{
+					FoldCase:           true,
+					NormaliseUnicode:   true,
+					CollapseWhitespace: true,
+				}).Text)
+				other, prs := seen[text]
+				if !prs {
+					seen[text] = location{dict.Identifier, idx}
+				} else if other.dictionary != dict.Identifier {
+					problems = append(problems, LintProblem{
+						Severity:   LintWarning,
+						Dictionary: dict.Identifier,
+						Entry:      idx,
+						Term:       term,
+						Message:    fmt.Sprintf("Term is also in %s entry %d", other.dictionary, other.entry),
+					})
+				}
+			}
+		}
+	}
+
+	return problems
+}
+
+// lintCorpus counts how many of the sample documents each term is found in, and warns about
+// those found in more than maxFraction of them
+func lintCorpus(dictionaries []Dictionary, documents []string, maxFraction float64) (LintProblems, error) {
+
+	if len(documents) < MinLintCorpusSize {
+		return nil, fmt.Errorf("Need at least %d documents in the corpus, found %d", MinLintCorpusSize, len(documents))
+	}
+
+	type termKey struct {
+		dictionary int
+		term       string
+	}
+	counts := make(map[termKey]int)
+
+	for _, filename := range documents {
+		text, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		for idx, dict := range dictionaries {
+			matches, _ := dict.FindMatches(text)
+			found := make(map[string]bool)
+			for _, match := range matches {
+				found[match.Term] = true
+			}
+			for term := range found {
+				counts[termKey{idx, term}] += 1
+			}
+		}
+	}
+
+	keys := make([]termKey, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].dictionary != keys[j].dictionary {
+			return keys[i].dictionary < keys[j].dictionary
+		}
+		return keys[i].term < keys[j].term
+	})
+
+	problems := make(LintProblems, 0)
+	for _, key := range keys {
+		fraction := float64(counts[key]) / float64(len(documents))
+		if fraction <= maxFraction {
+			continue
+		}
+		dict := dictionaries[key.dictionary]
+		problems = append(problems, LintProblem{
+			Severity:   LintWarning,
+			Dictionary: dict.Identifier,
+			Entry:      dict.entryForTerm(key.term),
+			Term:       key.term,
+			Message:    fmt.Sprintf("Term is found in %d of %d sample documents, so may be a common word", counts[key], len(documents)),
+		})
+	}
+
+	return problems, nil
+}
+
+// entryForTerm finds which entry a term or pattern came from
+func (dict Dictionary) entryForTerm(term string) int {
+	for _, t := range dict.matchTerms {
+		if t.Term == term {
+			return t.Entry
+		}
+	}
+	for _, pattern := range dict.matchPatterns {
+		if dict.Entries[pattern.Entry].Pattern == term {
+			return pattern.Entry
+		}
+	}
+	return -1
+}
+
+// findCorpusDocuments finds all the text files under a directory, such as the paper.txt files
+// in an output directory
+func findCorpusDocuments(directory string) ([]string, error) {
+	documents := make([]string, 0)
+	err := filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && filepath.Ext(path) == ".txt" {
+			documents = append(documents, path)
+		}
+		return nil
+	})
+	return documents, err
+}
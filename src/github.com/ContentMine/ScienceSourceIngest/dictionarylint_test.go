@@ -0,0 +1,176 @@
+//   Copyright 2018 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func lintEntry(name string, term string, wikidata string, synonyms ...string) DictionaryEntry {
+	return DictionaryEntry{
+		Name:        name,
+		Term:        term,
+		Synonyms:    synonyms,
+		Identifiers: DictionaryEntryIdentifiers{WikiData: wikidata},
+	}
+}
+
+// expectProblems checks there's exactly one problem of each given severity and message prefix
+func expectProblems(t *testing.T, problems LintProblems, expected map[string]LintSeverity) {
+	t.Helper()
+	if len(problems) != len(expected) {
+		t.Errorf("Expected %d problems, got %d: %v", len(expected), len(problems), problems)
+	}
+	for message, severity := range expected {
+		found := 0
+		for _, problem := range problems {
+			if strings.HasPrefix(problem.Message, message) && problem.Severity == severity {
+				found += 1
+			}
+		}
+		if found != 1 {
+			t.Errorf("Expected one %s %q, found %d in %v", severity, message, found, problems)
+		}
+	}
+}
+
+func TestValidateDictionary(t *testing.T) {
+
+	good := Dictionary{Identifier: "diseases", Entries: []DictionaryEntry{
+		lintEntry("malaria", "malaria", "Q12156"),
+		lintEntry("cholera", "cholera", "Q12090", "Cholera"),
+		{Name: "GEO series", Pattern: `GSE[0-9]+`, Identifiers: DictionaryEntryIdentifiers{WikiData: "Q1"}},
+	}}
+	if problems := good.Validate(); len(problems) != 0 {
+		t.Errorf("Expected no problems, got %v", problems)
+	}
+
+	bad := Dictionary{
+		Identifier: "diseases",
+		Options:    DictionaryMatchOptions{FoldCase: true},
+		Entries: []DictionaryEntry{
+			lintEntry("malaria", "malaria", "Q12156"),
+			lintEntry("empty", "", "Q1"),
+			lintEntry("cholera", "cholera", "12090"),
+			lintEntry("paludism", "Malaria", "Q12156"),
+			lintEntry("tuberculosis", "tuberculosis", "", "TB"),
+		},
+	}
+	expectProblems(t, bad.Validate(), map[string]LintSeverity{
+		"Entry has no term or pattern": LintError,
+		"Wikidata ID \"12090\"":        LintError,
+		"Term is also in entry 0":      LintWarning,
+		"Entry has no Wikidata ID":     LintWarning,
+		"Term is shorter than":         LintWarning,
+	})
+}
+
+func TestLintAcrossDictionaries(t *testing.T) {
+
+	dictionaries := []Dictionary{
+		{Identifier: "diseases", Entries: []DictionaryEntry{lintEntry("malaria", "malaria", "Q12156")}},
+		{Identifier: "tropical", Entries: []DictionaryEntry{
+			lintEntry("Malaria", "Malaria", "Q12156"),
+			lintEntry("dengue", "dengue", "Q30953"),
+		}},
+	}
+	problems := lintAcrossDictionaries(dictionaries)
+	expectProblems(t, problems, map[string]LintSeverity{"Term is also in diseases entry 0": LintWarning})
+	if problems[0].Dictionary != "tropical" || problems[0].Entry != 0 {
+		t.Errorf("Unexpected problem %v", problems[0])
+	}
+}
+
+func TestLintCorpus(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "sciencesourceingest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// "cold" is in every document, but "malaria" only in a couple
+	for i := 0; i < MinLintCorpusSize; i++ {
+		text := "Patients presented with a cold."
+		if i < 2 {
+			text += " Some had malaria."
+		}
+		folder := path.Join(dir, fmt.Sprintf("PMC%d", i))
+		err = os.Mkdir(folder, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(path.Join(folder, "paper.txt"), []byte(text), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dictionary := loadTestDictionary(t, Dictionary{Identifier: "diseases", Entries: []DictionaryEntry{
+		lintEntry("malaria", "malaria", "Q12156"),
+		lintEntry("common cold", "common cold", "Q41112", "cold"),
+	}})
+
+	documents, err := findCorpusDocuments(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	problems, err := lintCorpus([]Dictionary{dictionary}, documents, DefaultLintMaxDocumentFraction)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectProblems(t, problems, map[string]LintSeverity{"Term is found in 10 of 10": LintWarning})
+	if problems[0].Term != "cold" || problems[0].Entry != 1 {
+		t.Errorf("Unexpected problem %v", problems[0])
+	}
+
+	if _, err := lintCorpus([]Dictionary{dictionary}, documents[:2], DefaultLintMaxDocumentFraction); err == nil {
+		t.Errorf("Expected a corpus that's too small to be rejected")
+	}
+}
+
+func TestInvalidDictionaryNotLoaded(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "sciencesourceingest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data, err := json.Marshal(Dictionary{Identifier: "diseases", Entries: []DictionaryEntry{
+		lintEntry("malaria", "malaria", "http://www.wikidata.org/entity/Q12156"),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := path.Join(dir, "diseases.json")
+	err = ioutil.WriteFile(filename, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadDictionaryFromFile(filename); err == nil {
+		t.Errorf("Expected dictionary with a bad Wikidata ID not to load")
+	}
+	if _, err := loadDictionary(filename); err != nil {
+		t.Errorf("Expected lint to be able to load the dictionary: %v", err)
+	}
+}
@@ -0,0 +1,347 @@
+//   Copyright 2018 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ContentMine/wikibase"
+)
+
+// DryRunWikibase is an in memory stand-in for a wikibase server. It hands out made up item,
+// property and page IDs, and records everything we asked it to do so that we can write a report
+// of what would have happened had it been a real server.
+
+type DryRunCall struct {
+	Method string `json:"method"`
+	Target string `json:"target"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type DryRunPage struct {
+	Title     string `json:"title"`
+	PageID    int    `json:"page_id"`
+	Length    int    `json:"length"`
+	Protected bool   `json:"protected"`
+}
+
+type DryRunItem struct {
+	ID     wikibase.ItemPropertyType `json:"id"`
+	Label  string                    `json:"label"`
+	Kind   string                    `json:"kind,omitempty"`
+	Claims map[string]string         `json:"claims,omitempty"`
+}
+
+type DryRunReport struct {
+	Properties map[string]string                    `json:"properties"`
+	Items      map[string]wikibase.ItemPropertyType `json:"items"`
+	Pages      []*DryRunPage                        `json:"pages"`
+	Instances  []*DryRunItem                        `json:"instances"`
+	// Items that are already on the server, from an earlier real upload that got part way, and
+	// would only have their claims set
+	Existing []*DryRunItem `json:"existing_instances"`
+	Calls    []DryRunCall  `json:"calls"`
+}
+
+type DryRunWikibase struct {
+	lock sync.Mutex
+
+	nextItemID     int
+	nextPropertyID int
+	nextPageID     int
+
+	pagesByTitle map[string]*DryRunPage
+	pagesByID    map[int]*DryRunPage
+	instances    map[wikibase.ItemPropertyType]*DryRunItem
+
+	report DryRunReport
+}
+
+func NewDryRunWikibase() *DryRunWikibase {
+	return &DryRunWikibase{
+		nextItemID:     1,
+		nextPropertyID: 1,
+		nextPageID:     1,
+		pagesByTitle:   make(map[string]*DryRunPage),
+		pagesByID:      make(map[int]*DryRunPage),
+		instances:      make(map[wikibase.ItemPropertyType]*DryRunItem),
+		report: DryRunReport{
+			Properties: make(map[string]string),
+			Items:      make(map[string]wikibase.ItemPropertyType),
+			Pages:      make([]*DryRunPage, 0),
+			Instances:  make([]*DryRunItem, 0),
+			Existing:   make([]*DryRunItem, 0),
+			Calls:      make([]DryRunCall, 0),
+		},
+	}
+}
+
+// Must be called with the lock held
+func (d *DryRunWikibase) record(method string, target string, detail string) {
+	d.report.Calls = append(d.report.Calls, DryRunCall{Method: method, Target: target, Detail: detail})
+}
+
+// Must be called with the lock held
+func (d *DryRunWikibase) mapItem(label string) wikibase.ItemPropertyType {
+	if id, prs := d.report.Items[label]; prs {
+		return id
+	}
+	id := wikibase.ItemPropertyType(fmt.Sprintf("Q%d", d.nextItemID))
+	d.nextItemID += 1
+	d.report.Items[label] = id
+	return id
+}
+
+// itemHeader finds the embedded wikibase.ItemHeader in one of our item structs, along with the
+// item label from its struct tag
+func itemHeader(item interface{}) (reflect.Value, string, error) {
+
+	value := reflect.ValueOf(item)
+	for value.Kind() == reflect.Ptr {
+		value = value.Elem()
+	}
+	if value.Kind() != reflect.Struct {
+		return reflect.Value{}, "", fmt.Errorf("Expected item struct, got %v", value.Kind())
+	}
+
+	field, prs := value.Type().FieldByName("ItemHeader")
+	if !prs {
+		return reflect.Value{}, "", fmt.Errorf("Item %v has no ItemHeader", value.Type())
+	}
+
+	return value.FieldByName("ItemHeader"), field.Tag.Get("item"), nil
+}
+
+// propertyNames gets the labels of the properties in the item's struct tags
+func propertyNames(t reflect.Type) []string {
+
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	res := make([]string, 0)
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag.Get("property")
+		if len(tag) > 0 {
+			res = append(res, strings.Split(tag, ",")[0])
+		}
+	}
+
+	return res
+}
+
+// propertyClaims gets the property values that would be uploaded for an item as strings
+func propertyClaims(item interface{}) map[string]string {
+
+	value := reflect.ValueOf(item)
+	for value.Kind() == reflect.Ptr {
+		value = value.Elem()
+	}
+
+	claims := make(map[string]string)
+	for i := 0; i < value.NumField(); i++ {
+		tag := value.Type().Field(i).Tag.Get("property")
+		if len(tag) == 0 {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+
+		field := value.Field(i)
+		if field.Kind() == reflect.Ptr {
+			if field.IsNil() {
+				continue
+			}
+			field = field.Elem()
+		}
+
+		switch v := field.Interface().(type) {
+		case time.Time:
+			claims[name] = v.Format(time.RFC3339)
+		default:
+			claims[name] = fmt.Sprintf("%v", v)
+		}
+	}
+
+	return claims
+}
+
+func (d *DryRunWikibase) MapPropertyAndItemConfiguration(item interface{}, createIfMissing bool) error {
+
+	_, label, err := itemHeader(item)
+	if err != nil {
+		return err
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if len(label) > 0 {
+		d.mapItem(label)
+	}
+
+	for _, name := range propertyNames(reflect.TypeOf(item)) {
+		if _, prs := d.report.Properties[name]; !prs {
+			d.report.Properties[name] = fmt.Sprintf("P%d", d.nextPropertyID)
+			d.nextPropertyID += 1
+		}
+	}
+
+	return nil
+}
+
+func (d *DryRunWikibase) MapItemConfigurationByLabel(label string, createIfMissing bool) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.mapItem(label)
+	return nil
+}
+
+func (d *DryRunWikibase) ItemForLabel(label string) wikibase.ItemPropertyType {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.report.Items[label]
+}
+
+func (d *DryRunWikibase) CreateOrUpdateArticle(title string, body string) (int, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	page, prs := d.pagesByTitle[title]
+	if !prs {
+		page = &DryRunPage{Title: title, PageID: d.nextPageID}
+		d.nextPageID += 1
+		d.pagesByTitle[title] = page
+		d.pagesByID[page.PageID] = page
+		d.report.Pages = append(d.report.Pages, page)
+	}
+	page.Length = len(body)
+
+	d.record("CreateOrUpdateArticle", title, fmt.Sprintf("page %d, %d bytes", page.PageID, len(body)))
+
+	return page.PageID, nil
+}
+
+func (d *DryRunWikibase) ProtectPageByID(pageID int) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	page, prs := d.pagesByID[pageID]
+	if !prs {
+		return fmt.Errorf("No page with ID %d", pageID)
+	}
+	page.Protected = true
+
+	d.record("ProtectPageByID", page.Title, fmt.Sprintf("page %d", pageID))
+
+	return nil
+}
+
+func (d *DryRunWikibase) CreateItemInstance(label string, item interface{}) error {
+
+	header, kind, err := itemHeader(item)
+	if err != nil {
+		return err
+	}
+	if !header.CanSet() {
+		return fmt.Errorf("Item must be passed by reference to have its ID set")
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	id := wikibase.ItemPropertyType(fmt.Sprintf("Q%d", d.nextItemID))
+	d.nextItemID += 1
+	header.FieldByName("ID").Set(reflect.ValueOf(id))
+
+	instance := &DryRunItem{ID: id, Label: label, Kind: kind}
+	d.instances[id] = instance
+	d.report.Instances = append(d.report.Instances, instance)
+
+	d.record("CreateItemInstance", string(id), label)
+
+	return nil
+}
+
+func (d *DryRunWikibase) UploadClaimsForItem(item interface{}, create bool) error {
+
+	header, _, err := itemHeader(item)
+	if err != nil {
+		return err
+	}
+	id := header.FieldByName("ID").Interface().(wikibase.ItemPropertyType)
+	claims := propertyClaims(item)
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	instance, prs := d.instances[id]
+	if !prs {
+		// This can happen if we're resuming a paper that got part way through a real upload
+		instance = &DryRunItem{ID: id}
+		d.instances[id] = instance
+		d.report.Existing = append(d.report.Existing, instance)
+	}
+	instance.Claims = claims
+
+	d.record("UploadClaimsForItem", string(id), fmt.Sprintf("%d claims", len(claims)))
+
+	return nil
+}
+
+func (d *DryRunWikibase) RemoveItemLinks(item wikibase.ItemPropertyType, targets map[wikibase.ItemPropertyType]bool) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.record("RemoveItemLinks", string(item), fmt.Sprintf("links to %d items", len(targets)))
+
+	return nil
+}
+
+func (d *DryRunWikibase) SaveReport(filename string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	f, err := CreateAtomic(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Abort()
+
+	encoder := json.NewEncoder(f)
+	encoder.SetIndent("", "    ")
+	err = encoder.Encode(d.report)
+	if err != nil {
+		return err
+	}
+
+	return f.Commit()
+}
+
+func (d *DryRunWikibase) Summary() string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	// The items and properties are the configuration we looked up, which a real server would only
+	// create if they were missing
+	return fmt.Sprintf("%d pages and %d item instances would be created and %d existing item instances updated, referencing %d configuration items and %d properties",
+		len(d.report.Pages), len(d.report.Instances), len(d.report.Existing), len(d.report.Items), len(d.report.Properties))
+}
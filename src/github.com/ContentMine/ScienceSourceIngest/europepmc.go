@@ -0,0 +1,311 @@
+//   Copyright 2018 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+)
+
+// The go-europmc library has the REST API location baked in, so we build the URLs ourselves
+// to let them be pointed at a local server or recorded fixtures instead.
+const DefaultEuropePMCBaseURL string = "https://www.ebi.ac.uk/europepmc/webservices/rest"
+
+// Defaults for how hard we try to fetch things from Europe PMC. These can be overridden from
+// the command line.
+const (
+	DefaultEuropePMCRetries        int           = 3
+	DefaultEuropePMCInitialBackoff time.Duration = time.Second
+	DefaultEuropePMCMaxBackoff     time.Duration = time.Minute
+	DefaultEuropePMCRequestRate    float64       = 2.0
+)
+
+type EuropePMCClient struct {
+	BaseURL    string
+	HTTPClient *http.Client
+
+	// How many times to retry after the first attempt fails, and the backoff between attempts,
+	// which doubles each time up to MaxBackoff
+	MaxRetries     int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	// Shared by everyone using this client, so that all the worker goroutines together stay under
+	// the request rate
+	Limiter *RateLimiter
+}
+
+func NewEuropePMCClient(baseURL string, transport http.RoundTripper) *EuropePMCClient {
+	if len(baseURL) == 0 {
+		baseURL = DefaultEuropePMCBaseURL
+	}
+	return &EuropePMCClient{
+		BaseURL:        strings.TrimRight(baseURL, "/"),
+		HTTPClient:     &http.Client{Transport: transport},
+		MaxRetries:     DefaultEuropePMCRetries,
+		InitialBackoff: DefaultEuropePMCInitialBackoff,
+		MaxBackoff:     DefaultEuropePMCMaxBackoff,
+		Limiter:        NewRateLimiter(DefaultEuropePMCRequestRate),
+	}
+}
+
+var defaultEuropePMCClient = NewEuropePMCClient(DefaultEuropePMCBaseURL, nil)
+
+func (client *EuropePMCClient) FullTextURL(id string) string {
+	return fmt.Sprintf("%s/%s/fullTextXML", client.BaseURL, id)
+}
+
+func (client *EuropePMCClient) SupplementaryFilesURL(id string) string {
+	return fmt.Sprintf("%s/%s/supplementaryFiles", client.BaseURL, id)
+}
+
+// RateLimiter spaces out calls to Wait so that on average there are no more than the given number
+// per second.
+type RateLimiter struct {
+	lock     sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func NewRateLimiter(perSecond float64) *RateLimiter {
+	limiter := &RateLimiter{}
+	if perSecond > 0 {
+		limiter.interval = time.Duration(float64(time.Second) / perSecond)
+	}
+	return limiter
+}
+
+// Wait blocks until it is our turn to make a request, or returns an error if ctx is cancelled
+// first
+func (limiter *RateLimiter) Wait(ctx context.Context) error {
+	if limiter == nil || limiter.interval == 0 {
+		return ctx.Err()
+	}
+
+	limiter.lock.Lock()
+	now := time.Now()
+	slot := limiter.next
+	if slot.Before(now) {
+		slot = now
+	}
+	limiter.next = slot.Add(limiter.interval)
+	limiter.lock.Unlock()
+
+	return sleepContext(ctx, slot.Sub(now))
+}
+
+// sleepContext is time.Sleep, but gives up early if ctx is cancelled
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+type HTTPStatusError struct {
+	URL        string
+	StatusCode int
+	RetryAfter time.Duration
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("Got status %d %s from %s", e.StatusCode, http.StatusText(e.StatusCode), e.URL)
+}
+
+// Temporary errors are worth retrying, whereas if the paper isn't there it won't be there if we
+// ask again.
+func (e *HTTPStatusError) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode == http.StatusRequestTimeout || e.StatusCode >= 500
+}
+
+// A TooLargeError says a response was bigger than we're willing to read. Asking again won't
+// make it any smaller.
+type TooLargeError struct {
+	URL     string
+	MaxSize int64
+}
+
+func (e *TooLargeError) Error() string {
+	return fmt.Sprintf("Response from %s is larger than %d bytes", e.URL, e.MaxSize)
+}
+
+// parseRetryAfter reads a Retry-After header, which can either be a number of seconds or a date
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if len(value) == 0 {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(strings.TrimSpace(value)); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if when, err := http.ParseTime(value); err == nil {
+		if when.After(now) {
+			return when.Sub(now)
+		}
+	}
+	return 0
+}
+
+// backoff works out how long to wait before the given retry, with jitter so that several workers
+// that failed at once don't all come back at once.
+func (client *EuropePMCClient) backoff(retry int) time.Duration {
+	backoff := client.InitialBackoff
+	for i := 1; i < retry && backoff < client.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if client.MaxBackoff > 0 && backoff > client.MaxBackoff {
+		backoff = client.MaxBackoff
+	}
+	half := int64(backoff / 2)
+	if half <= 0 {
+		return backoff
+	}
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+// get makes a single request, and returns the body only if we got a 200. If maxSize is set then
+// bodies larger than that aren't read any further than we need to tell.
+func (client *EuropePMCClient) get(ctx context.Context, resourceURL string, maxSize int64) ([]byte, error) {
+
+	err := client.Limiter.Wait(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("GET", resourceURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.HTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &HTTPStatusError{
+			URL:        resourceURL,
+			StatusCode: resp.StatusCode,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+		}
+	}
+
+	if maxSize <= 0 {
+		return ioutil.ReadAll(resp.Body)
+	}
+	if resp.ContentLength > maxSize {
+		return nil, &TooLargeError{URL: resourceURL, MaxSize: maxSize}
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxSize {
+		return nil, &TooLargeError{URL: resourceURL, MaxSize: maxSize}
+	}
+	return data, nil
+}
+
+// fetch gets a resource, retrying on network errors and temporary server errors, until ctx is
+// cancelled
+func (client *EuropePMCClient) fetch(ctx context.Context, resourceURL string, maxSize int64) ([]byte, error) {
+
+	retry := 0
+	for {
+		data, err := client.get(ctx, resourceURL, maxSize)
+		if err == nil {
+			return data, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if _, tooLarge := err.(*TooLargeError); tooLarge {
+			return nil, err
+		}
+
+		if urlErr, ok := err.(*url.Error); ok {
+			if _, miss := urlErr.Err.(*ReplayMissError); miss {
+				return nil, err
+			}
+		}
+
+		wait := client.backoff(retry + 1)
+		if statusErr, ok := err.(*HTTPStatusError); ok {
+			if !statusErr.Temporary() {
+				return nil, err
+			}
+			if statusErr.RetryAfter > wait {
+				// Don't let the server keep a worker waiting longer than we'd back off for
+				if client.MaxBackoff > 0 && statusErr.RetryAfter > client.MaxBackoff {
+					return nil, errwrap.Wrapf(fmt.Sprintf("Giving up as asked to retry after %v, more than the maximum backoff of %v: {{err}}",
+						statusErr.RetryAfter, client.MaxBackoff), err)
+				}
+				wait = statusErr.RetryAfter
+			}
+		}
+
+		if retry >= client.MaxRetries {
+			return nil, errwrap.Wrapf(fmt.Sprintf("Giving up after %d attempts: {{err}}", retry+1), err)
+		}
+		retry += 1
+
+		log.Printf("Failed to fetch %s (%v), retrying in %v", resourceURL, err, wait)
+		err = sleepContext(ctx, wait)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// fetchResource saves a resource to filename if it isn't there already. If maxSize is set then
+// larger resources give a TooLargeError and aren't saved.
+func (client *EuropePMCClient) fetchResource(ctx context.Context, resourceURL string, filename string, maxSize int64) error {
+
+	// if it already exists, don't fetch it again
+	if _, err := os.Stat(filename); err == nil {
+		return nil
+	}
+
+	// Only create the file once we have a good response, otherwise we'd save error pages
+	// and never try again
+	data, err := client.fetch(ctx, resourceURL, maxSize)
+	if err != nil {
+		return err
+	}
+
+	return WriteFileAtomic(filename, data)
+}
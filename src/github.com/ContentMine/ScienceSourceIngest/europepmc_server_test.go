@@ -0,0 +1,81 @@
+//   Copyright 2018 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+)
+
+// fakeEuropePMCServer serves canned fullTextXML and supplementaryFiles responses, and can be told
+// to fail a number of times first so we can test how fetching copes with errors.
+
+type fakeEuropePMCServer struct {
+	*httptest.Server
+
+	lock sync.Mutex
+
+	Resources map[string][]byte // keyed on path, e.g., /PMC1234567/fullTextXML
+	Failures  map[string][]int  // status codes to return for a path before succeeding
+	Requests  map[string]int
+
+	RetryAfter string // sent with failures if set
+	Streamed   bool   // send bodies without a Content-Length, as they're being made
+}
+
+func newFakeEuropePMCServer() *fakeEuropePMCServer {
+	server := &fakeEuropePMCServer{
+		Resources: make(map[string][]byte),
+		Failures:  make(map[string][]int),
+		Requests:  make(map[string]int),
+	}
+	server.Server = httptest.NewServer(http.HandlerFunc(server.handle))
+	return server
+}
+
+func (server *fakeEuropePMCServer) handle(w http.ResponseWriter, r *http.Request) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	server.Requests[r.URL.Path] += 1
+
+	if failures := server.Failures[r.URL.Path]; len(failures) > 0 {
+		server.Failures[r.URL.Path] = failures[1:]
+		if len(server.RetryAfter) > 0 {
+			w.Header().Set("Retry-After", server.RetryAfter)
+		}
+		http.Error(w, "Fake failure", failures[0])
+		return
+	}
+
+	body, prs := server.Resources[r.URL.Path]
+	if !prs {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	if server.Streamed {
+		w.(http.Flusher).Flush()
+	}
+	w.Write(body)
+}
+
+func (server *fakeEuropePMCServer) requestCount(path string) int {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	return server.Requests[path]
+}
@@ -0,0 +1,291 @@
+//   Copyright 2018 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func newTestEuropePMCServer(t *testing.T) (*fakeEuropePMCServer, []byte) {
+	data, err := ioutil.ReadFile(path.Join("testdata", "PMC1234567.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newFakeEuropePMCServer()
+	server.Resources["/PMC1234567/fullTextXML"] = data
+	return server, data
+}
+
+func newTestFetchProcessor(t *testing.T, client *EuropePMCClient) (PaperProcessor, func()) {
+	dir, err := ioutil.TempDir("", "sciencesourceingest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	processor := PaperProcessor{
+		Paper:           testPaper(),
+		TargetDirectory: dir,
+		EuropePMC:       client,
+	}
+	return processor, func() { os.RemoveAll(dir) }
+}
+
+func TestFetchPaperUsesConfiguredURL(t *testing.T) {
+
+	server, expected := newTestEuropePMCServer(t)
+	defer server.Close()
+
+	processor, cleanup := newTestFetchProcessor(t, NewEuropePMCClient(server.URL, nil))
+	defer cleanup()
+
+	err := processor.FetchPaper(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(processor.targetXMLFileName())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, expected) {
+		t.Errorf("Fetched paper does not match what the server sent")
+	}
+
+	// Fetching again should use what's on disk
+	err = processor.FetchPaper(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count := server.requestCount("/PMC1234567/fullTextXML"); count != 1 {
+		t.Errorf("Expected 1 request, got %d", count)
+	}
+}
+
+func TestRecordAndReplayFetch(t *testing.T) {
+
+	server, expected := newTestEuropePMCServer(t)
+
+	fixtures, err := ioutil.TempDir("", "sciencesourceingest-fixtures")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(fixtures)
+
+	recorder := NewEuropePMCClient(server.URL, &RecordReplayTransport{Mode: RecordMode, Directory: fixtures})
+	recordProcessor, cleanup := newTestFetchProcessor(t, recorder)
+	defer cleanup()
+	err = recordProcessor.FetchPaper(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replay must work without the server
+	server.Close()
+
+	replayer := NewEuropePMCClient(server.URL, &RecordReplayTransport{Mode: ReplayMode, Directory: fixtures})
+	replayProcessor, cleanup := newTestFetchProcessor(t, replayer)
+	defer cleanup()
+	err = replayProcessor.FetchPaper(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(replayProcessor.targetXMLFileName())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, expected) {
+		t.Errorf("Replayed paper does not match what was recorded")
+	}
+
+	// Anything not recorded should fail rather than go to the network
+	replayProcessor.Paper.PMCID.Value = "PMC7654321"
+	err = replayProcessor.FetchPaper(context.Background())
+	if err == nil {
+		t.Errorf("Expected replaying an unrecorded paper to fail")
+	}
+}
+
+func newTestRetryingClient(server *fakeEuropePMCServer) *EuropePMCClient {
+	client := NewEuropePMCClient(server.URL, nil)
+	client.InitialBackoff = time.Millisecond
+	client.MaxBackoff = 10 * time.Millisecond
+	client.Limiter = nil
+	return client
+}
+
+func TestFetchRetriesTemporaryFailures(t *testing.T) {
+
+	server, expected := newTestEuropePMCServer(t)
+	defer server.Close()
+	server.Failures["/PMC1234567/fullTextXML"] = []int{503, 500, 429}
+
+	processor, cleanup := newTestFetchProcessor(t, newTestRetryingClient(server))
+	defer cleanup()
+
+	err := processor.FetchPaper(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(processor.targetXMLFileName())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, expected) {
+		t.Errorf("Fetched paper does not match what the server sent")
+	}
+	if count := server.requestCount("/PMC1234567/fullTextXML"); count != 4 {
+		t.Errorf("Expected 4 requests, got %d", count)
+	}
+}
+
+func TestFetchGivesUpAndSavesNothing(t *testing.T) {
+
+	server, _ := newTestEuropePMCServer(t)
+	defer server.Close()
+	server.Failures["/PMC1234567/fullTextXML"] = []int{503, 503, 503, 503, 503}
+
+	client := newTestRetryingClient(server)
+	client.MaxRetries = 2
+	processor, cleanup := newTestFetchProcessor(t, client)
+	defer cleanup()
+
+	err := processor.FetchPaper(context.Background())
+	if err == nil {
+		t.Fatalf("Expected fetch to fail")
+	}
+	if count := server.requestCount("/PMC1234567/fullTextXML"); count != 3 {
+		t.Errorf("Expected 3 requests, got %d", count)
+	}
+	if fileExists(processor.targetXMLFileName()) {
+		t.Errorf("Expected no paper to be saved after a failed fetch")
+	}
+
+	// Not found is not worth retrying
+	processor.Paper.PMCID.Value = "PMC7654321"
+	err = processor.FetchPaper(context.Background())
+	if err == nil {
+		t.Fatalf("Expected fetch of missing paper to fail")
+	}
+	if count := server.requestCount("/PMC7654321/fullTextXML"); count != 1 {
+		t.Errorf("Expected 1 request for missing paper, got %d", count)
+	}
+	if fileExists(processor.targetXMLFileName()) {
+		t.Errorf("Expected no paper to be saved for a 404")
+	}
+}
+
+func TestFetchGivesUpOnLongRetryAfter(t *testing.T) {
+
+	server, _ := newTestEuropePMCServer(t)
+	defer server.Close()
+	server.Failures["/PMC1234567/fullTextXML"] = []int{503, 503}
+	server.RetryAfter = "3600"
+
+	processor, cleanup := newTestFetchProcessor(t, newTestRetryingClient(server))
+	defer cleanup()
+
+	start := time.Now()
+	err := processor.FetchPaper(context.Background())
+	if err == nil {
+		t.Fatalf("Expected fetch to fail")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected to give up rather than wait, took %v", elapsed)
+	}
+	if count := server.requestCount("/PMC1234567/fullTextXML"); count != 1 {
+		t.Errorf("Expected 1 request, got %d", count)
+	}
+}
+
+func TestFetchBackoffCancelled(t *testing.T) {
+
+	server, _ := newTestEuropePMCServer(t)
+	defer server.Close()
+	server.Failures["/PMC1234567/fullTextXML"] = []int{503, 503}
+
+	client := newTestRetryingClient(server)
+	client.InitialBackoff = time.Hour
+	client.MaxBackoff = time.Hour
+	processor, cleanup := newTestFetchProcessor(t, client)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := processor.FetchPaper(ctx)
+	if err == nil {
+		t.Fatalf("Expected fetch to fail")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected cancelling to stop the backoff, took %v", elapsed)
+	}
+	if count := server.requestCount("/PMC1234567/fullTextXML"); count != 1 {
+		t.Errorf("Expected 1 request, got %d", count)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+
+	now := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	cases := map[string]time.Duration{
+		"":                              0,
+		"5":                             5 * time.Second,
+		"-1":                            0,
+		"Mon, 01 Oct 2018 12:00:30 GMT": 30 * time.Second,
+		"Mon, 01 Oct 2018 11:00:00 GMT": 0,
+		"nonsense":                      0,
+	}
+	for value, expected := range cases {
+		if actual := parseRetryAfter(value, now); actual != expected {
+			t.Errorf("Expected %q to give %v, got %v", value, expected, actual)
+		}
+	}
+}
+
+func TestRateLimiterSpacesRequests(t *testing.T) {
+
+	limiter := NewRateLimiter(100)
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		limiter.Wait(context.Background())
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("Expected 5 requests at 100/s to take at least 40ms, took %v", elapsed)
+	}
+}
+
+func TestRateLimiterWaitCancelled(t *testing.T) {
+
+	limiter := NewRateLimiter(0.001)
+	if err := limiter.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	if err := limiter.Wait(ctx); err != context.Canceled {
+		t.Errorf("Expected the wait to be cancelled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected cancelled wait to return at once, took %v", elapsed)
+	}
+}
@@ -0,0 +1,319 @@
+//   Copyright 2018 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Statistics on which dictionary entries were found across all the papers in an output
+// directory, for curators to see which entries are useful and which never fire.
+
+const DefaultMinCooccurrence int = 2
+
+type DictionaryHits struct {
+	Dictionary string `json:"dictionary"`
+	Hits       int    `json:"hits"`
+	Papers     int    `json:"papers"`
+	Entries    int    `json:"entries"`
+}
+
+type EntryHits struct {
+	// Dictionary and Wikidata ID, or preferred label if there is no Wikidata ID
+	ID             string `json:"id"`
+	Dictionary     string `json:"dictionary"`
+	WikiData       string `json:"wikidata"`
+	PreferredLabel string `json:"preferred_label"`
+	Hits           int    `json:"hits"`
+	Papers         int    `json:"papers"`
+	// How often each form of the entry was found
+	Terms map[string]int `json:"terms"`
+}
+
+// CooccurrenceCount is how many papers mention both entries
+type CooccurrenceCount struct {
+	First  string `json:"first"`
+	Second string `json:"second"`
+	Papers int    `json:"papers"`
+}
+
+type HitReport struct {
+	Papers        int                 `json:"papers"`
+	Dictionaries  []DictionaryHits    `json:"dictionaries"`
+	Entries       []EntryHits         `json:"entries"`
+	Cooccurrences []CooccurrenceCount `json:"cooccurrences"`
+}
+
+func hitEntryID(annotation ScienceSourceAnnotation) string {
+	if len(annotation.WikiDataItemCode) > 0 {
+		return annotation.DictionaryName + "/" + annotation.WikiDataItemCode
+	}
+	return annotation.DictionaryName + "/" + hitPreferredLabel(annotation)
+}
+
+// Papers annotated before we recorded the preferred label only have the term found
+func hitPreferredLabel(annotation ScienceSourceAnnotation) string {
+	if annotation.PreferredLabel != nil {
+		return *annotation.PreferredLabel
+	}
+	return annotation.TermFound
+}
+
+// BuildHitReport adds up the annotations in the articles. Pairs of entries found together in fewer
+// than minCooccurrence papers are left out, as there are a great many of them.
+func BuildHitReport(articles []*ScienceSourceArticle, minCooccurrence int) HitReport {
+
+	dictionaries := make(map[string]*DictionaryHits)
+	dictionaryEntries := make(map[string]map[string]bool)
+	entries := make(map[string]*EntryHits)
+	entriesInPapers := make([][]string, 0, len(articles))
+
+	for _, article := range articles {
+
+		inPaper := make(map[string]bool)
+		dictionariesInPaper := make(map[string]bool)
+
+		for i := range article.Annotations {
+			for _, annotation := range article.Annotations[i].allAnnotations() {
+				id := hitEntryID(*annotation)
+
+				dictionary, prs := dictionaries[annotation.DictionaryName]
+				if !prs {
+					dictionary = &DictionaryHits{Dictionary: annotation.DictionaryName}
+					dictionaries[annotation.DictionaryName] = dictionary
+					dictionaryEntries[annotation.DictionaryName] = make(map[string]bool)
+				}
+				dictionary.Hits += 1
+				dictionaryEntries[annotation.DictionaryName][id] = true
+				if !dictionariesInPaper[annotation.DictionaryName] {
+					dictionariesInPaper[annotation.DictionaryName] = true
+					dictionary.Papers += 1
+				}
+
+				entry, prs := entries[id]
+				if !prs {
+					entry = &EntryHits{
+						ID:             id,
+						Dictionary:     annotation.DictionaryName,
+						WikiData:       annotation.WikiDataItemCode,
+						PreferredLabel: hitPreferredLabel(*annotation),
+						Terms:          make(map[string]int),
+					}
+					entries[id] = entry
+				}
+				entry.Hits += 1
+				entry.Terms[annotation.TermFound] += 1
+				if !inPaper[id] {
+					inPaper[id] = true
+					entry.Papers += 1
+				}
+			}
+		}
+
+		ids := make([]string, 0, len(inPaper))
+		for id := range inPaper {
+			ids = append(ids, id)
+		}
+		entriesInPapers = append(entriesInPapers, ids)
+	}
+	cooccurrences := countCooccurrences(entriesInPapers, entries, minCooccurrence)
+
+	report := HitReport{
+		Papers:        len(articles),
+		Dictionaries:  make([]DictionaryHits, 0, len(dictionaries)),
+		Entries:       make([]EntryHits, 0, len(entries)),
+		Cooccurrences: make([]CooccurrenceCount, 0),
+	}
+
+	for name, dictionary := range dictionaries {
+		dictionary.Entries = len(dictionaryEntries[name])
+		report.Dictionaries = append(report.Dictionaries, *dictionary)
+	}
+	sort.Slice(report.Dictionaries, func(i, j int) bool {
+		return report.Dictionaries[i].Dictionary < report.Dictionaries[j].Dictionary
+	})
+
+	for _, entry := range entries {
+		report.Entries = append(report.Entries, *entry)
+	}
+	sort.Slice(report.Entries, func(i, j int) bool {
+		if report.Entries[i].Hits != report.Entries[j].Hits {
+			return report.Entries[i].Hits > report.Entries[j].Hits
+		}
+		return report.Entries[i].ID < report.Entries[j].ID
+	})
+
+	for pair, papers := range cooccurrences {
+		report.Cooccurrences = append(report.Cooccurrences, CooccurrenceCount{First: pair[0], Second: pair[1], Papers: papers})
+	}
+	sort.Slice(report.Cooccurrences, func(i, j int) bool {
+		a, b := report.Cooccurrences[i], report.Cooccurrences[j]
+		if a.Papers != b.Papers {
+			return a.Papers > b.Papers
+		}
+		if a.First != b.First {
+			return a.First < b.First
+		}
+		return a.Second < b.Second
+	})
+
+	return report
+}
+
+// countCooccurrences counts how many papers each pair of entries is found together in, given the
+// entries found in each paper, leaving out pairs found together in fewer than minCooccurrence
+// papers. A pair can't be in more papers than either of its entries, so entries that aren't in
+// enough papers are left out before pairing them up, otherwise a paper with many entries would
+// give us a great many pairs to throw away.
+func countCooccurrences(entriesInPapers [][]string, entries map[string]*EntryHits, minCooccurrence int) map[[2]string]int {
+
+	cooccurrences := make(map[[2]string]int)
+	for _, inPaper := range entriesInPapers {
+		ids := make([]string, 0, len(inPaper))
+		for _, id := range inPaper {
+			if entries[id].Papers >= minCooccurrence {
+				ids = append(ids, id)
+			}
+		}
+		sort.Strings(ids)
+		for i := 0; i < len(ids); i++ {
+			for j := i + 1; j < len(ids); j++ {
+				cooccurrences[[2]string{ids[i], ids[j]}] += 1
+			}
+		}
+	}
+
+	for pair, papers := range cooccurrences {
+		if papers < minCooccurrence {
+			delete(cooccurrences, pair)
+		}
+	}
+	return cooccurrences
+}
+
+// loadStateFiles finds the state file of every paper in an output directory. Papers whose state
+// can't be loaded are logged and skipped, so one bad paper doesn't stop the report.
+func loadStateFiles(directory string) ([]*ScienceSourceArticle, error) {
+
+	articles := make([]*ScienceSourceArticle, 0)
+	err := filepath.Walk(directory, func(filename string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || info.Name() != "scisource.json" {
+			return nil
+		}
+		article, err := LoadScienceSourceArticle(filename)
+		if err != nil {
+			log.Printf("Skipping %s: %v", filename, err)
+			return nil
+		}
+		articles = append(articles, article)
+		return nil
+	})
+
+	return articles, err
+}
+
+func (report HitReport) SaveJSON(filename string) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(filename, data)
+}
+
+func writeCSVFile(filename string, rows [][]string) error {
+	var buffer bytes.Buffer
+	writer := csv.NewWriter(&buffer)
+	err := writer.WriteAll(rows)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(filename, buffer.Bytes())
+}
+
+// SaveCSV writes a file for each table in the report, named with the given prefix
+func (report HitReport) SaveCSV(prefix string) ([]string, error) {
+
+	dictionaries := [][]string{{"dictionary", "hits", "papers", "entries"}}
+	for _, dictionary := range report.Dictionaries {
+		dictionaries = append(dictionaries, []string{
+			dictionary.Dictionary,
+			strconv.Itoa(dictionary.Hits),
+			strconv.Itoa(dictionary.Papers),
+			strconv.Itoa(dictionary.Entries),
+		})
+	}
+
+	entries := [][]string{{"id", "dictionary", "wikidata", "preferred_label", "hits", "papers", "terms"}}
+	for _, entry := range report.Entries {
+		terms := make([]string, 0, len(entry.Terms))
+		for term := range entry.Terms {
+			terms = append(terms, term)
+		}
+		sort.Strings(terms)
+		for i, term := range terms {
+			terms[i] = fmt.Sprintf("%s (%d)", term, entry.Terms[term])
+		}
+		entries = append(entries, []string{
+			entry.ID,
+			entry.Dictionary,
+			entry.WikiData,
+			entry.PreferredLabel,
+			strconv.Itoa(entry.Hits),
+			strconv.Itoa(entry.Papers),
+			strings.Join(terms, "; "),
+		})
+	}
+
+	cooccurrences := [][]string{{"first", "second", "papers"}}
+	for _, cooccurrence := range report.Cooccurrences {
+		cooccurrences = append(cooccurrences, []string{cooccurrence.First, cooccurrence.Second, strconv.Itoa(cooccurrence.Papers)})
+	}
+
+	filenames := make([]string, 0, 3)
+	for _, table := range []struct {
+		name string
+		rows [][]string
+	}{
+		{"dictionaries", dictionaries},
+		{"entries", entries},
+		{"cooccurrences", cooccurrences},
+	} {
+		filename := fmt.Sprintf("%s-%s.csv", prefix, table.name)
+		err := writeCSVFile(filename, table.rows)
+		if err != nil {
+			return nil, err
+		}
+		filenames = append(filenames, filename)
+	}
+
+	return filenames, nil
+}
+
+func defaultHitReportPrefix(directory string) string {
+	return path.Join(directory, "hit-report")
+}
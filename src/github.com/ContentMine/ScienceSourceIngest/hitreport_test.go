@@ -0,0 +1,192 @@
+//   Copyright 2018 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func hitAnnotation(dictionary string, wikidata string, label string, term string) ScienceSourceAnnotation {
+	return ScienceSourceAnnotation{
+		TermFound:         term,
+		PreferredLabel:    &label,
+		LengthOfTermFound: len(term),
+		WikiDataItemCode:  wikidata,
+		DictionaryName:    dictionary,
+	}
+}
+
+func hitArticle(title string, annotations ...ScienceSourceAnnotation) *ScienceSourceArticle {
+	article := &ScienceSourceArticle{ScienceSourceArticleTitle: title}
+	for i, annotation := range annotations {
+		article.Annotations = append(article.Annotations, ScienceSourceAnchorPoint{CharacterNumber: i * 100, Annotation: annotation})
+	}
+	return article
+}
+
+func testHitArticles() []*ScienceSourceArticle {
+	malaria := hitAnnotation("diseases", "Q12156", "malaria", "malaria")
+	paludism := hitAnnotation("diseases", "Q12156", "malaria", "paludism")
+	cholera := hitAnnotation("diseases", "Q12090", "cholera", "cholera")
+	quinine := hitAnnotation("drugs", "Q179916", "quinine", "quinine")
+
+	// Quinine is also found on the same text as malaria in the last paper
+	last := hitArticle("three", malaria)
+	last.Annotations[0].AdditionalAnnotations = []ScienceSourceAnnotation{quinine}
+
+	return []*ScienceSourceArticle{
+		hitArticle("one", malaria, paludism, quinine),
+		hitArticle("two", cholera, malaria),
+		last,
+	}
+}
+
+func TestBuildHitReport(t *testing.T) {
+
+	report := BuildHitReport(testHitArticles(), DefaultMinCooccurrence)
+
+	if report.Papers != 3 {
+		t.Errorf("Expected 3 papers, got %d", report.Papers)
+	}
+
+	expectedDictionaries := []DictionaryHits{
+		{Dictionary: "diseases", Hits: 5, Papers: 3, Entries: 2},
+		{Dictionary: "drugs", Hits: 2, Papers: 2, Entries: 1},
+	}
+	if !reflect.DeepEqual(report.Dictionaries, expectedDictionaries) {
+		t.Errorf("Expected dictionaries %v, got %v", expectedDictionaries, report.Dictionaries)
+	}
+
+	if len(report.Entries) != 3 {
+		t.Fatalf("Expected 3 entries, got %v", report.Entries)
+	}
+	malaria := report.Entries[0]
+	if malaria.ID != "diseases/Q12156" || malaria.Hits != 4 || malaria.Papers != 3 || malaria.PreferredLabel != "malaria" {
+		t.Errorf("Unexpected malaria entry %v", malaria)
+	}
+	if !reflect.DeepEqual(malaria.Terms, map[string]int{"malaria": 3, "paludism": 1}) {
+		t.Errorf("Unexpected malaria terms %v", malaria.Terms)
+	}
+
+	// Only malaria and quinine are together in two papers
+	expectedCooccurrences := []CooccurrenceCount{{First: "diseases/Q12156", Second: "drugs/Q179916", Papers: 2}}
+	if !reflect.DeepEqual(report.Cooccurrences, expectedCooccurrences) {
+		t.Errorf("Expected co-occurrences %v, got %v", expectedCooccurrences, report.Cooccurrences)
+	}
+	if all := BuildHitReport(testHitArticles(), 1); len(all.Cooccurrences) != 2 {
+		t.Errorf("Expected 2 co-occurrences with no minimum, got %v", all.Cooccurrences)
+	}
+}
+
+func TestHitReportWithManyEntriesInOnePaper(t *testing.T) {
+
+	// A paper that mentions thousands of things once would give millions of pairs, none of which
+	// can be in enough papers to be reported
+	articles := testHitArticles()
+	annotations := []ScienceSourceAnnotation{hitAnnotation("diseases", "Q12156", "malaria", "malaria")}
+	for i := 0; i < 3000; i++ {
+		label := fmt.Sprintf("gene%d", i)
+		annotations = append(annotations, hitAnnotation("genes", "", label, label))
+	}
+	articles = append(articles, hitArticle("four", annotations...))
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	report := BuildHitReport(articles, DefaultMinCooccurrence)
+	runtime.ReadMemStats(&after)
+
+	if len(report.Entries) != 3003 {
+		t.Errorf("Expected 3003 entries, got %d", len(report.Entries))
+	}
+	expectedCooccurrences := []CooccurrenceCount{{First: "diseases/Q12156", Second: "drugs/Q179916", Papers: 2}}
+	if !reflect.DeepEqual(report.Cooccurrences, expectedCooccurrences) {
+		t.Errorf("Expected co-occurrences %v, got %v", expectedCooccurrences, report.Cooccurrences)
+	}
+	// Counting every pair would take hundreds of megabytes
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 50*1024*1024 {
+		t.Errorf("Expected the report to be built without pairing up every entry, allocated %d bytes", allocated)
+	}
+}
+
+func TestHitReportFromOutputDirectory(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "sciencesourceingest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, article := range testHitArticles() {
+		folder := path.Join(dir, article.ScienceSourceArticleTitle)
+		err = os.Mkdir(folder, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = article.Save(path.Join(folder, "scisource.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A bad paper shouldn't stop the report
+	err = os.Mkdir(path.Join(dir, "bad"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(path.Join(dir, "bad", "scisource.json"), []byte("{"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	articles, err := loadStateFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(articles) != 3 {
+		t.Fatalf("Expected 3 papers, got %d", len(articles))
+	}
+
+	report := BuildHitReport(articles, DefaultMinCooccurrence)
+	filenames, err := report.SaveCSV(defaultHitReportPrefix(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filenames) != 3 {
+		t.Fatalf("Expected 3 CSV files, got %v", filenames)
+	}
+
+	f, err := os.Open(path.Join(dir, "hit-report-entries.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 4 || rows[0][0] != "id" {
+		t.Fatalf("Unexpected entries CSV %v", rows)
+	}
+	expected := []string{"diseases/Q12156", "diseases", "Q12156", "malaria", "4", "3", "malaria (3); paludism (1)"}
+	if !reflect.DeepEqual(rows[1], expected) {
+		t.Errorf("Expected %v, got %v", expected, rows[1])
+	}
+}
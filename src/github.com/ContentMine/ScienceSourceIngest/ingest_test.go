@@ -0,0 +1,550 @@
+//   Copyright 2018 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ContentMine/wikibase"
+)
+
+const testOAuthInformation string = `{
+    "consumer": {"key": "testconsumerkey", "secret": "testconsumersecret"},
+    "access": {"token": "testaccesstoken", "secret": "testaccesssecret"}
+}`
+
+func testPaper() Paper {
+	return Paper{
+		Date:             DataValue{Type: "literal", Value: "2009-01-01T00:00:00Z"},
+		Item:             DataValue{Type: "uri", Value: "http://www.wikidata.org/entity/Q28474713"},
+		JournalLabel:     DataValue{Type: "literal", Value: "PLOS Neglected Tropical Diseases"},
+		LicenseLabel:     DataValue{Type: "literal", Value: "CC BY 2.5"},
+		MainSubjectLabel: DataValue{Type: "literal", Value: "infectious disease"},
+		PMCID:            DataValue{Type: "literal", Value: "PMC1234567"},
+		Title:            DataValue{Type: "literal", Value: "Malaria and cholera in rural settings"},
+	}
+}
+
+// newTestProcessor makes a processor for the test paper in a temporary directory, with the
+// fixture XML already in place so that nothing is fetched from Europe PMC.
+func newTestProcessor(t *testing.T) (PaperProcessor, func()) {
+
+	dir, err := ioutil.TempDir("", "sciencesourceingest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	processor := PaperProcessor{
+		Paper:           testPaper(),
+		TargetDirectory: dir,
+		Converter:       NativeConverter{},
+	}
+
+	err = processor.createFolderIfRequired()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path.Join("testdata", processor.Paper.ID()+".xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(processor.targetXMLFileName(), data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return processor, func() { os.RemoveAll(dir) }
+}
+
+func newTestScienceSourceClient(t *testing.T, server *fakeWikibaseServer, dir string) *ScienceSourceClient {
+
+	oauthPath := path.Join(dir, "oauth.json")
+	err := ioutil.WriteFile(oauthPath, []byte(testOAuthInformation), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oauthInfo, err := wikibase.LoadOauthInformation(oauthPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewScienceSourceClient(oauthInfo, server.URL)
+	err = client.GetConfigurationFromServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return client
+}
+
+func TestProcessPaperEndToEnd(t *testing.T) {
+
+	server := newFakeWikibaseServer()
+	defer server.Close()
+
+	processor, cleanup := newTestProcessor(t)
+	defer cleanup()
+
+	client := newTestScienceSourceClient(t, server, processor.TargetDirectory)
+
+	dictionaries, err := LoadDictionariesFromDirectory(path.Join("testdata", "dictionaries"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = processor.ProcessPaper(context.Background(), dictionaries, client)
+	if err != nil {
+		t.Fatalf("Failed to process paper: %v", err)
+	}
+
+	article, err := LoadScienceSourceArticle(processor.targetScienceSourceStateFileName())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !article.ClaimsUploaded {
+		t.Errorf("Expected article to be marked as complete")
+	}
+
+	expectedTerms := []string{"cholera", "malaria", "pneumonia", "malaria", "cholera"}
+	if len(article.Annotations) != len(expectedTerms) {
+		t.Fatalf("Expected %d annotations, got %d", len(expectedTerms), len(article.Annotations))
+	}
+	for i, term := range expectedTerms {
+		if article.Annotations[i].Annotation.TermFound != term {
+			t.Errorf("Expected annotation %d to be %s, got %s", i, term, article.Annotations[i].Annotation.TermFound)
+		}
+	}
+
+	// The page should be uploaded and protected
+	page, prs := server.Pages[article.ScienceSourceArticleTitle]
+	if !prs {
+		t.Fatalf("Page %s not created", article.ScienceSourceArticleTitle)
+	}
+	if page.ID != article.PageID {
+		t.Errorf("Expected page ID %d, got %d", page.ID, article.PageID)
+	}
+	if !page.Protected {
+		t.Errorf("Expected page to be protected")
+	}
+	if !strings.Contains(page.Text, "{{articleheader") || !strings.Contains(page.Text, "{{articlefooter") {
+		t.Errorf("Expected page to have header and footer templates")
+	}
+
+	// Check the item graph matches the Data_schema, as set up by ReconsileArticleItemTree
+	expectClaim := func(itemID wikibase.ItemPropertyType, property string, expected string) {
+		t.Helper()
+		values := server.claimValues(string(itemID), property)
+		if len(values) != 1 || values[0] != expected {
+			t.Errorf("Expected %s to have %s of %s, got %v", itemID, property, expected, values)
+		}
+	}
+
+	terminus := server.entityID("item", "terminus")
+	if len(terminus) == 0 {
+		t.Fatalf("No terminus item")
+	}
+
+	expectClaim(article.ID, "instance of", server.entityID("item", "article"))
+	expectClaim(article.ID, "Wikidata item code", "Q28474713")
+	expectClaim(article.ID, "following anchor point", string(article.Annotations[0].ID))
+
+	for i, anchor := range article.Annotations {
+		expectClaim(anchor.ID, "instance of", server.entityID("item", "anchor point"))
+		expectClaim(anchor.ID, "anchor point in", string(article.ID))
+		expectClaim(anchor.ID, "anchors", string(anchor.Annotation.ID))
+		if i == 0 {
+			if values := server.claimValues(string(anchor.ID), "preceding anchor point"); len(values) != 0 {
+				t.Errorf("Expected first anchor point to have no preceding anchor point, got %v", values)
+			}
+		} else {
+			expectClaim(anchor.ID, "preceding anchor point", string(article.Annotations[i-1].ID))
+		}
+		if i == len(article.Annotations)-1 {
+			expectClaim(anchor.ID, "following anchor point", terminus)
+		} else {
+			expectClaim(anchor.ID, "following anchor point", string(article.Annotations[i+1].ID))
+		}
+
+		expectClaim(anchor.Annotation.ID, "instance of", server.entityID("item", "annotation"))
+		expectClaim(anchor.Annotation.ID, "based on", string(anchor.ID))
+		expectClaim(anchor.Annotation.ID, "term found", expectedTerms[i])
+		expectClaim(anchor.Annotation.ID, "preferred label", expectedTerms[i])
+		expectClaim(anchor.Annotation.ID, "dictionary name", "infectiousdiseases")
+	}
+
+	if problems := processor.Verify(); len(problems) != 0 {
+		t.Errorf("Verify found problems: %v", problems)
+	}
+
+	// Running again should not create anything new on the server
+	entities := len(server.Entities)
+	err = processor.ProcessPaper(context.Background(), dictionaries, client)
+	if err != nil {
+		t.Fatalf("Failed to re-process paper: %v", err)
+	}
+	if len(server.Entities) != entities {
+		t.Errorf("Expected %d entities after re-run, got %d", entities, len(server.Entities))
+	}
+}
+
+// cancellingWikibase cancels the run after a number of items have been created, as if the user
+// had hit Ctrl-C part way through an upload
+type cancellingWikibase struct {
+	*DryRunWikibase
+	cancelAfter int
+	created     int
+	cancel      context.CancelFunc
+}
+
+func (c *cancellingWikibase) CreateItemInstance(label string, item interface{}) error {
+	err := c.DryRunWikibase.CreateItemInstance(label, item)
+	c.created += 1
+	if c.created == c.cancelAfter {
+		c.cancel()
+	}
+	return err
+}
+
+func TestInterruptedUploadResumes(t *testing.T) {
+
+	processor, cleanup := newTestProcessor(t)
+	defer cleanup()
+
+	dictionaries, err := LoadDictionariesFromDirectory(path.Join("testdata", "dictionaries"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wiki := &cancellingWikibase{DryRunWikibase: NewDryRunWikibase(), cancelAfter: 4, cancel: cancel}
+	client := NewScienceSourceClientWithWikibase(wiki)
+	err = client.GetConfigurationFromServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = processor.ProcessPaper(ctx, dictionaries, client)
+	if err == nil {
+		t.Fatalf("Expected interrupted upload to return an error")
+	}
+
+	// Every item created before we stopped must have been saved
+	article, err := LoadScienceSourceArticle(processor.targetScienceSourceStateFileName())
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := 0
+	if len(article.ID) != 0 {
+		saved += 1
+	}
+	for _, anchor := range article.Annotations {
+		if len(anchor.ID) != 0 {
+			saved += 1
+		}
+		if len(anchor.Annotation.ID) != 0 {
+			saved += 1
+		}
+	}
+	if saved != wiki.created {
+		t.Errorf("Created %d items but only saved %d", wiki.created, saved)
+	}
+	if article.ClaimsUploaded {
+		t.Errorf("Expected interrupted article not to be marked as complete")
+	}
+
+	// Resuming should only create the items we didn't get to
+	wiki.cancelAfter = 0
+	err = processor.ProcessPaper(context.Background(), dictionaries, client)
+	if err != nil {
+		t.Fatalf("Failed to resume paper: %v", err)
+	}
+	expected := 1 + 2*len(article.Annotations)
+	if wiki.created != expected {
+		t.Errorf("Expected %d items created in total, got %d", expected, wiki.created)
+	}
+}
+
+func TestMergedAnnotationsUploaded(t *testing.T) {
+
+	processor, cleanup := newTestProcessor(t)
+	defer cleanup()
+	processor.Annotation = AnnotationOptions{Overlaps: OverlapMerge}
+
+	dictionaries, err := LoadDictionariesFromDirectory(path.Join("testdata", "dictionaries"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A second dictionary with the same terms should give every anchor point two annotations
+	duplicate := dictionaries[0]
+	duplicate.Identifier = "duplicate"
+	dictionaries = append(dictionaries, duplicate)
+
+	client := NewScienceSourceClientWithWikibase(NewDryRunWikibase())
+	err = client.GetConfigurationFromServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = processor.ProcessPaper(context.Background(), dictionaries, client)
+	if err != nil {
+		t.Fatalf("Failed to process paper: %v", err)
+	}
+
+	article, err := LoadScienceSourceArticle(processor.targetScienceSourceStateFileName())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(article.Annotations) != 5 {
+		t.Fatalf("Expected 5 anchor points, got %d", len(article.Annotations))
+	}
+	for i, anchor := range article.Annotations {
+		if len(anchor.AdditionalAnnotations) != 1 {
+			t.Fatalf("Expected anchor point %d to have one additional annotation, got %d", i, len(anchor.AdditionalAnnotations))
+		}
+		additional := anchor.AdditionalAnnotations[0]
+		if additional.DictionaryName == anchor.Annotation.DictionaryName {
+			t.Errorf("Expected anchor point %d annotations to come from different dictionaries", i)
+		}
+		if len(additional.ID) == 0 || additional.BasedOn != anchor.ID {
+			t.Errorf("Expected additional annotation on %d to be created and based on its anchor point", i)
+		}
+	}
+
+	if problems := processor.Verify(); len(problems) != 0 {
+		t.Errorf("Verify found problems: %v", problems)
+	}
+}
+
+func TestProcessPaperDryRun(t *testing.T) {
+
+	processor, cleanup := newTestProcessor(t)
+	defer cleanup()
+	processor.DryRun = true
+
+	dictionaries, err := LoadDictionariesFromDirectory(path.Join("testdata", "dictionaries"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wiki := NewDryRunWikibase()
+	client := NewScienceSourceClientWithWikibase(wiki)
+	err = client.GetConfigurationFromServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = processor.ProcessPaper(context.Background(), dictionaries, client)
+	if err != nil {
+		t.Fatalf("Failed to process paper: %v", err)
+	}
+
+	// The made up IDs must not be saved
+	article, err := LoadScienceSourceArticle(processor.targetScienceSourceStateFileName())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if article.PageID != 0 || len(article.ID) != 0 || article.ClaimsUploaded {
+		t.Errorf("Expected no upload progress to be saved on a dry run")
+	}
+
+	reportPath := path.Join(processor.TargetDirectory, "dry-run-report.json")
+	err = wiki.SaveReport(reportPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(reportPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report DryRunReport
+	err = json.Unmarshal(data, &report)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The article, and an anchor point and annotation for each term found
+	instances := 1 + 2*len(article.Annotations)
+	if len(report.Pages) != 1 {
+		t.Fatalf("Expected 1 page, got %d", len(report.Pages))
+	}
+	if page := report.Pages[0]; !strings.Contains(page.Title, processor.Paper.ID()) || !page.Protected || page.Length == 0 {
+		t.Errorf("Unexpected page %+v", page)
+	}
+	if len(report.Instances) != instances {
+		t.Errorf("Expected %d item instances, got %d", instances, len(report.Instances))
+	}
+	for _, instance := range report.Instances {
+		if len(instance.Claims) == 0 {
+			t.Errorf("Expected claims for %s %s", instance.Kind, instance.ID)
+		}
+	}
+	if len(report.Items) == 0 || len(report.Properties) == 0 {
+		t.Errorf("Expected the configuration to be in the report")
+	}
+
+	calls := make(map[string]int)
+	for _, call := range report.Calls {
+		calls[call.Method] += 1
+	}
+	expected := map[string]int{
+		"CreateOrUpdateArticle": 1,
+		"ProtectPageByID":       1,
+		"CreateItemInstance":    instances,
+		"UploadClaimsForItem":   instances,
+	}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("Expected calls %v, got %v", expected, calls)
+	}
+
+	summary := wiki.Summary()
+	if !strings.HasPrefix(summary, fmt.Sprintf("1 pages and %d item instances would be created and 0 existing item instances updated, referencing", instances)) {
+		t.Errorf("Unexpected summary %q", summary)
+	}
+}
+
+func TestDryRunOfInterruptedUpload(t *testing.T) {
+
+	processor, cleanup := newTestProcessor(t)
+	defer cleanup()
+
+	dictionaries, err := LoadDictionariesFromDirectory(path.Join("testdata", "dictionaries"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Get part way through a real upload, with IDs that can't be mistaken for made up ones
+	ctx, cancel := context.WithCancel(context.Background())
+	interrupted := &cancellingWikibase{DryRunWikibase: NewDryRunWikibase(), cancelAfter: 4, cancel: cancel}
+	interrupted.nextItemID = 1000
+	client := NewScienceSourceClientWithWikibase(interrupted)
+	err = client.GetConfigurationFromServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = processor.ProcessPaper(ctx, dictionaries, client)
+	if err == nil {
+		t.Fatalf("Expected interrupted upload to return an error")
+	}
+
+	// A dry run of the rest should only count the items we didn't get to as being created, and the
+	// page is already there
+	processor.DryRun = true
+	wiki := NewDryRunWikibase()
+	client = NewScienceSourceClientWithWikibase(wiki)
+	err = client.GetConfigurationFromServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = processor.ProcessPaper(context.Background(), dictionaries, client)
+	if err != nil {
+		t.Fatalf("Failed to process paper: %v", err)
+	}
+
+	article, err := LoadScienceSourceArticle(processor.targetScienceSourceStateFileName())
+	if err != nil {
+		t.Fatal(err)
+	}
+	existing := make(map[wikibase.ItemPropertyType]bool)
+	existing[article.ID] = true
+	for _, anchor := range article.Annotations {
+		existing[anchor.ID] = true
+		existing[anchor.Annotation.ID] = true
+	}
+	delete(existing, "")
+	if len(existing) != interrupted.created {
+		t.Fatalf("Expected %d items to have been saved, got %d", interrupted.created, len(existing))
+	}
+
+	instances := 1 + 2*len(article.Annotations)
+	if len(wiki.report.Instances) != instances-len(existing) {
+		t.Errorf("Expected %d item instances to be created, got %d", instances-len(existing), len(wiki.report.Instances))
+	}
+	if len(wiki.report.Existing) != len(existing) {
+		t.Errorf("Expected %d existing item instances, got %d", len(existing), len(wiki.report.Existing))
+	}
+	for _, instance := range wiki.report.Existing {
+		if !existing[instance.ID] {
+			t.Errorf("Unexpected existing item instance %s", instance.ID)
+		}
+	}
+
+	summary := wiki.Summary()
+	expected := fmt.Sprintf("0 pages and %d item instances would be created and %d existing item instances updated, referencing",
+		instances-len(existing), len(existing))
+	if !strings.HasPrefix(summary, expected) {
+		t.Errorf("Unexpected summary %q", summary)
+	}
+}
+
+func TestUploadTermAtStartOfSentence(t *testing.T) {
+
+	server := newFakeWikibaseServer()
+	defer server.Close()
+
+	processor, cleanup := newTestProcessor(t)
+	defer cleanup()
+
+	client := newTestScienceSourceClient(t, server, processor.TargetDirectory)
+
+	// Start a sentence with the only term we look for
+	data, err := ioutil.ReadFile(processor.targetXMLFileName())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = bytes.Replace(data, []byte("We treated cholera with"), []byte("Few were ill. Cholera was treated with"), 1)
+	err = ioutil.WriteFile(processor.targetXMLFileName(), data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dictionary := Dictionary{Identifier: "capitalised", Entries: []DictionaryEntry{
+		{Name: "cholera", Term: "Cholera", Identifiers: DictionaryEntryIdentifiers{WikiData: "Q12090"}},
+	}}
+	err = dictionary.prepareMatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = processor.ProcessPaper(context.Background(), []Dictionary{dictionary}, client)
+	if err != nil {
+		t.Fatalf("Failed to process paper: %v", err)
+	}
+
+	article, err := LoadScienceSourceArticle(processor.targetScienceSourceStateFileName())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(article.Annotations) != 1 {
+		t.Fatalf("Expected 1 annotation, got %d", len(article.Annotations))
+	}
+	anchor := article.Annotations[0]
+	if anchor.PrecedingPhrase != nil {
+		t.Errorf("Expected no preceding phrase, got %q", *anchor.PrecedingPhrase)
+	}
+	if values := server.claimValues(string(anchor.ID), "preceding phrase"); len(values) != 0 {
+		t.Errorf("Expected no preceding phrase claim, got %v", values)
+	}
+	if values := server.claimValues(string(anchor.ID), "following phrase"); len(values) != 1 || !strings.HasPrefix(values[0], " was treated with") {
+		t.Errorf("Unexpected following phrase claims %v", values)
+	}
+}
@@ -0,0 +1,791 @@
+//   Copyright 2018 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+// This is a port of jats-parsoid.xsl, jats-text.xsl, and jats-common.xsl to Go. It follows the
+// stylesheets template by template, so if you change one please change the other to match
+// until we retire the XSLT path.
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const xlinkNamespace string = "http://www.w3.org/1999/xlink"
+
+// The source document. We don't use encoding/xml's struct mapping here as JATS is mixed content
+// all the way down, and we need to see every node in document order.
+
+type jatsNode struct {
+	Name     string // empty for text nodes
+	Attr     []xml.Attr
+	Text     string
+	Parent   *jatsNode
+	Children []*jatsNode
+}
+
+func loadJATSDocument(filename string) (*jatsNode, error) {
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return parseJATSDocument(f)
+}
+
+func parseJATSDocument(r io.Reader) (*jatsNode, error) {
+
+	decoder := xml.NewDecoder(r)
+	decoder.Entity = xml.HTMLEntity
+
+	root := &jatsNode{}
+	current := root
+
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			name := t.Name.Local
+			if len(t.Name.Space) > 0 {
+				name = t.Name.Space + ":" + t.Name.Local
+			}
+			node := &jatsNode{
+				Name:   name,
+				Attr:   t.Attr,
+				Parent: current,
+			}
+			current.Children = append(current.Children, node)
+			current = node
+		case xml.EndElement:
+			current = current.Parent
+		case xml.CharData:
+			// Equivalent of <xsl:strip-space elements="*"/>
+			if len(strings.TrimSpace(string(t))) == 0 {
+				continue
+			}
+			current.Children = append(current.Children, &jatsNode{
+				Text:   string(t),
+				Parent: current,
+			})
+		}
+	}
+
+	return root, nil
+}
+
+func (n *jatsNode) isText() bool {
+	return len(n.Name) == 0 && n.Parent != nil
+}
+
+func (n *jatsNode) is(names ...string) bool {
+	for _, name := range names {
+		if n.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *jatsNode) parentIs(names ...string) bool {
+	return n.Parent != nil && n.Parent.is(names...)
+}
+
+func (n *jatsNode) attr(name string) (string, bool) {
+	space := ""
+	if strings.HasPrefix(name, "xlink:") {
+		space = xlinkNamespace
+		name = strings.TrimPrefix(name, "xlink:")
+	}
+	for _, a := range n.Attr {
+		if a.Name.Local != name {
+			continue
+		}
+		if len(space) > 0 && a.Name.Space != space && a.Name.Space != "xlink" {
+			continue
+		}
+		return a.Value, true
+	}
+	return "", false
+}
+
+func (n *jatsNode) attrValue(name string) string {
+	value, _ := n.attr(name)
+	return value
+}
+
+func (n *jatsNode) childElements(names ...string) []*jatsNode {
+	res := make([]*jatsNode, 0)
+	for _, child := range n.Children {
+		if !child.isText() && child.is(names...) {
+			res = append(res, child)
+		}
+	}
+	return res
+}
+
+func (n *jatsNode) elements() []*jatsNode {
+	res := make([]*jatsNode, 0)
+	for _, child := range n.Children {
+		if !child.isText() {
+			res = append(res, child)
+		}
+	}
+	return res
+}
+
+func (n *jatsNode) firstChild(name string) *jatsNode {
+	for _, child := range n.Children {
+		if child.is(name) {
+			return child
+		}
+	}
+	return nil
+}
+
+// stringValue is the XPath string() of a node, i.e. all the descendant text concatenated.
+func (n *jatsNode) stringValue() string {
+	if n.isText() {
+		return n.Text
+	}
+	var b strings.Builder
+	for _, child := range n.Children {
+		b.WriteString(child.stringValue())
+	}
+	return b.String()
+}
+
+// The result document, which is then either written out as HTML or has all its text
+// concatenated, which is what xsltproc does for method="html" and method="text" respectively.
+
+type resultAttr struct {
+	Name  string
+	Value string
+}
+
+type resultNode struct {
+	Tag      string // empty for text nodes
+	Attr     []resultAttr
+	Text     string
+	Children []*resultNode
+
+	// The text node in the paper XML that this text was copied from, if any, which lets us
+	// line up the text and HTML outputs
+	Source *jatsNode
+	// The node in the paper XML whose template made this text, which tells us what part of
+	// the paper it is from
+	Origin *jatsNode
+}
+
+func (r *resultNode) element(tag string, attrs ...resultAttr) *resultNode {
+	child := &resultNode{Tag: tag, Attr: attrs}
+	r.Children = append(r.Children, child)
+	return child
+}
+
+func (r *resultNode) text(text string) {
+	if len(text) == 0 {
+		return
+	}
+	r.Children = append(r.Children, &resultNode{Text: text})
+}
+
+// sourceText copies a text node from the paper XML
+func (r *resultNode) sourceText(n *jatsNode) {
+	if len(n.Text) == 0 {
+		return
+	}
+	r.Children = append(r.Children, &resultNode{Text: n.Text, Source: n})
+}
+
+// setOrigin records n as the origin of any text under r that doesn't already have one
+func (r *resultNode) setOrigin(n *jatsNode) {
+	if len(r.Tag) == 0 && r.Origin == nil {
+		r.Origin = n
+	}
+	for _, child := range r.Children {
+		child.setOrigin(n)
+	}
+}
+
+func (r *resultNode) textContent() string {
+	var b strings.Builder
+	b.WriteString(r.Text)
+	for _, child := range r.Children {
+		b.WriteString(child.textContent())
+	}
+	return b.String()
+}
+
+// The transform itself
+
+type jatsTransformer struct {
+	document *jatsNode
+	textOnly bool
+
+	// Position of each ref within its ref-list, which is what <xsl:number count="ref" from="ref-list"
+	// level="any"/> gives us
+	referenceNumbers map[string]int
+}
+
+func newJATSTransformer(document *jatsNode, textOnly bool) *jatsTransformer {
+
+	t := &jatsTransformer{
+		document:         document,
+		textOnly:         textOnly,
+		referenceNumbers: make(map[string]int),
+	}
+
+	for _, article := range document.childElements("article") {
+		for _, back := range article.childElements("back") {
+			for _, refList := range back.childElements("ref-list") {
+				for idx, ref := range refList.childElements("ref") {
+					id := ref.attrValue("id")
+					if _, prs := t.referenceNumbers[id]; !prs {
+						t.referenceNumbers[id] = idx + 1
+					}
+				}
+			}
+		}
+	}
+
+	return t
+}
+
+func (t *jatsTransformer) transform() *resultNode {
+
+	root := &resultNode{}
+
+	if t.textOnly {
+		t.applyTemplates(root, t.document.Children)
+	} else {
+		page := root.element("html")
+		head := page.element("head")
+		head.element("meta", resultAttr{"http-equiv", "Content-Type"}, resultAttr{"content", "text/html; charset=UTF-8"})
+		head.element("title").text("Converted JATS paper:")
+		t.applyTemplates(page.element("body"), t.document.Children)
+	}
+
+	return root
+}
+
+func (t *jatsTransformer) applyTemplates(out *resultNode, nodes []*jatsNode) {
+	for _, node := range nodes {
+		t.applyTemplate(out, node)
+	}
+}
+
+func (t *jatsTransformer) applyTemplate(out *resultNode, n *jatsNode) {
+
+	// Templates can add to the end of out or to elements they've added to the end of out, and
+	// anything not claimed by a template for a child node is ours. The article title template
+	// moves nodes into its h1, but only ones its children have already claimed.
+	before := len(out.Children)
+	t.applyMatchingTemplate(out, n)
+	for _, child := range out.Children[before:] {
+		child.setOrigin(n)
+	}
+}
+
+func (t *jatsTransformer) applyMatchingTemplate(out *resultNode, n *jatsNode) {
+
+	if n.isText() {
+		out.sourceText(n)
+		return
+	}
+
+	// Templates that have a priority of 0.5 due to their match patterns
+	switch {
+	case n.is("article-title") && n.parentIs("title-group"):
+		contents := &resultNode{}
+		t.applyTemplates(contents, n.Children)
+		h1 := out.element("h1", resultAttr{"id", strings.Replace(contents.textContent(), " ", "_", -1)})
+		h1.Children = contents.Children
+		return
+	case n.is("contrib-group") && n.parentIs("article-meta"):
+		t.contribGroup(out, n)
+		return
+	case n.is("xref") && n.attrValue("ref-type") == "bibr":
+		t.bibliographyReference(out, n)
+		return
+	case n.is("label") && n.parentIs("aff", "corresp", "chem-struct", "element-citation", "mixed-citation", "citation"):
+		out.element("span", resultAttr{"class", "generated"}).text("[")
+		t.applyTemplates(out, n.Children)
+		out.element("span", resultAttr{"class", "generated"}).text("] ")
+		return
+	case n.parentIs("string-name"):
+		t.applyTemplates(out, n.Children)
+		return
+	case n.is("tbody") && n.parentIs("array"):
+		attrs := make([]resultAttr, 0)
+		for _, a := range n.Attr {
+			if a.Name.Local != "content-type" {
+				attrs = append(attrs, resultAttr{a.Name.Local, a.Value})
+			}
+		}
+		t.applyTemplates(out.element("table").element("tbody", attrs...), n.Children)
+		return
+	}
+
+	switch n.Name {
+	case "article":
+		t.article(out, n)
+	case "front":
+		t.front(out, n)
+	case "back":
+		if !t.textOnly {
+			t.applyTemplates(out, n.childElements("ack", "ref-list"))
+		}
+	case "journal-title":
+		if n.parentIs("article-meta") {
+			return
+		}
+		p := out.element("p")
+		p.text("Title: ")
+		p.text(n.stringValue())
+	case "journal-title-group":
+		if n.parentIs("article-meta") {
+			return
+		}
+		t.applyTemplates(out, n.Children)
+	case "alt-title":
+		p := out.element("p")
+		p.text("Alternative Title: ")
+		t.applyTemplates(p, n.Children)
+	case "title-group", "string-name":
+		t.applyTemplates(out, n.Children)
+	case "role":
+		out.text(" (")
+		out.text(n.stringValue())
+		out.text(")")
+	case "aff":
+		t.affiliation(out, n)
+	case "pub-date":
+		t.publicationDate(out, n)
+	case "abstract":
+		t.abstract(out, n)
+	case "ext-link":
+		a := out.element("a", resultAttr{"rel", "mw:ExtLink"}, resultAttr{"href", n.attrValue("xlink:href")})
+		t.applyTemplates(a, n.Children)
+	case "ack":
+		section := out.element("section")
+		section.element("h2", resultAttr{"id", "Acknowledgements"}).text("Acknowledgements")
+		t.applyTemplates(section, n.Children)
+	case "ref-list":
+		t.referenceList(out, n)
+	case "bold":
+		t.applyTemplates(out.element("b"), n.Children)
+	case "italic":
+		t.applyTemplates(out.element("i"), n.Children)
+	case "monospace":
+		t.applyTemplates(out.element("tt"), n.Children)
+	case "sec":
+		section := out.element("section")
+		t.applyTemplates(section, n.childElements("title"))
+		for _, child := range n.Children {
+			if !child.is("title", "sec-meta") {
+				t.applyTemplate(section, child)
+			}
+		}
+	case "p", "license-p":
+		t.applyTemplates(out.element("p"), n.Children)
+	case "name":
+		t.name(out, n)
+	case "title":
+		t.heading(out, n, "h3")
+	case "subtitle":
+		t.heading(out, n, "h5")
+	case "table", "thead", "tbody", "tfoot", "tr", "th", "td":
+		attrs := make([]resultAttr, 0)
+		for _, a := range n.Attr {
+			if a.Name.Local == "rowspan" || a.Name.Local == "colspan" {
+				attrs = append(attrs, resultAttr{a.Name.Local, a.Value})
+			}
+		}
+		t.applyTemplates(out.element(n.Name, attrs...), n.Children)
+	default:
+		// journal-meta/* and article-meta/* are matched with an explicit priority of 0, and so
+		// only win over the built in rule, not over any of the named templates above
+		if n.parentIs("journal-meta", "article-meta") {
+			return
+		}
+		t.applyTemplates(out, n.Children)
+	}
+}
+
+func (t *jatsTransformer) article(out *resultNode, n *jatsNode) {
+
+	if t.textOnly {
+		t.applyTemplates(out, n.Children)
+		return
+	}
+
+	t.applyTemplates(out, n.childElements("front"))
+	for _, body := range n.childElements("body") {
+		out.element("h2", resultAttr{"id", "Paper"}).text("Paper")
+		t.applyTemplates(out, body.Children)
+	}
+	t.applyTemplates(out, n.childElements("back"))
+}
+
+func (t *jatsTransformer) front(out *resultNode, n *jatsNode) {
+
+	if t.textOnly {
+		t.applyTemplates(out, n.Children)
+		return
+	}
+
+	journal := out.element("section")
+	journal.element("h2", resultAttr{"id", "Journal_Information"}).text("Journal Information")
+	for _, meta := range n.childElements("journal-meta") {
+		t.applyTemplates(journal, meta.Children)
+	}
+
+	article := out.element("section")
+	for _, meta := range n.childElements("article-meta") {
+		t.applyTemplates(article, meta.Children)
+	}
+}
+
+func (t *jatsTransformer) contribGroup(out *resultNode, n *jatsNode) {
+
+	ul := out.element("ul")
+	for _, contrib := range n.childElements("contrib") {
+
+		// contrib-identify
+		li := ul.element("li")
+		for _, child := range contrib.Children {
+			if child.is("anonymous", "collab", "name") {
+				t.applyTemplate(li, child)
+			} else if child.is("collab-alternatives", "name-alternatives") {
+				t.applyTemplates(li, child.elements())
+			}
+		}
+		t.applyTemplates(li, contrib.childElements("role"))
+
+		// contrib-info, which uses a mode with no templates, so we just get the text
+		for _, aff := range contrib.childElements("aff") {
+			ul.text(aff.stringValue())
+		}
+	}
+}
+
+func (t *jatsTransformer) affiliation(out *resultNode, n *jatsNode) {
+
+	p := out.element("p")
+	addrLine := n.firstChild("addr-line")
+	if addrLine != nil {
+		if label := n.firstChild("label"); label != nil {
+			p.text(" [")
+			p.text(label.stringValue())
+			p.text("]")
+		}
+		p.text(addrLine.stringValue())
+	} else {
+		p.text(n.stringValue())
+	}
+}
+
+func (t *jatsTransformer) publicationDate(out *resultNode, n *jatsNode) {
+
+	p := out.element("p")
+	p.text("Publication date")
+	if pubType, prs := n.attr("pub-type"); prs {
+		p.text(" (")
+		p.text(pubType)
+		p.text(")")
+	}
+	p.text(": ")
+	if month := n.firstChild("month"); month != nil {
+		p.text(month.stringValue())
+	}
+	p.text("/")
+	if year := n.firstChild("year"); year != nil {
+		p.text(year.stringValue())
+	}
+}
+
+func (t *jatsTransformer) abstract(out *resultNode, n *jatsNode) {
+
+	section := out.element("section")
+	if abstractType, prs := n.attr("abstract-type"); prs {
+		caps := abstractType
+		if len(caps) > 0 && caps[0] >= 'a' && caps[0] <= 'z' {
+			caps = strings.ToUpper(caps[:1]) + caps[1:]
+		}
+		section.element("h2", resultAttr{"id", caps}).text(caps)
+	} else {
+		section.element("h2", resultAttr{"id", "Abstract"}).text("Abstract")
+	}
+	t.applyTemplates(section, n.Children)
+}
+
+func (t *jatsTransformer) heading(out *resultNode, n *jatsNode, tag string) {
+
+	value := n.stringValue()
+	if len(strings.TrimSpace(value)) == 0 {
+		return
+	}
+	h := out.element(tag, resultAttr{"id", strings.Replace(value, " ", "_", -1)})
+	t.applyTemplates(h, n.Children)
+}
+
+func (t *jatsTransformer) name(out *resultNode, n *jatsNode) {
+
+	eastern := n.attrValue("name-style") == "eastern"
+	hasSurname := n.firstChild("surname") != nil
+	hasGivenNames := n.firstChild("given-names") != nil
+	hasSuffix := n.firstChild("suffix") != nil
+
+	for _, prefix := range n.childElements("prefix") {
+		t.applyTemplates(out, prefix.Children)
+		if hasSurname || hasGivenNames || hasSuffix {
+			out.text(" ")
+		}
+	}
+
+	surnames := func() {
+		for _, surname := range n.childElements("surname") {
+			t.applyTemplates(out, surname.Children)
+			if (hasGivenNames && eastern) || hasSuffix {
+				out.text(" ")
+			}
+		}
+	}
+
+	if eastern {
+		surnames()
+	}
+	for _, givenNames := range n.childElements("given-names") {
+		t.applyTemplates(out, givenNames.Children)
+		if (hasSurname && !eastern) || hasSuffix {
+			out.text(" ")
+		}
+	}
+	if !eastern {
+		surnames()
+	}
+	for _, suffix := range n.childElements("suffix") {
+		t.applyTemplates(out, suffix.Children)
+	}
+}
+
+func (t *jatsTransformer) bibliographyReference(out *resultNode, n *jatsNode) {
+
+	rid := n.attrValue("rid")
+
+	sup := out.element("sup",
+		resultAttr{"class", "mw-ref"},
+		resultAttr{"rel", "dc:references"},
+		resultAttr{"typeof", "mw:Extension/ref"},
+		resultAttr{"id", "cite_ref-" + rid},
+		resultAttr{"data-mw", fmt.Sprintf(`{"name":"ref","attrs":{"name":%s},"body":{"id":%s}}`, jsonString(rid), jsonString("mw-reference-text-cite_note-"+rid))},
+	)
+	span := sup.element("a", resultAttr{"href", "#cite_note-" + rid}).element("span", resultAttr{"class", "mw-reflink-text"})
+	span.text("[")
+	if number, prs := t.referenceNumbers[rid]; prs {
+		span.text(fmt.Sprintf("%d", number))
+	}
+	span.text("]")
+}
+
+const citationStyles string = `
+                    .mw-parser-output cite.citation{font-style:inherit}.mw-parser-output q{quotes:"\"""\"""'""'"}.mw-parser-output code.cs1-code{color:inherit;background:inherit;border:inherit;padding:inherit}.mw-parser-output .cs1-lock-free a{background:url("//upload.wikimedia.org/wikipedia/commons/thumb/6/65/Lock-green.svg/9px-Lock-green.svg.png")no-repeat;background-position:right .1em center}.mw-parser-output .cs1-lock-limited a,.mw-parser-output .cs1-lock-registration a{background:url("//upload.wikimedia.org/wikipedia/commons/thumb/d/d6/Lock-gray-alt-2.svg/9px-Lock-gray-alt-2.svg.png")no-repeat;background-position:right .1em center}.mw-parser-output .cs1-lock-subscription a{background:url("//upload.wikimedia.org/wikipedia/commons/thumb/a/aa/Lock-red-alt-2.svg/9px-Lock-red-alt-2.svg.png")no-repeat;background-position:right .1em center}.mw-parser-output .cs1-subscription,.mw-parser-output .cs1-registration{color:#555}.mw-parser-output .cs1-subscription span,.mw-parser-output .cs1-registration span{border-bottom:1px dotted;cursor:help}.mw-parser-output .cs1-hidden-error{display:none;font-size:100%}.mw-parser-output .cs1-visible-error{font-size:100%}.mw-parser-output .cs1-subscription,.mw-parser-output .cs1-registration,.mw-parser-output .cs1-format{font-size:95%}.mw-parser-output .cs1-kern-left,.mw-parser-output .cs1-kern-wl-left{padding-left:0.2em}.mw-parser-output .cs1-kern-right,.mw-parser-output .cs1-kern-wl-right{padding-right:0.2em}
+                `
+
+func (t *jatsTransformer) referenceList(out *resultNode, n *jatsNode) {
+
+	section := out.element("section")
+	section.element("h2", resultAttr{"id", "References"}).text("References")
+	div := section.element("div",
+		resultAttr{"class", "mw-references-wrap"},
+		resultAttr{"typeof", "mw:Extension/references"},
+		resultAttr{"data-mw", `{"name":"references","attrs":{}}`},
+	)
+	ol := div.element("ol", resultAttr{"class", "mw-references references"})
+
+	for _, ref := range n.childElements("ref") {
+		id := ref.attrValue("id")
+		citations := ref.childElements("element-citation", "mixed-citation")
+
+		li := ol.element("li", resultAttr{"id", "cite_note-" + id})
+		li.element("a", resultAttr{"rel", "mw:referenceBy"}, resultAttr{"href", "#cite_ref-" + id}).
+			element("span", resultAttr{"class", "mw-linkback-text"}).text("↑ ")
+
+		span := li.element("span", resultAttr{"class", "mw-reference-text"}, resultAttr{"id", "mw-reference-text-cite_note-" + id})
+
+		var dataMW strings.Builder
+		for _, citation := range citations {
+			dataMW.WriteString(citationDataMW(citation))
+		}
+		cite := span.element("cite",
+			resultAttr{"class", "citation XXXXX"},
+			resultAttr{"typeof", "mw:Transclusion"},
+			resultAttr{"data-mw", dataMW.String()},
+		)
+		t.applyTemplates(cite, citations)
+
+		span.element("span")
+		span.element("style",
+			resultAttr{"typeof", "mw:Extension/templatestyles"},
+			resultAttr{"data-mw", `{"name":"templatestyles","attrs":{"src":"Module:Citation/CS1/styles.css"},"body":{"extsrc":""}}`},
+		).text(citationStyles)
+		span.element("span")
+	}
+}
+
+// citationDataMW generates the embedded mediawiki template data for a citation
+func citationDataMW(citation *jatsNode) string {
+
+	var template string
+	switch citation.attrValue("publication-type") {
+	case "other":
+		template = `"cite report","href":"./Template:Cite_report"`
+	case "journal":
+		template = `"cite journal","href":"./Template:Cite_journal"`
+	case "book":
+		template = `"cite book","href":"./Template:Cite_book"`
+	default:
+		// No template matches, so the built in rule gives us the immediate text children, as all
+		// the child elements match a template that outputs nothing
+		var b strings.Builder
+		for _, child := range citation.Children {
+			if child.isText() {
+				b.WriteString(child.Text)
+			}
+		}
+		return b.String()
+	}
+
+	// The stylesheet has templates for the title, date, and so on, but the catch all template for
+	// the other children has the same priority and comes last, so xsltproc uses it for all of
+	// them and no params are ever output
+	var b strings.Builder
+	b.WriteString(`{"parts":[{"template":{"target":{"wt":` + template + `},"params":{`)
+	b.WriteString(`"noop":{"wt":"noop"}`)
+	b.WriteString(`},"i":0}}]}`)
+
+	return b.String()
+}
+
+// jsonString quotes a value for use in data-mw JSON. The XSL files paste values in as they are,
+// which breaks the JSON for any reference ID with a quote in it. HTML escaping is left to the
+// HTML serialisation of the attribute.
+func jsonString(value string) string {
+	var b bytes.Buffer
+	encoder := json.NewEncoder(&b)
+	encoder.SetEscapeHTML(false)
+	// Encoding a string can't fail
+	encoder.Encode(value)
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// HTML serialisation. We put line breaks after block elements much as xsltproc does, so the
+// output is roughly diffable against the XSLT path.
+
+var htmlTextEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+var htmlAttrEscaper = strings.NewReplacer("&", "&amp;", "\"", "&quot;")
+
+var htmlVoidElements = map[string]bool{
+	"meta": true,
+	"br":   true,
+	"hr":   true,
+	"img":  true,
+}
+
+var htmlBlockElements = map[string]bool{
+	"html": true, "head": true, "body": true, "title": true, "meta": true, "section": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true, "p": true,
+	"ul": true, "ol": true, "li": true, "div": true, "style": true,
+	"table": true, "thead": true, "tbody": true, "tfoot": true, "tr": true,
+}
+
+// breaksAfterOpening tells us if there's a line break after the element's opening tag, which is
+// when it starts with a block element
+func (n *resultNode) breaksAfterOpening() bool {
+	return len(n.Children) > 0 && len(n.Children[0].Tag) > 0 && htmlBlockElements[n.Children[0].Tag]
+}
+
+func writeResultAsHTML(w io.Writer, root *resultNode) error {
+	var b strings.Builder
+	writeResultChildrenAsHTML(&b, root)
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeResultChildrenAsHTML(b *strings.Builder, n *resultNode) {
+	for i, child := range n.Children {
+		if n.Tag == "style" && len(child.Tag) == 0 {
+			// style contents are not escaped
+			b.WriteString(child.Text)
+			continue
+		}
+		var next *resultNode
+		if i+1 < len(n.Children) {
+			next = n.Children[i+1]
+		}
+		writeResultNodeAsHTML(b, child, next)
+	}
+}
+
+// breaksAfterClosing tells us if there's a line break after the element, which like xsltproc we
+// leave out before text so as not to change it
+func (n *resultNode) breaksAfterClosing(next *resultNode) bool {
+	return htmlBlockElements[n.Tag] && (next == nil || len(next.Tag) > 0)
+}
+
+func writeResultNodeAsHTML(b *strings.Builder, n *resultNode, next *resultNode) {
+
+	if len(n.Tag) == 0 {
+		b.WriteString(htmlTextEscaper.Replace(n.Text))
+		return
+	}
+
+	b.WriteString("<" + n.Tag)
+	for _, a := range n.Attr {
+		b.WriteString(fmt.Sprintf(` %s="%s"`, a.Name, htmlAttrEscaper.Replace(a.Value)))
+	}
+	b.WriteString(">")
+
+	if htmlVoidElements[n.Tag] {
+		if next == nil || len(next.Tag) > 0 {
+			b.WriteString("\n")
+		}
+		return
+	}
+
+	if n.breaksAfterOpening() {
+		b.WriteString("\n")
+	}
+	writeResultChildrenAsHTML(b, n)
+
+	b.WriteString("</" + n.Tag + ">")
+	if n.breaksAfterClosing(next) {
+		b.WriteString("\n")
+	}
+}
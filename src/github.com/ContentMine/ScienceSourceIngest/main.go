@@ -15,118 +15,85 @@
 package main
 
 import (
-	"flag"
+	"context"
 	"fmt"
 	"log"
 	"os"
-	"sync"
-
-	"github.com/ContentMine/wikibase"
+	"os/signal"
+	"sort"
+	"syscall"
 )
 
 // These will be set by the build script to something meaningful
 var Remote string
 var Version string
 
-// We could fire off 100 requests at once, but that's not being nice to
-// either the local machine or PMC's API, so we limite the number of
-// concurrent paper requests here
-const concurrencyLimit int = 1
-
-var xsl_file_list = []string{"jats-text.xsl", "jats-parsoid.xsl", "jats-common.xsl"}
-
-func main() {
-
-	var feed_path string
-	var target_path string
-	var dictionaries_path string
-	var url_base string
-	var oauth_tokens_path string
-	var xslt_proc_path string
-	flag.StringVar(&feed_path, "feed", "", "JSON feed of papers, required")
-	flag.StringVar(&target_path, "output", ".", "Directory to store the results, required")
-	flag.StringVar(&dictionaries_path, "dictionaries", "", "Directory of dictionaries to load.")
-	flag.StringVar(&url_base, "urlbase", "http://localhost:8181", "Base URL for science source.")
-	flag.StringVar(&oauth_tokens_path, "oauth", "oauth.json", "JSON file with oauth credentials in.")
-	flag.StringVar(&xslt_proc_path, "xsltproc", "/usr/bin/xsltproc", "Location off xsltproc tool.")
-	flag.Parse()
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [command] [options]\n\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Commands:\n")
 
-	log.Printf("Feed to parse: %s", feed_path)
-
-	feed, err := LoadFeedFromFile(feed_path)
-	if err != nil {
-		panic(err)
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
 	}
-
-	// Check we can find the required XSL files up front, just to ensure better error reporting
-	// to the humans.
-	for _, xsl_file := range(xsl_file_list) {
-        if _, err := os.Stat(xsl_file); os.IsNotExist(err) {
-            panic(fmt.Errorf("XSL file %s does not exist.", xsl_file))
-        }
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, commands[name].Description)
 	}
+	fmt.Fprintf(os.Stderr, "\nIf no command is given then run is assumed. Use [command] -help to see the options for each command.\n")
+}
 
-	// the SPARQL seems to have duplicates in, so let's check
-	library := make(map[string]Paper)
-	for _, paper := range feed.Results.Papers {
-		if _, prs := library[paper.ID()]; prs == true {
-			log.Printf("Found a duplicate paper: %v", paper.ID())
-		} else {
-			library[paper.ID()] = paper
+// shutdownContext is cancelled on the first SIGINT or SIGTERM, which tells the pipeline to stop
+// starting new work and let any wiki calls in flight finish so their results get saved. A
+// second signal gets the default behaviour and kills the program straight away.
+func shutdownContext() (context.Context, context.CancelFunc) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case sig := <-signals:
+			log.Printf("Received %v, stopping once current work is saved. Send again to quit immediately.", sig)
+			signal.Stop(signals)
+			cancel()
+		case <-ctx.Done():
 		}
-	}
-	log.Printf("We have %d papers to process", len(library))
+	}()
 
-	// Load the dictionaries of terms we want to create annotations for
-	dictionaries, err := LoadDictionariesFromDirectory(dictionaries_path)
-	if err != nil {
-		panic(err)
-	}
-	log.Printf("We have loaded %d dictionaries", len(dictionaries))
-	for _, dict := range dictionaries {
-		log.Printf("Dict %s has %d entries", dict.Identifier, len(dict.Entries))
+	return ctx, func() {
+		signal.Stop(signals)
+		cancel()
 	}
+}
 
-	// Connect to Science Source instance and get any information we need
-	oauthInfo, load_err := wikibase.LoadOauthInformation(oauth_tokens_path)
-	if load_err != nil {
-		panic(load_err)
-	}
-	sciSourceClient := NewScienceSourceClient(oauthInfo, url_base)
-	err = sciSourceClient.GetConfigurationFromServer()
-	if err != nil {
-		panic(err)
+func main() {
+
+	// For backwards compatibility if we're not given a command then we do everything
+	name := defaultCommand
+	args := os.Args[1:]
+	if len(args) > 0 && len(args[0]) > 0 && args[0][0] != '-' {
+		name = args[0]
+		args = args[1:]
 	}
 
-	// Here I use a traditional wait group to wait for everyone to be done,
-	// and I use a channel to control the number of concurrent operations allowed.
-	// In theory I can use the channel also to wait at the end, but it's not as
-	// easy to read the code here, so I've chosen to use both mechanisms for
-	// the sake of code clarity
-	var wg sync.WaitGroup
-	sem := make(chan bool, concurrencyLimit)
-	for _, paper := range library {
-		to_process := paper
-		sem <- true
-		wg.Add(1)
+	if name == "help" {
+		usage()
+		return
+	}
 
-		go func() {
-			defer func() {
-				wg.Done()
-				<-sem
-			}()
-			log.Printf("Process paper %s", to_process.ID())
+	cmd, prs := commands[name]
+	if !prs {
+		fmt.Fprintf(os.Stderr, "Unknown command %s\n\n", name)
+		usage()
+		os.Exit(2)
+	}
 
-			var processor = PaperProcessor{
-				Paper:           to_process,
-				TargetDirectory: target_path,
-				XSLTProcPath:    xslt_proc_path,
-			}
-			err := processor.ProcessPaper(dictionaries, sciSourceClient)
-			if err != nil {
-				log.Printf("Failed to process paper %s: %v", to_process.ID(), err)
-			}
-		}()
+	ctx, cancel := shutdownContext()
+	err := cmd.Run(ctx, args)
+	cancel()
+	if err != nil {
+		log.Fatalf("Failed to %s: %v", name, err)
 	}
-	wg.Wait()
 }
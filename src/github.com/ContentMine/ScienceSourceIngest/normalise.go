@@ -0,0 +1,143 @@
+//   Copyright 2018 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// The text we mine and the dictionary terms don't always agree on case, on which of the many
+// Unicode dashes, quotes, and spaces are used, or on how accented characters are encoded. So a
+// dictionary can ask for both its terms and the paper text to be normalised before matching.
+// Normalising changes the length of the text, so we keep a map back to the original offsets,
+// as annotations must refer to positions in the paper text as it is on disk.
+
+type DictionaryMatchOptions struct {
+	FoldCase           bool `json:"fold_case,omitempty"`
+	NormaliseUnicode   bool `json:"normalise_unicode,omitempty"`
+	CollapseWhitespace bool `json:"collapse_whitespace,omitempty"`
+	EquateDashes       bool `json:"equate_dashes,omitempty"`
+	EquateQuotes       bool `json:"equate_quotes,omitempty"`
+
+	// By default terms must match whole words, this lets them match anywhere
+	MatchWithinWords bool `json:"match_within_words,omitempty"`
+}
+
+func (options DictionaryMatchOptions) normalises() bool {
+	return options.FoldCase || options.NormaliseUnicode || options.CollapseWhitespace ||
+		options.EquateDashes || options.EquateQuotes
+}
+
+type normalisedText struct {
+	Text []byte
+
+	// For each byte in Text, the span in the original text that it came from
+	starts []int
+	ends   []int
+}
+
+// originalSpan maps a span in the normalised text back to the original text
+func (n normalisedText) originalSpan(start int, length int) (int, int) {
+	if length == 0 {
+		return n.starts[start], n.starts[start]
+	}
+	return n.starts[start], n.ends[start+length-1]
+}
+
+func normaliseRune(r rune, options DictionaryMatchOptions) rune {
+	if options.EquateDashes && (unicode.Is(unicode.Pd, r) || r == '−') {
+		return '-'
+	}
+	if options.EquateQuotes {
+		switch r {
+		case '‘', '’', '‚', '‛', '′', '`', '´':
+			return '\''
+		case '“', '”', '„', '‟', '″':
+			return '"'
+		}
+	}
+	if options.CollapseWhitespace && unicode.IsSpace(r) {
+		return ' '
+	}
+	return r
+}
+
+func normaliseText(original []byte, options DictionaryMatchOptions) normalisedText {
+
+	res := normalisedText{
+		Text:   make([]byte, 0, len(original)),
+		starts: make([]int, 0, len(original)),
+		ends:   make([]int, 0, len(original)),
+	}
+	caser := cases.Fold()
+	lastWasSpace := false
+
+	for offset := 0; offset < len(original); {
+
+		// Work in whole NFKC segments when normalising, as a base character and any combining
+		// marks after it normalise together
+		length := 0
+		if options.NormaliseUnicode {
+			length = norm.NFKC.NextBoundary(original[offset:], true)
+		}
+		if length <= 0 {
+			_, length = utf8.DecodeRune(original[offset:])
+		}
+		segment := original[offset : offset+length]
+		if options.NormaliseUnicode {
+			segment = norm.NFKC.Bytes(segment)
+		}
+
+		mapped := make([]byte, 0, len(segment))
+		for len(segment) > 0 {
+			r, size := utf8.DecodeRune(segment)
+			if r == utf8.RuneError && size <= 1 {
+				// leave invalid bytes alone rather than turn them into replacement characters
+				mapped = append(mapped, segment[0])
+			} else {
+				r = normaliseRune(r, options)
+				if options.CollapseWhitespace && r == ' ' {
+					if lastWasSpace {
+						segment = segment[size:]
+						continue
+					}
+					lastWasSpace = true
+				} else {
+					lastWasSpace = false
+				}
+				var encoded [utf8.UTFMax]byte
+				mapped = append(mapped, encoded[:utf8.EncodeRune(encoded[:], r)]...)
+			}
+			segment = segment[size:]
+		}
+		if options.FoldCase {
+			mapped = caser.Bytes(mapped)
+		}
+
+		for _, b := range mapped {
+			res.Text = append(res.Text, b)
+			res.starts = append(res.starts, offset)
+			res.ends = append(res.ends, offset+length)
+		}
+
+		offset += length
+	}
+
+	return res
+}
@@ -0,0 +1,226 @@
+//   Copyright 2018 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"unicode/utf8"
+
+	"github.com/hashicorp/errwrap"
+)
+
+// Dictionary matches are found at byte offsets into paper.txt, but the character numbers,
+// lengths, and distances we put on the wiki are read as character positions, so we convert
+// them before they're stored. Which unit a paper's offsets are in is recorded in its state
+// file, with papers annotated before we did this being in bytes.
+
+type OffsetUnit string
+
+const (
+	// Bytes of UTF-8, which is how things were originally
+	OffsetUnitBytes OffsetUnit = "byte"
+	// Unicode code points, which is what MediaWiki and the data schema count as characters
+	OffsetUnitCodePoints OffsetUnit = "codepoint"
+	// UTF-16 code units, which is what JavaScript string offsets count
+	OffsetUnitUTF16 OffsetUnit = "utf16"
+)
+
+const DefaultOffsetUnit OffsetUnit = OffsetUnitCodePoints
+
+func ParseOffsetUnit(name string) (OffsetUnit, error) {
+	switch unit := OffsetUnit(name); unit {
+	case OffsetUnitBytes, OffsetUnitCodePoints, OffsetUnitUTF16:
+		return unit, nil
+	}
+	return "", fmt.Errorf("Unknown offset unit %s, expected %s, %s, or %s", name,
+		OffsetUnitCodePoints, OffsetUnitUTF16, OffsetUnitBytes)
+}
+
+// textOffsets converts between byte offsets into some text and offsets in another unit
+type textOffsets struct {
+	unit OffsetUnit
+	// The offset in units that each byte is part of, with one extra for the end of the text
+	units []int
+	// The byte each unit starts at, or -1 for the second half of a UTF-16 surrogate pair, again
+	// with one extra for the end of the text
+	bytes []int
+}
+
+func newTextOffsets(prose []byte, unit OffsetUnit) textOffsets {
+
+	offsets := textOffsets{
+		unit:  unit,
+		units: make([]int, len(prose)+1),
+		bytes: make([]int, 0, len(prose)+1),
+	}
+
+	count := 0
+	for i := 0; i < len(prose); {
+		// Bytes that aren't valid UTF-8 come back as one byte runes, which is also how they'd
+		// count once replaced with U+FFFD
+		r, size := utf8.DecodeRune(prose[i:])
+		if unit == OffsetUnitBytes {
+			size = 1
+		}
+		for j := 0; j < size; j++ {
+			offsets.units[i+j] = count
+		}
+		offsets.bytes = append(offsets.bytes, i)
+		count += 1
+		if unit == OffsetUnitUTF16 && r > 0xFFFF {
+			offsets.bytes = append(offsets.bytes, -1)
+			count += 1
+		}
+		i += size
+	}
+	offsets.units[len(prose)] = count
+	offsets.bytes = append(offsets.bytes, len(prose))
+
+	return offsets
+}
+
+// toUnits converts a byte offset, which should be at the start of a rune
+func (offsets textOffsets) toUnits(offset int) int {
+	return offsets.units[offset]
+}
+
+// toBytes converts an offset in units to a byte offset, failing if it is outside the text or
+// not at the start of a character
+func (offsets textOffsets) toBytes(offset int) (int, bool) {
+	if offset < 0 || offset >= len(offsets.bytes) || offsets.bytes[offset] < 0 {
+		return 0, false
+	}
+	return offsets.bytes[offset], true
+}
+
+// span converts an offset and length in units to a byte range
+func (offsets textOffsets) span(offset int, length int) (int, int, bool) {
+	start, ok := offsets.toBytes(offset)
+	if !ok {
+		return 0, 0, false
+	}
+	end, ok := offsets.toBytes(offset + length)
+	return start, end, ok
+}
+
+// offsetUnit is the unit the article's offsets are stored in
+func (article *ScienceSourceArticle) offsetUnit() OffsetUnit {
+	if len(article.OffsetUnit) == 0 {
+		return OffsetUnitBytes
+	}
+	return article.OffsetUnit
+}
+
+// convertOffsets changes the article's offsets, lengths, and distances into the given unit,
+// using the paper text they were found in. It returns whether any of them changed.
+func (article *ScienceSourceArticle) convertOffsets(prose []byte, unit OffsetUnit) (bool, error) {
+
+	from := newTextOffsets(prose, article.offsetUnit())
+	to := newTextOffsets(prose, unit)
+	changed := false
+
+	for i := range article.Annotations {
+		anchor := &article.Annotations[i]
+
+		start, end, ok := from.span(anchor.CharacterNumber, anchor.Annotation.LengthOfTermFound)
+		if !ok || string(prose[start:end]) != anchor.Annotation.TermFound {
+			return false, fmt.Errorf("Annotation %d at %d is not %q in the paper text", i, anchor.CharacterNumber, anchor.Annotation.TermFound)
+		}
+		offset := to.toUnits(start)
+		length := to.toUnits(end) - offset
+
+		if offset != anchor.CharacterNumber || length != anchor.Annotation.LengthOfTermFound {
+			changed = true
+		}
+		anchor.CharacterNumber = offset
+		anchor.Annotation.LengthOfTermFound = length
+		for j := range anchor.AdditionalAnnotations {
+			anchor.AdditionalAnnotations[j].LengthOfTermFound = length
+		}
+	}
+
+	for i := range article.Annotations {
+		anchor := &article.Annotations[i]
+		if anchor.DistanceToPreceding != nil && i > 0 {
+			distance := anchor.CharacterNumber - article.Annotations[i-1].CharacterNumber
+			changed = changed || distance != *anchor.DistanceToPreceding
+			anchor.DistanceToPreceding = &distance
+		}
+		if anchor.DistanceToFollowing != nil && i < len(article.Annotations)-1 {
+			distance := article.Annotations[i+1].CharacterNumber - anchor.CharacterNumber
+			changed = changed || distance != *anchor.DistanceToFollowing
+			anchor.DistanceToFollowing = &distance
+		}
+	}
+
+	article.OffsetUnit = unit
+	return changed, nil
+}
+
+// convertRecordOffsets converts a paper's record to the given unit, if it isn't in it already
+func (processor PaperProcessor) convertRecordOffsets(record *ScienceSourceArticle, unit OffsetUnit) (bool, error) {
+
+	if record.offsetUnit() == unit {
+		return false, nil
+	}
+
+	data, err := ioutil.ReadFile(processor.targetTextFileName())
+	if err != nil {
+		return false, errwrap.Wrapf("Error reading text mining file: {{err}}", err)
+	}
+
+	changed, err := record.convertOffsets(data, unit)
+	if err != nil {
+		return false, err
+	}
+
+	// The offsets into the page need to be in the new unit too
+	textMap, err := processor.loadTextHTMLMap(data)
+	if err != nil {
+		return false, errwrap.Wrapf("Error reading text to HTML map: {{err}}", err)
+	}
+	relocated := record.locateInHTML(data, textMap)
+
+	return changed || relocated, nil
+}
+
+// MigrateOffsets converts the offsets in a paper's state file to the given unit. If the paper
+// has been uploaded and any of the offsets change it is marked to be uploaded again, so that the
+// claims on the wiki are updated. It returns whether any offsets changed.
+func (processor PaperProcessor) MigrateOffsets(unit OffsetUnit) (bool, error) {
+
+	record, err := processor.loadRecord()
+	if err != nil {
+		return false, errwrap.Wrapf("Failed to load paper record: {{err}}", err)
+	}
+	if record.offsetUnit() == unit {
+		return false, nil
+	}
+
+	changed, err := processor.convertRecordOffsets(record, unit)
+	if err != nil {
+		return false, errwrap.Wrapf("Failed to convert offsets: {{err}}", err)
+	}
+	if changed {
+		record.ClaimsUploaded = false
+	}
+
+	err = record.Save(processor.targetScienceSourceStateFileName())
+	if err != nil {
+		return false, errwrap.Wrapf("Failed to save paper record: {{err}}", err)
+	}
+	return changed, nil
+}
@@ -0,0 +1,158 @@
+//   Copyright 2018 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// Two byte, three byte, and four byte characters before the terms
+const testOffsetsText = "Café 発見 𝛼-helix: malaria and cholera."
+
+func TestTextOffsets(t *testing.T) {
+
+	prose := []byte(testOffsetsText)
+	malaria := strings.Index(testOffsetsText, "malaria")
+
+	tests := []struct {
+		unit     OffsetUnit
+		expected int
+	}{
+		{OffsetUnitBytes, malaria},
+		{OffsetUnitCodePoints, 17},
+		{OffsetUnitUTF16, 18},
+	}
+
+	for _, test := range tests {
+		offsets := newTextOffsets(prose, test.unit)
+		offset := offsets.toUnits(malaria)
+		if offset != test.expected {
+			t.Errorf("Expected malaria at %d %s, got %d", test.expected, test.unit, offset)
+		}
+		start, end, ok := offsets.span(offset, len("malaria"))
+		if !ok || string(prose[start:end]) != "malaria" {
+			t.Errorf("Expected %s span to be malaria, got %d-%d", test.unit, start, end)
+		}
+		if _, ok := offsets.toBytes(offsets.toUnits(len(prose)) + 1); ok {
+			t.Errorf("Expected %s offset past the end of the text to fail", test.unit)
+		}
+	}
+
+	// The second half of the surrogate pair for 𝛼 isn't a character on its own
+	alpha := newTextOffsets(prose, OffsetUnitUTF16).toUnits(strings.Index(testOffsetsText, "𝛼"))
+	if _, ok := newTextOffsets(prose, OffsetUnitUTF16).toBytes(alpha + 1); ok {
+		t.Errorf("Expected offset inside a surrogate pair to fail")
+	}
+}
+
+func testOffsetsArticle() *ScienceSourceArticle {
+	malaria := strings.Index(testOffsetsText, "malaria")
+	cholera := strings.Index(testOffsetsText, "cholera")
+	following := cholera - malaria
+	preceding := cholera - malaria
+
+	// As annotated before offsets were converted, in bytes
+	return &ScienceSourceArticle{
+		ScienceSourceArticleTitle: "test",
+		Annotations: []ScienceSourceAnchorPoint{
+			{
+				CharacterNumber:     malaria,
+				DistanceToFollowing: &following,
+				Annotation:          ScienceSourceAnnotation{TermFound: "malaria", LengthOfTermFound: 7},
+			},
+			{
+				CharacterNumber:     cholera,
+				DistanceToPreceding: &preceding,
+				Annotation:          ScienceSourceAnnotation{TermFound: "cholera", LengthOfTermFound: 7},
+			},
+		},
+	}
+}
+
+func TestConvertOffsets(t *testing.T) {
+
+	article := testOffsetsArticle()
+	if article.offsetUnit() != OffsetUnitBytes {
+		t.Errorf("Expected article with no unit to be in bytes, got %s", article.offsetUnit())
+	}
+
+	changed, err := article.convertOffsets([]byte(testOffsetsText), OffsetUnitCodePoints)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed || article.OffsetUnit != OffsetUnitCodePoints {
+		t.Errorf("Expected offsets to change to code points")
+	}
+	if article.Annotations[0].CharacterNumber != 17 || article.Annotations[1].CharacterNumber != 29 {
+		t.Errorf("Unexpected offsets %d and %d", article.Annotations[0].CharacterNumber, article.Annotations[1].CharacterNumber)
+	}
+	if *article.Annotations[0].DistanceToFollowing != 12 || *article.Annotations[1].DistanceToPreceding != 12 {
+		t.Errorf("Unexpected distances %d and %d", *article.Annotations[0].DistanceToFollowing, *article.Annotations[1].DistanceToPreceding)
+	}
+
+	// Converting again to the same unit leaves things alone
+	changed, err = article.convertOffsets([]byte(testOffsetsText), OffsetUnitCodePoints)
+	if err != nil || changed {
+		t.Errorf("Expected no change, got %v, %v", changed, err)
+	}
+
+	// Offsets that don't match the text are an error
+	if _, err := testOffsetsArticle().convertOffsets([]byte("Malaria and cholera."), OffsetUnitUTF16); err == nil {
+		t.Errorf("Expected conversion against the wrong text to fail")
+	}
+}
+
+func TestMigrateOffsets(t *testing.T) {
+
+	processor, cleanup := newTestProcessor(t)
+	defer cleanup()
+
+	err := ioutil.WriteFile(processor.targetTextFileName(), []byte(testOffsetsText), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	article := testOffsetsArticle()
+	article.ID = "Q1"
+	article.PageID = 1
+	article.ClaimsUploaded = true
+	err = article.Save(processor.targetScienceSourceStateFileName())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changed, err := processor.MigrateOffsets(OffsetUnitUTF16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed {
+		t.Errorf("Expected offsets to change")
+	}
+
+	migrated, err := LoadScienceSourceArticle(processor.targetScienceSourceStateFileName())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if migrated.OffsetUnit != OffsetUnitUTF16 || migrated.Annotations[0].CharacterNumber != 18 {
+		t.Errorf("Unexpected migrated article %v", migrated)
+	}
+	if migrated.ClaimsUploaded {
+		t.Errorf("Expected paper to need its claims uploading again")
+	}
+	if problems := processor.Verify(); len(problems) != 0 {
+		t.Errorf("Verify found problems: %v", problems)
+	}
+}
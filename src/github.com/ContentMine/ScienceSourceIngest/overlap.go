@@ -0,0 +1,186 @@
+//   Copyright 2018 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Matches from different dictionaries, or different terms in one dictionary, can cover the
+// same text: "fever" is inside "yellow fever", and two dictionaries may share a term. The
+// overlap policy decides which of them become anchor points.
+
+type OverlapPolicy string
+
+const (
+	// Every match gets its own anchor point, which is how things were originally
+	OverlapKeepAll OverlapPolicy = "keep-all"
+	// Matches of exactly the same text share one anchor point, other overlaps are kept
+	OverlapMerge OverlapPolicy = "merge"
+	// Of overlapping matches keep the longest, with ties going to dictionary priority
+	OverlapLongest OverlapPolicy = "longest"
+	// Of overlapping matches keep the one from the highest priority dictionary, with ties
+	// going to the longest
+	OverlapPriority OverlapPolicy = "priority"
+)
+
+const DefaultOverlapPolicy OverlapPolicy = OverlapKeepAll
+
+func ParseOverlapPolicy(name string) (OverlapPolicy, error) {
+	switch policy := OverlapPolicy(name); policy {
+	case OverlapKeepAll, OverlapMerge, OverlapLongest, OverlapPriority:
+		return policy, nil
+	}
+	return "", fmt.Errorf("Unknown overlap policy %s, expected %s, %s, %s, or %s", name,
+		OverlapKeepAll, OverlapMerge, OverlapLongest, OverlapPriority)
+}
+
+// AnnotationOptions are the settings for turning dictionary matches into annotations
+type AnnotationOptions struct {
+	Overlaps OverlapPolicy
+
+	// Dictionary identifiers, highest priority first. Dictionaries not listed come after
+	// these in the order they were loaded.
+	DictionaryPriority []string
+
+	// Most characters of context to give either side of a term, or zero for the default
+	PhraseMaxLength int
+
+	// What to count offsets in, or empty for the default
+	OffsetUnit OffsetUnit
+
+	// Section types, such as "methods" or "table", to ignore matches in
+	ExcludeSections []string
+}
+
+func (options AnnotationOptions) offsetUnit() OffsetUnit {
+	if len(options.OffsetUnit) == 0 {
+		return DefaultOffsetUnit
+	}
+	return options.OffsetUnit
+}
+
+// A MatchGroup is one or more matches that will share an anchor point. All the matches in a
+// group have the same span, and the first is the one we prefer.
+type MatchGroup []DictionaryMatch
+
+func (group MatchGroup) Offset() int { return group[0].Offset }
+func (group MatchGroup) Length() int { return group[0].Length }
+
+func dictionaryRanks(dictionaries []Dictionary, priority []string) map[string]int {
+	ranks := make(map[string]int)
+	for _, identifier := range priority {
+		if _, prs := ranks[identifier]; !prs {
+			ranks[identifier] = len(ranks)
+		}
+	}
+	for _, dictionary := range dictionaries {
+		if _, prs := ranks[dictionary.Identifier]; !prs {
+			ranks[dictionary.Identifier] = len(ranks)
+		}
+	}
+	return ranks
+}
+
+// resolveOverlaps applies the overlap policy, and returns the groups of matches that should
+// become anchor points, sorted by offset.
+func resolveOverlaps(matches []DictionaryMatch, dictionaries []Dictionary, options AnnotationOptions) []MatchGroup {
+
+	if len(options.Overlaps) == 0 {
+		options.Overlaps = DefaultOverlapPolicy
+	}
+
+	ranks := dictionaryRanks(dictionaries, options.DictionaryPriority)
+	rank := func(match DictionaryMatch) int {
+		if match.Dictionary == nil {
+			return len(ranks)
+		}
+		return ranks[match.Dictionary.Identifier]
+	}
+
+	// Put the matches in order of preference
+	candidates := make([]DictionaryMatch, len(matches))
+	copy(candidates, matches)
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		switch options.Overlaps {
+		case OverlapLongest:
+			if a.Length != b.Length {
+				return a.Length > b.Length
+			}
+			if rank(a) != rank(b) {
+				return rank(a) < rank(b)
+			}
+		case OverlapPriority:
+			if rank(a) != rank(b) {
+				return rank(a) < rank(b)
+			}
+			if a.Length != b.Length {
+				return a.Length > b.Length
+			}
+		default:
+			if rank(a) != rank(b) {
+				return rank(a) < rank(b)
+			}
+		}
+		return a.Offset < b.Offset
+	})
+
+	groups := make([]MatchGroup, 0, len(candidates))
+
+	switch options.Overlaps {
+	case OverlapKeepAll:
+		for _, match := range candidates {
+			groups = append(groups, MatchGroup{match})
+		}
+
+	case OverlapMerge:
+		type span struct{ offset, length int }
+		bySpan := make(map[span]int)
+		for _, match := range candidates {
+			key := span{match.Offset, match.Length}
+			if i, prs := bySpan[key]; prs {
+				groups[i] = append(groups[i], match)
+			} else {
+				bySpan[key] = len(groups)
+				groups = append(groups, MatchGroup{match})
+			}
+		}
+
+	default:
+		// Greedily take the most preferred match, then anything that doesn't overlap what
+		// we've already taken. accepted is kept sorted by offset so that we only need to check
+		// the neighbours of each new match.
+		accepted := make([]MatchGroup, 0, len(candidates))
+		for _, match := range candidates {
+			i := sort.Search(len(accepted), func(i int) bool { return accepted[i].Offset() >= match.Offset })
+			if i > 0 && accepted[i-1].Offset()+accepted[i-1].Length() > match.Offset {
+				continue
+			}
+			if i < len(accepted) && match.Offset+match.Length > accepted[i].Offset() {
+				continue
+			}
+			accepted = append(accepted, nil)
+			copy(accepted[i+1:], accepted[i:])
+			accepted[i] = MatchGroup{match}
+		}
+		groups = accepted
+	}
+
+	sort.SliceStable(groups, func(i, j int) bool { return groups[i].Offset() < groups[j].Offset() })
+
+	return groups
+}
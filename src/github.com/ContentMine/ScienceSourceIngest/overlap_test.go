@@ -0,0 +1,79 @@
+//   Copyright 2018 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func describeGroups(prose string, groups []MatchGroup) string {
+	parts := make([]string, len(groups))
+	for i, group := range groups {
+		names := make([]string, len(group))
+		for j, match := range group {
+			names[j] = match.Dictionary.Identifier
+		}
+		parts[i] = fmt.Sprintf("%s@%d(%s)", prose[group.Offset():group.Offset()+group.Length()], group.Offset(), strings.Join(names, ","))
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestResolveOverlaps(t *testing.T) {
+
+	prose := "cases of yellow fever and fever"
+	diseases := Dictionary{Identifier: "diseases"}
+	symptoms := Dictionary{Identifier: "symptoms"}
+	dictionaries := []Dictionary{diseases, symptoms}
+
+	match := func(dictionary *Dictionary, term string, nth int) DictionaryMatch {
+		offset := -1
+		for i := 0; i <= nth; i++ {
+			offset += 1 + strings.Index(prose[offset+1:], term)
+		}
+		return DictionaryMatch{Offset: offset, Length: len(term), Dictionary: dictionary}
+	}
+
+	matches := []DictionaryMatch{
+		match(&symptoms, "fever", 0),
+		match(&symptoms, "fever", 1),
+		match(&diseases, "yellow fever", 0),
+		match(&diseases, "fever", 1),
+	}
+
+	tests := []struct {
+		options  AnnotationOptions
+		expected string
+	}{
+		{AnnotationOptions{Overlaps: OverlapKeepAll},
+			"yellow fever@9(diseases) fever@16(symptoms) fever@26(diseases) fever@26(symptoms)"},
+		{AnnotationOptions{Overlaps: OverlapMerge},
+			"yellow fever@9(diseases) fever@16(symptoms) fever@26(diseases,symptoms)"},
+		{AnnotationOptions{Overlaps: OverlapLongest},
+			"yellow fever@9(diseases) fever@26(diseases)"},
+		{AnnotationOptions{Overlaps: OverlapLongest, DictionaryPriority: []string{"symptoms"}},
+			"yellow fever@9(diseases) fever@26(symptoms)"},
+		{AnnotationOptions{Overlaps: OverlapPriority, DictionaryPriority: []string{"symptoms"}},
+			"fever@16(symptoms) fever@26(symptoms)"},
+	}
+
+	for _, test := range tests {
+		got := describeGroups(prose, resolveOverlaps(matches, dictionaries, test.options))
+		if got != test.expected {
+			t.Errorf("With %+v expected %s, got %s", test.options, test.expected, got)
+		}
+	}
+}
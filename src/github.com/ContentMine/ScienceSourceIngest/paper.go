@@ -15,15 +15,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
-	"net/http"
 	"os"
-	"os/exec"
 	"path"
-	"sort"
 	"time"
 
     "github.com/hashicorp/errwrap"
@@ -32,7 +29,11 @@ import (
 
 type PaperProcessor struct {
 	Paper               Paper
-	XSLTProcPath        string
+	Converter           PaperConverter
+	EuropePMC           *EuropePMCClient
+	DryRun              bool
+	Annotation          AnnotationOptions
+	Supplementary       SupplementaryOptions
 	TargetDirectory     string
 	ScienceSourceRecord *ScienceSourceArticle
 }
@@ -54,70 +55,11 @@ const HTMLFooter string = `{{articlefooter
 }}
 `
 
-type SearchDirection int
-
-const (
-	SearchDirectionBackward SearchDirection = -1
-	SearchDirectionForward                  = 1
-)
-
-const PhraseTargetSize int = 100
-
 // Generic helpers
 
-func fetchResource(url string, filename string) error {
-
-	// if it already exists, don't fetch it again
-	if _, err := os.Stat(filename); err == nil {
-		return nil
-	}
-
-	f, err := os.Create(filename)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	resp, resp_err := http.Get(url)
-	if resp_err != nil {
-		return resp_err
-	}
-	defer resp.Body.Close()
-
-	_, copy_err := io.Copy(f, resp.Body)
-	return copy_err
-}
-
-func findPhrase(prose []byte, startOffset int, direction SearchDirection) string {
-
-	targetOffset := startOffset + (PhraseTargetSize * int(direction))
-
-	// Need better terminating condition here
-	for true {
-		if direction == SearchDirectionBackward {
-			if targetOffset < 0 {
-				targetOffset = 0
-				break
-			}
-		} else {
-			if targetOffset > (len(prose) - 1) {
-				targetOffset = len(prose) - 1
-				break
-			}
-		}
-
-		if prose[targetOffset] == byte(' ') {
-			break
-		}
-
-		targetOffset = targetOffset + (1 * int(direction))
-	}
-
-	if startOffset > targetOffset {
-		startOffset, targetOffset = targetOffset, startOffset
-	}
-
-	return string(prose[startOffset:targetOffset])
+func fileExists(filename string) bool {
+	_, err := os.Stat(filename)
+	return err == nil
 }
 
 // Computed properties
@@ -138,26 +80,71 @@ func (processor PaperProcessor) targetTextFileName() string {
 	return path.Join(processor.folderName(), "paper.txt")
 }
 
+func (processor PaperProcessor) targetTextMapFileName() string {
+	return path.Join(processor.folderName(), "paper-map.json")
+}
+
+func (processor PaperProcessor) targetTextSectionsFileName() string {
+	return path.Join(processor.folderName(), "paper-sections.json")
+}
+
 func (processor PaperProcessor) targetScienceSourceStateFileName() string {
 	return path.Join(processor.folderName(), "scisource.json")
 }
 
+func (processor PaperProcessor) targetAnnotationDiffFileName() string {
+	return path.Join(processor.folderName(), "annotation-diff.json")
+}
+
 func (processor PaperProcessor) targetSupplementaryArchiveFileName() string {
 	return path.Join(processor.folderName(), "supplementary.zip")
 }
 
+func (processor PaperProcessor) europePMC() *EuropePMCClient {
+	if processor.EuropePMC == nil {
+		return defaultEuropePMCClient
+	}
+	return processor.EuropePMC
+}
+
 // Side effect heavy functions
 
 func (processor PaperProcessor) createFolderIfRequired() error {
-	return os.MkdirAll(processor.folderName(), 0755)
+	err := os.MkdirAll(processor.folderName(), 0755)
+	if err != nil {
+		return err
+	}
+	return removeStaleTempFiles(processor.folderName())
 }
 
-func (processor PaperProcessor) fetchPaperTextToDisk() error {
-	return fetchResource(processor.Paper.FullTextURL(), processor.targetXMLFileName())
+// loadRecord loads the paper's state file. If the file is corrupt we move it aside rather than
+// trust it or throw it away, as it may be the only record of what we created on the wiki, and
+// return an error so that someone looks at it before the paper is processed again.
+func (processor PaperProcessor) loadRecord() (*ScienceSourceArticle, error) {
+
+	record, err := LoadScienceSourceArticle(processor.targetScienceSourceStateFileName())
+	if err != nil && IsCorruptState(err) {
+		quarantined, qerr := quarantineFile(processor.targetScienceSourceStateFileName())
+		if qerr != nil {
+			return nil, fmt.Errorf("%v, and failed to quarantine it: %v", err, qerr)
+		}
+		log.Printf("Moved corrupt state for paper %s to %s", processor.Paper.ID(), quarantined)
+		return nil, fmt.Errorf("%v, moved to %s: check it against the wiki before re-running", err, quarantined)
+	}
+	return record, err
 }
 
-func (processor PaperProcessor) fetchPaperSupplementaryFilesToDisk() error {
-	return fetchResource(processor.Paper.SupplementaryFilesURL(), processor.targetSupplementaryArchiveFileName())
+func (processor PaperProcessor) fetchPaperTextToDisk(ctx context.Context) error {
+	client := processor.europePMC()
+	return client.fetchResource(ctx, client.FullTextURL(processor.Paper.ID()), processor.targetXMLFileName(), 0)
+}
+
+// We won't unpack more than the maximum size, so there's no point downloading an archive bigger
+// than that
+func (processor PaperProcessor) fetchPaperSupplementaryFilesToDisk(ctx context.Context) error {
+	client := processor.europePMC()
+	return client.fetchResource(ctx, client.SupplementaryFilesURL(processor.Paper.ID()), processor.targetSupplementaryArchiveFileName(),
+		processor.Supplementary.maxSize())
 }
 
 // Main processing functions
@@ -185,11 +172,11 @@ func (processor PaperProcessor) populateScienceSourceArticle() (*ScienceSourceAr
 
 func (processor PaperProcessor) processXMLToHTML(FirstAuthor *europmc.ContributorName) error {
 
-	f, err := os.Create(processor.targetHTMLFileName())
+	f, err := CreateAtomic(processor.targetHTMLFileName())
 	if err != nil {
 		return errwrap.Wrapf("Error creating HTML target file: {{err}}", err)
 	}
-	defer f.Close()
+	defer f.Abort()
 
 	firstName := ""
 	surname := ""
@@ -215,44 +202,9 @@ func (processor PaperProcessor) processXMLToHTML(FirstAuthor *europmc.Contributo
 		return errwrap.Wrapf("Error when writing header: {{err}}", err)
 	}
 
-	cmd := exec.Cmd{
-		Path: processor.XSLTProcPath,
-		Args: []string{"xsltproc", "jats-parsoid.xsl", processor.targetXMLFileName()},
-	}
-
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		return errwrap.Wrapf("Error generating output handle for xsltproc: {{err}}", err)
-	}
-	stderr, err := cmd.StderrPipe()
-	if err != nil {
-	    return errwrap.Wrapf("Error generating error handle for xsltproc: {{err}}", err)
-	}
-	if err := cmd.Start(); err != nil {
-		return errwrap.Wrapf("Error running xsltproc: {{err}}", err)
-	}
-
-	// We need to ditch the '<!DOCTYPE html>' (15 characters) from the start of the XSLT
-	c := 0
-	for count := len("<!DOCTYPE html>"); count > 0; count -= c {
-		stash := make([]byte, count)
-		c, err = stdout.Read(stash)
-		if err != nil {
-		    errprose, _ := ioutil.ReadAll(stderr)
-		    errtext := fmt.Sprintf("Error typing to find DOCTYPE tag: {{err}}. Error output from xsltproc: %s", errprose)
-		    return errwrap.Wrapf(errtext, err)
-		}
-	}
-
-	_, err = io.Copy(f, stdout)
+	err = processor.Converter.ConvertToHTML(processor.targetXMLFileName(), f)
 	if err != nil {
-		return errwrap.Wrapf("Error copying file contents: {{err}}", err)
-	}
-
-	if err := cmd.Wait(); err != nil {
-	    errprose, _ := ioutil.ReadAll(stderr)
-		errtext := fmt.Sprintf("Error when waiting for xsltproc: {{err}}. Error output from xsltproc: %s", errprose)
-		return errwrap.Wrapf(errtext, err)
+		return errwrap.Wrapf("Error converting paper to HTML: {{err}}", err)
 	}
 
 	now := time.Now()
@@ -269,46 +221,97 @@ func (processor PaperProcessor) processXMLToHTML(FirstAuthor *europmc.Contributo
 		return errwrap.Wrapf("Error when writing footer: {{err}}", err)
 	}
 
-	return nil
+	return f.Commit()
 }
 
 func (processor PaperProcessor) processXMLToText() error {
 
-	f, err := os.Create(processor.targetTextFileName())
+	f, err := CreateAtomic(processor.targetTextFileName())
 	if err != nil {
 		return errwrap.Wrapf("Error generating text mining target file: {{err}}", err)
 	}
-	defer f.Close()
+	defer f.Abort()
 
-	cmd := exec.Cmd{
-		Path: "/usr/bin/xsltproc",
-		Args: []string{"xsltproc", "jats-text.xsl", processor.targetXMLFileName()},
+	err = processor.Converter.ConvertToText(processor.targetXMLFileName(), f)
+	if err != nil {
+		return errwrap.Wrapf("Error converting paper to text: {{err}}", err)
 	}
 
-	stdout, err := cmd.StdoutPipe()
+	return f.Commit()
+}
+
+// processTextToHTMLMap saves where the text ends up in the HTML, if the converter can tell us.
+// Otherwise any map from an earlier conversion is removed, as it won't match any more.
+func (processor PaperProcessor) processTextToHTMLMap() error {
+
+	mapper, ok := processor.Converter.(TextHTMLMapper)
+	if !ok {
+		err := os.Remove(processor.targetTextMapFileName())
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	textMap, err := mapper.MapTextToHTML(processor.targetXMLFileName())
 	if err != nil {
-		return errwrap.Wrapf("Error generating file handles for xsltproc: {{err}}", err)
+		return err
 	}
-	stderr, err := cmd.StderrPipe()
+	return textMap.Save(processor.targetTextMapFileName())
+}
+
+// loadTextHTMLMap loads the map for the paper's text, or nil if there isn't one that matches it
+func (processor PaperProcessor) loadTextHTMLMap(prose []byte) (*TextHTMLMap, error) {
+
+	textMap, err := LoadTextHTMLMap(processor.targetTextMapFileName())
 	if err != nil {
-	    return errwrap.Wrapf("Error generating error handle for xsltproc: {{err}}", err)
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
 	}
-	if err := cmd.Start(); err != nil {
-		return errwrap.Wrapf("Error running xsltproc: {{err}}", err)
+	if !textMap.validFor(prose) {
+		log.Printf("Ignoring %s for paper %s as it doesn't match the paper text", processor.targetTextMapFileName(), processor.Paper.ID())
+		return nil, nil
 	}
+	return textMap, nil
+}
+
+// processTextSections saves which part of the paper each bit of the text is from, if the
+// converter can tell us, again removing any from an earlier conversion otherwise.
+func (processor PaperProcessor) processTextSections() error {
 
-	_, copy_err := io.Copy(f, stdout)
-	if copy_err != nil {
-		return errwrap.Wrapf("Error copying file contents: {{err}}", err)
+	sectioner, ok := processor.Converter.(TextSectioner)
+	if !ok {
+		err := os.Remove(processor.targetTextSectionsFileName())
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
 	}
 
-	if err := cmd.Wait(); err != nil {
-	    errprose, _ := ioutil.ReadAll(stderr)
-		errtext := fmt.Sprintf("Error when waiting for xsltproc: {{err}}. Error output from xsltproc: %s", errprose)
-		return errwrap.Wrapf(errtext, err)
+	sections, err := sectioner.SectionText(processor.targetXMLFileName())
+	if err != nil {
+		return err
 	}
+	return sections.Save(processor.targetTextSectionsFileName())
+}
 
-	return nil
+// loadTextSections loads the sections for the paper's text, or nil if there aren't any that match it
+func (processor PaperProcessor) loadTextSections(prose []byte) (*TextSections, error) {
+
+	sections, err := LoadTextSections(processor.targetTextSectionsFileName())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if !sections.validFor(prose) {
+		log.Printf("Ignoring %s for paper %s as it doesn't match the paper text", processor.targetTextSectionsFileName(), processor.Paper.ID())
+		return nil, nil
+	}
+	return sections, nil
 }
 
 func (processor PaperProcessor) findAnnotations(dictionaries []Dictionary, article *ScienceSourceArticle,
@@ -322,113 +325,262 @@ func (processor PaperProcessor) findAnnotations(dictionaries []Dictionary, artic
 	total_matches := make([]DictionaryMatch, 0)
 
 	for _, dictionary := range dictionaries {
-		total_matches = append(total_matches, dictionary.FindMatches(data)...)
+		matches, stats := dictionary.FindMatches(data)
+		if stats.RejectedWithinWords > 0 {
+			log.Printf("Dictionary %s: rejected %d of %d hits in paper %s as not whole words",
+				dictionary.Identifier, stats.RejectedWithinWords, stats.Hits, processor.Paper.ID())
+		}
+		if stats.RejectedCase > 0 {
+			log.Printf("Dictionary %s: rejected %d of %d hits in paper %s as acronyms in the wrong case",
+				dictionary.Identifier, stats.RejectedCase, stats.Hits, processor.Paper.ID())
+		}
+		total_matches = append(total_matches, matches...)
 	}
 
-	sort.Sort(DictionaryMatchesByOffset(total_matches))
-
-	res := make([]ScienceSourceAnchorPoint, len(total_matches))
+	sections, err := processor.loadTextSections(data)
+	if err != nil {
+		return errwrap.Wrapf("Error reading text sections: {{err}}", err)
+	}
+	if len(processor.Annotation.ExcludeSections) > 0 {
+		if sections == nil {
+			log.Printf("Can't exclude sections from paper %s as we don't know where they are, try converting it again", processor.Paper.ID())
+		} else {
+			remaining := excludeSections(total_matches, sections, processor.Annotation.ExcludeSections)
+			if len(remaining) < len(total_matches) {
+				log.Printf("Ignored %d matches in excluded sections of paper %s", len(total_matches)-len(remaining), processor.Paper.ID())
+			}
+			total_matches = remaining
+		}
+	}
 
-	for i := 0; i < len(total_matches); i++ {
-		match := total_matches[i]
+	groups := resolveOverlaps(total_matches, dictionaries, processor.Annotation)
+	kept := 0
+	for _, group := range groups {
+		kept += len(group)
+	}
+	if kept < len(total_matches) {
+		log.Printf("Dropped %d overlapping matches in paper %s", len(total_matches)-kept, processor.Paper.ID())
+	}
 
-		now := time.Now()
-		today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
 
-		annotation := ScienceSourceAnnotation{
-			TermFound:                 match.Entry.Term,
-			DictionaryName:            match.Dictionary.Identifier,
-			WikiDataItemCode:          match.Entry.Identifiers.WikiData,
-			LengthOfTermFound:         len(match.Entry.Term),
-			TimeCode:                  today,
-			ScienceSourceArticleTitle: article.ScienceSourceArticleTitle,
+	textMap, err := processor.loadTextHTMLMap(data)
+	if err != nil {
+		return errwrap.Wrapf("Error reading text to HTML map: {{err}}", err)
+	}
+
+	phrases := newPhraseFinder(data, processor.Annotation.PhraseMaxLength)
+	unit := processor.Annotation.offsetUnit()
+	offsets := newTextOffsets(data, unit)
+	res := make([]ScienceSourceAnchorPoint, len(groups))
+
+	for i := 0; i < len(groups); i++ {
+		group := groups[i]
+		offset := offsets.toUnits(group.Offset())
+		length := offsets.toUnits(group.Offset()+group.Length()) - offset
+
+		annotations := make([]ScienceSourceAnnotation, len(group))
+		for j, match := range group {
+			preferredLabel := match.Entry.PreferredLabel()
+			annotations[j] = ScienceSourceAnnotation{
+				TermFound:                 string(data[match.Offset : match.Offset+match.Length]),
+				PreferredLabel:            &preferredLabel,
+				DictionaryName:            match.Dictionary.Identifier,
+				WikiDataItemCode:          match.Entry.Identifiers.WikiData,
+				LengthOfTermFound:         length,
+				TimeCode:                  today,
+				ScienceSourceArticleTitle: article.ScienceSourceArticleTitle,
+			}
 		}
 
 		anchorPoint := ScienceSourceAnchorPoint{
-			PrecedingPhrase:           findPhrase(data, match.Offset, SearchDirectionBackward),
-			FollowingPhrase:           findPhrase(data, match.Offset+len(match.Entry.Term), SearchDirectionForward),
-			CharacterNumber:           match.Offset,
+			CharacterNumber:           offset,
 			TimeCode:                  today,
 			ScienceSourceArticleTitle: article.ScienceSourceArticleTitle,
 
-			Annotation: annotation,
+			Annotation: annotations[0],
+		}
+		if len(annotations) > 1 {
+			anchorPoint.AdditionalAnnotations = annotations[1:]
+		}
+		// Wikibase won't store an empty string, so a term at the start or end of a sentence has
+		// no phrase on that side
+		if precedingPhrase := phrases.Preceding(group.Offset()); len(precedingPhrase) > 0 {
+			anchorPoint.PrecedingPhrase = &precedingPhrase
+		}
+		if followingPhrase := phrases.Following(group.Offset() + group.Length()); len(followingPhrase) > 0 {
+			anchorPoint.FollowingPhrase = &followingPhrase
+		}
+		if sections != nil {
+			if section := sections.at(group.Offset()); section != nil {
+				sectionType := section.Type
+				anchorPoint.SectionType = &sectionType
+				if len(section.Heading) > 0 {
+					sectionHeading := section.Heading
+					anchorPoint.SectionHeading = &sectionHeading
+				}
+			}
 		}
 
 		if i > 0 {
-			distanceToPreceding := match.Offset - total_matches[i-1].Offset
+			distanceToPreceding := offset - offsets.toUnits(groups[i-1].Offset())
 			anchorPoint.DistanceToPreceding = &distanceToPreceding
 		}
-		if i < (len(total_matches) - 1) {
-			distanceToFollowing := total_matches[i+1].Offset - match.Offset
+		if i < (len(groups) - 1) {
+			distanceToFollowing := offsets.toUnits(groups[i+1].Offset()) - offset
 			anchorPoint.DistanceToFollowing = &distanceToFollowing
 		}
 
 		res[i] = anchorPoint
 	}
 
+	supplementaryFiles, err := processor.indexSupplementaryFiles(dictionaries)
+	if err != nil {
+		return errwrap.Wrapf("Error indexing supplementary files: {{err}}", err)
+	}
+
 	article.Annotations = res
+	article.SupplementaryFiles = supplementaryFiles
+	article.Dictionaries = dictionaryVersions(dictionaries)
+	article.OffsetUnit = unit
+	article.locateInHTML(data, textMap)
 	return nil
 }
 
-// main entry point
+// Pipeline stages. Each stage can be run on its own, and will skip work that has already been done
+// based on what is in the paper's folder, so that they can be safely re-run after a failure.
 
-func (processor PaperProcessor) ProcessPaper(dictionaries []Dictionary, sciSourceClient *ScienceSourceClient) error {
+func (processor PaperProcessor) FetchPaper(ctx context.Context) error {
 
 	err := processor.createFolderIfRequired()
 	if err != nil {
 		return errwrap.Wrapf("Failed to create folder for paper: {{err}}", err)
 	}
 
-	// Have we already processed this paper?
-	processor.ScienceSourceRecord, err = LoadScienceSourceArticle(processor.targetScienceSourceStateFileName())
+	err = processor.fetchPaperTextToDisk(ctx)
 	if err != nil {
-		processor.ScienceSourceRecord, err = processor.populateScienceSourceArticle()
-		if err != nil {
-			return errwrap.Wrapf("Failed to populate record: {{err}}", err)
-		}
+		return errwrap.Wrapf("Failed to fetch paper text: {{err}}", err)
+	}
 
-		err = processor.fetchPaperTextToDisk()
-		if err != nil {
-			return errwrap.Wrapf("Failed to fetch paper text: {{err}}", err)
-		}
+	err = processor.fetchSupplementaryFiles(ctx)
+	if err != nil {
+		return errwrap.Wrapf("Failed to fetch paper supplementary files: {{err}}", err)
+	}
 
-		/*err = processor.fetchPaperSupplementaryFilesToDisk()
-		if err != nil {
-			return errwrap.Wrapf("Failed to fetch paper supplementary files: {{err}}", err)
-		}*/
+	return nil
+}
 
-		openXMLdoc, err := europmc.LoadPaperXMLFromFile(processor.targetXMLFileName())
-		if err != nil {
+func (processor PaperProcessor) ConvertPaper(force bool) error {
+
+	if !force && fileExists(processor.targetHTMLFileName()) && fileExists(processor.targetTextFileName()) {
+		return nil
+	}
+
+	if !fileExists(processor.targetXMLFileName()) {
+		return fmt.Errorf("Paper XML %s not found, has the paper been fetched?", processor.targetXMLFileName())
+	}
+
+	openXMLdoc, err := europmc.LoadPaperXMLFromFile(processor.targetXMLFileName())
+	if err != nil {
+		// Most likely a bad download, so move it aside to be fetched again next time
+		quarantined, qerr := quarantineFile(processor.targetXMLFileName())
+		if qerr != nil {
 			return errwrap.Wrapf("Failed to load paper XML: {{err}}", err)
 		}
+		log.Printf("Moved unreadable XML for paper %s to %s", processor.Paper.ID(), quarantined)
+		return errwrap.Wrapf("Failed to load paper XML, it will be fetched again: {{err}}", err)
+	}
 
-		err = processor.processXMLToHTML(openXMLdoc.FirstAuthor())
-		if err != nil {
-			return errwrap.Wrapf("Failed to convert paper to HTML: {{err}}", err)
-		}
+	err = processor.processXMLToHTML(openXMLdoc.FirstAuthor())
+	if err != nil {
+		return errwrap.Wrapf("Failed to convert paper to HTML: {{err}}", err)
+	}
 
-		err = processor.processXMLToText()
-		if err != nil {
-			return errwrap.Wrapf("Failed to generate text for mining: {{err}}", err)
-		}
+	err = processor.processXMLToText()
+	if err != nil {
+		return errwrap.Wrapf("Failed to generate text for mining: {{err}}", err)
+	}
 
-		err = processor.findAnnotations(dictionaries, processor.ScienceSourceRecord,
-			openXMLdoc.Title(), openXMLdoc.JournalTitle())
-		if err != nil {
-			return errwrap.Wrapf("Error when finding annotations: {{err}}", err)
-		}
+	err = processor.processTextToHTMLMap()
+	if err != nil {
+		return errwrap.Wrapf("Failed to map text to HTML: {{err}}", err)
+	}
 
-		// Save the record with annotations
-		err = processor.ScienceSourceRecord.Save(processor.targetScienceSourceStateFileName())
-		if err != nil {
-			return errwrap.Wrapf("Failed to save paper record: {{err}}", err)
+	err = processor.processTextSections()
+	if err != nil {
+		return errwrap.Wrapf("Failed to find sections in text: {{err}}", err)
+	}
+
+	return nil
+}
+
+func (processor PaperProcessor) AnnotatePaper(dictionaries []Dictionary, force bool) error {
+
+	existing, err := processor.loadRecord()
+	if err != nil && !os.IsNotExist(err) {
+		return errwrap.Wrapf("Failed to load paper record: {{err}}", err)
+	}
+	if existing != nil {
+		if !force {
+			return nil
+		}
+		// Once we've started making things on the wiki we can't throw away the state that
+		// tells us what we made, or we'll end up with orphaned items
+		if existing.PageID != 0 || len(existing.ID) != 0 {
+			return fmt.Errorf("Paper %s has already been uploaded, not re-annotating", processor.Paper.ID())
 		}
 	}
-	log.Printf("Count %d", len(processor.ScienceSourceRecord.Annotations))
+
+	if !fileExists(processor.targetTextFileName()) {
+		return fmt.Errorf("Paper text %s not found, has the paper been converted?", processor.targetTextFileName())
+	}
+
+	record, err := processor.populateScienceSourceArticle()
+	if err != nil {
+		return errwrap.Wrapf("Failed to populate record: {{err}}", err)
+	}
+
+	err = processor.findAnnotations(dictionaries, record, processor.Paper.Title.Value, processor.Paper.JournalLabel.Value)
+	if err != nil {
+		return errwrap.Wrapf("Error when finding annotations: {{err}}", err)
+	}
+
+	// Save the record with annotations
+	err = record.Save(processor.targetScienceSourceStateFileName())
+	if err != nil {
+		return errwrap.Wrapf("Failed to save paper record: {{err}}", err)
+	}
+
+	log.Printf("Found %d annotations in paper %s", len(record.Annotations), processor.Paper.ID())
+
+	return nil
+}
+
+// saveUploadState records progress made uploading to the wiki. On a dry run the IDs we are given are
+// made up, so we mustn't save them or a later real run would think the paper already uploaded.
+func (processor PaperProcessor) saveUploadState() error {
+	if processor.DryRun {
+		return nil
+	}
+	return processor.ScienceSourceRecord.Save(processor.targetScienceSourceStateFileName())
+}
+
+func (processor PaperProcessor) UploadPaper(ctx context.Context, sciSourceClient *ScienceSourceClient) error {
+
+	var err error
+	processor.ScienceSourceRecord, err = processor.loadRecord()
+	if err != nil {
+		return errwrap.Wrapf("Failed to load paper record, has the paper been annotated? {{err}}", err)
+	}
+
+	if processor.ScienceSourceRecord.ClaimsUploaded {
+		return nil
+	}
 
 	if processor.ScienceSourceRecord.PageID == 0 {
 		log.Printf("Uploading paper %s", processor.Paper.ID())
-		err = sciSourceClient.UploadPaper(processor.ScienceSourceRecord, processor.targetHTMLFileName())
+		err = sciSourceClient.UploadPaper(ctx, processor.ScienceSourceRecord, processor.targetHTMLFileName())
 		if err != nil {
 			return errwrap.Wrapf("Failed to upload paper: {{err}}", err)
 		}
@@ -436,7 +588,7 @@ func (processor PaperProcessor) ProcessPaper(dictionaries []Dictionary, sciSourc
 		log.Printf("Page ID is %d", processor.ScienceSourceRecord.PageID)
 
 		// Save the record again as it'll have an updated Page ID
-		err = processor.ScienceSourceRecord.Save(processor.targetScienceSourceStateFileName())
+		err = processor.saveUploadState()
 		if err != nil {
 			return errwrap.Wrapf("Failed to re-save paper record: {{err}}", err)
 		}
@@ -451,9 +603,9 @@ func (processor PaperProcessor) ProcessPaper(dictionaries []Dictionary, sciSourc
 	// the only time when we have all the information about all properties for each item.
 	//
 	// [0] https://sciencesource.wmflabs.org/wiki/Data_schema
-	upload_err := sciSourceClient.CreateArticleItemTree(processor.ScienceSourceRecord)
+	upload_err := sciSourceClient.CreateArticleItemTree(ctx, processor.ScienceSourceRecord, processor.saveUploadState)
 	// regardless of whether we error, do another save to record any partial changes to the tree
-	err = processor.ScienceSourceRecord.Save(processor.targetScienceSourceStateFileName())
+	err = processor.saveUploadState()
 	if err != nil || upload_err != nil {
 
 		// if we had two errors combine them into one
@@ -471,18 +623,79 @@ func (processor PaperProcessor) ProcessPaper(dictionaries []Dictionary, sciSourc
 	// If we got here then now we have an item for every part of the data structure, so upload all the properties.
 	err = sciSourceClient.ReconsileArticleItemTree(processor.ScienceSourceRecord)
 	if err != nil {
-			return errwrap.Wrapf("Error when reconciling article tree: {{err}}", err)
+		return errwrap.Wrapf("Error when reconciling article tree: {{err}}", err)
+	}
+	err = sciSourceClient.PopulateAritcleItemTree(ctx, processor.ScienceSourceRecord)
+	if err != nil {
+		return errwrap.Wrapf("Error when populating article tree: {{err}}", err)
 	}
-	err = sciSourceClient.PopulateAritcleItemTree(processor.ScienceSourceRecord)
+	err = sciSourceClient.UnlinkRetiredItems(processor.ScienceSourceRecord)
 	if err != nil {
-			return errwrap.Wrapf("Error when populating article tree: {{err}}", err)
+		return errwrap.Wrapf("Error when unlinking retired items: {{err}}", err)
 	}
-	err = processor.ScienceSourceRecord.Save(processor.targetScienceSourceStateFileName())
+	processor.ScienceSourceRecord.ClaimsUploaded = true
+	err = processor.saveUploadState()
 	if err != nil {
-			return errwrap.Wrapf("Failed on final save of paper record: {{err}}", err)
+		return errwrap.Wrapf("Failed on final save of paper record: {{err}}", err)
 	}
 
 	log.Printf("Completed paper %s", processor.Paper.ID())
 
 	return nil
 }
+
+// main entry point, which runs all the stages in turn
+
+// isAnnotated tells us whether the paper has got as far as having a state file, in which case
+// the fetch, convert, and annotate stages are skipped when running the whole pipeline.
+func (processor PaperProcessor) isAnnotated() (bool, error) {
+	_, err := processor.loadRecord()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (processor PaperProcessor) fetchIfNotAnnotated(ctx context.Context) error {
+	annotated, err := processor.isAnnotated()
+	if err != nil || annotated {
+		return err
+	}
+	return processor.FetchPaper(ctx)
+}
+
+func (processor PaperProcessor) annotateIfNotAnnotated(dictionaries []Dictionary) error {
+	annotated, err := processor.isAnnotated()
+	if err != nil || annotated {
+		return err
+	}
+
+	err = processor.ConvertPaper(true)
+	if err != nil {
+		return err
+	}
+
+	return processor.AnnotatePaper(dictionaries, false)
+}
+
+func (processor PaperProcessor) ProcessPaper(ctx context.Context, dictionaries []Dictionary, sciSourceClient *ScienceSourceClient) error {
+
+	err := processor.fetchIfNotAnnotated(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = processor.annotateIfNotAnnotated(dictionaries)
+	if err != nil {
+		return err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return processor.UploadPaper(ctx, sciSourceClient)
+}
@@ -0,0 +1,233 @@
+//   Copyright 2018 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The preceding and following phrases on an anchor point give the text either side of the term
+// found, so people can see it in context. They stop at the end of the sentence the term is in,
+// and at paragraph breaks, which in the paper text are newlines. Sentences are found with a few
+// simple rules rather than anything clever: a full stop, question mark, or exclamation mark ends
+// a sentence if it is followed by a space and then something other than a lower case letter, and
+// isn't the end of a common abbreviation or an initial. As the paper text runs headings and some
+// paragraphs straight into each other ("here.Methods"), a full stop between a lower case and
+// an upper case letter also ends a sentence.
+
+// DefaultPhraseMaxLength is the most characters of context we take either side of a term
+const DefaultPhraseMaxLength int = 100
+
+// Words that are usually followed by a full stop that doesn't end the sentence
+var phraseAbbreviations = map[string]bool{
+	"al": true, "approx": true, "ca": true, "cf": true, "Dr": true, "e.g": true, "eq": true,
+	"Eq": true, "Eqs": true, "fig": true, "Fig": true, "Figs": true, "i.e": true, "Mr": true,
+	"Mrs": true, "Ms": true, "no": true, "No": true, "Prof": true, "ref": true, "Ref": true,
+	"Refs": true, "sp": true, "spp": true, "St": true, "viz": true, "vol": true, "Vol": true,
+	"vs": true,
+}
+
+func isSentenceTerminator(r rune) bool {
+	switch r {
+	case '.', '?', '!', '\u2026', '\u3002', '\uFF0E', '\uFF1F', '\uFF01':
+		return true
+	}
+	return false
+}
+
+// Closing quotes and brackets can come between the end of a sentence and the space after it
+func isSentenceCloser(r rune) bool {
+	switch r {
+	case '"', '\'', ')', ']', '\u2019', '\u201D':
+		return true
+	}
+	return false
+}
+
+// isParagraphBreak tells us if r splits paragraphs in the paper text
+func isParagraphBreak(r rune) bool {
+	return r == '\n' || r == '\r' || r == '\u2029'
+}
+
+// lastWordBefore gets the word that ends at offset, for checking against the abbreviations
+func lastWordBefore(prose []byte, offset int) string {
+	start := offset
+	for start > 0 {
+		r, size := utf8.DecodeLastRune(prose[:start])
+		if !isWordRune(r) && r != '.' {
+			break
+		}
+		start -= size
+	}
+	return string(prose[start:offset])
+}
+
+// endsSentence tells us whether the terminator at offset, followed by whatever is at next, ends
+// a sentence
+func endsSentence(prose []byte, offset int, next int) bool {
+
+	if next >= len(prose) {
+		return true
+	}
+
+	after, _ := utf8.DecodeRune(prose[next:])
+	if !unicode.IsSpace(after) {
+		// Only a full stop run straight into the next sentence
+		before, _ := utf8.DecodeLastRune(prose[:offset])
+		return prose[offset] == '.' && next == offset+1 && unicode.IsLower(before) && unicode.IsUpper(after)
+	}
+
+	if prose[offset] == '.' {
+		word := lastWordBefore(prose, offset)
+		if phraseAbbreviations[word] {
+			return false
+		}
+		if utf8.RuneCountInString(word) == 1 {
+			if r, _ := utf8.DecodeRuneInString(word); unicode.IsUpper(r) {
+				return false
+			}
+		}
+	}
+
+	// A lower case letter after the space means we've probably misread an abbreviation
+	for i := next; i < len(prose); {
+		r, size := utf8.DecodeRune(prose[i:])
+		if isParagraphBreak(r) {
+			return true
+		}
+		if !unicode.IsSpace(r) {
+			return !unicode.IsLower(r)
+		}
+		i += size
+	}
+	return true
+}
+
+// findSentenceStarts splits prose into sentences and paragraphs, returning the offset each one
+// starts at. The first sentence always starts at zero.
+func findSentenceStarts(prose []byte) []int {
+
+	starts := []int{0}
+	for i := 0; i < len(prose); {
+		r, size := utf8.DecodeRune(prose[i:])
+
+		if isParagraphBreak(r) {
+			starts = append(starts, i+size)
+		} else if isSentenceTerminator(r) {
+			next := i + size
+			for next < len(prose) {
+				c, csize := utf8.DecodeRune(prose[next:])
+				if !isSentenceTerminator(c) && !isSentenceCloser(c) {
+					break
+				}
+				next += csize
+			}
+			if endsSentence(prose, i, next) {
+				// The next sentence starts after the spaces, and paragraph breaks are dealt with
+				// on the next pass round
+				for next < len(prose) {
+					c, csize := utf8.DecodeRune(prose[next:])
+					if !unicode.IsSpace(c) || isParagraphBreak(c) {
+						break
+					}
+					next += csize
+				}
+				if next < len(prose) {
+					if c, _ := utf8.DecodeRune(prose[next:]); !isParagraphBreak(c) {
+						starts = append(starts, next)
+					}
+				}
+			}
+			i = next
+			continue
+		}
+		i += size
+	}
+	return starts
+}
+
+// A phraseFinder gets the context for terms found in a paper's text
+type phraseFinder struct {
+	prose          []byte
+	sentenceStarts []int
+	maxLength      int
+}
+
+func newPhraseFinder(prose []byte, maxLength int) phraseFinder {
+	if maxLength <= 0 {
+		maxLength = DefaultPhraseMaxLength
+	}
+	return phraseFinder{
+		prose:          prose,
+		sentenceStarts: findSentenceStarts(prose),
+		maxLength:      maxLength,
+	}
+}
+
+// Preceding returns the text from the start of the sentence up to offset
+func (finder phraseFinder) Preceding(offset int) string {
+
+	// The last sentence that starts at or before offset
+	idx := sort.SearchInts(finder.sentenceStarts, offset+1) - 1
+	start := finder.sentenceStarts[idx]
+
+	// Clip to the maximum length, starting after a space if we can so as not to split a word
+	if utf8.RuneCount(finder.prose[start:offset]) > finder.maxLength {
+		clipped := offset
+		for count := 0; count < finder.maxLength; count++ {
+			_, size := utf8.DecodeLastRune(finder.prose[start:clipped])
+			clipped -= size
+		}
+		if r, _ := utf8.DecodeLastRune(finder.prose[start:clipped]); !unicode.IsSpace(r) {
+			if space := strings.IndexFunc(string(finder.prose[clipped:offset]), unicode.IsSpace); space >= 0 {
+				clipped += space
+			}
+		}
+		start = clipped
+	}
+
+	return strings.ToValidUTF8(strings.TrimLeftFunc(string(finder.prose[start:offset]), unicode.IsSpace), "")
+}
+
+// Following returns the text from offset to the end of the sentence
+func (finder phraseFinder) Following(offset int) string {
+
+	// The first sentence that starts at or after offset
+	idx := sort.SearchInts(finder.sentenceStarts, offset)
+	end := len(finder.prose)
+	if idx < len(finder.sentenceStarts) {
+		end = finder.sentenceStarts[idx]
+	}
+
+	// Clip to the maximum length, ending before a space if we can so as not to split a word
+	if utf8.RuneCount(finder.prose[offset:end]) > finder.maxLength {
+		clipped := offset
+		for count := 0; count < finder.maxLength; count++ {
+			_, size := utf8.DecodeRune(finder.prose[clipped:end])
+			clipped += size
+		}
+		if r, _ := utf8.DecodeRune(finder.prose[clipped:end]); !unicode.IsSpace(r) {
+			if space := strings.LastIndexFunc(string(finder.prose[offset:clipped]), unicode.IsSpace); space >= 0 {
+				clipped = offset + space
+			}
+		}
+		end = clipped
+	}
+
+	return strings.ToValidUTF8(strings.TrimRightFunc(string(finder.prose[offset:end]), unicode.IsSpace), "")
+}
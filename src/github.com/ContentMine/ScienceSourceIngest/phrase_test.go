@@ -0,0 +1,108 @@
+//   Copyright 2018 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestFindSentenceStarts(t *testing.T) {
+
+	tests := []struct {
+		prose     string
+		sentences []string
+	}{
+		{"One. Two? Three!", []string{"One. ", "Two? ", "Three!"}},
+		{"Cases are common [1]. See here.Methods", []string{"Cases are common [1]. ", "See here.", "Methods"}},
+		{"As shown in Fig. 2 by J. Smith et al. the rate rose, e.g. in 2009. Then 3.5 fell.", []string{
+			"As shown in Fig. 2 by J. Smith et al. the rate rose, e.g. in 2009. ", "Then 3.5 fell."}},
+		{"He said \"stop.\" Then left.", []string{"He said \"stop.\" ", "Then left."}},
+		{"First paragraph\nSecond. Still second\n\nThird", []string{
+			"First paragraph\n", "Second. ", "Still second\n", "\n", "Third"}},
+	}
+
+	for _, test := range tests {
+		prose := []byte(test.prose)
+		starts := findSentenceStarts(prose)
+		sentences := make([]string, len(starts))
+		for i, start := range starts {
+			end := len(prose)
+			if i < len(starts)-1 {
+				end = starts[i+1]
+			}
+			sentences[i] = string(prose[start:end])
+		}
+		if !reflect.DeepEqual(sentences, test.sentences) {
+			t.Errorf("Expected %q to be split into %q, got %q", test.prose, test.sentences, sentences)
+		}
+	}
+}
+
+func TestPhrasesStopAtSentences(t *testing.T) {
+
+	prose := []byte("Introduction\nCases of malaria are common [1]. We treated cholera with aciclovir in some cases. See here.")
+	finder := newPhraseFinder(prose, DefaultPhraseMaxLength)
+
+	offset := strings.Index(string(prose), "cholera")
+	if phrase := finder.Preceding(offset); phrase != "We treated " {
+		t.Errorf("Unexpected preceding phrase %q", phrase)
+	}
+	if phrase := finder.Following(offset + len("cholera")); phrase != " with aciclovir in some cases." {
+		t.Errorf("Unexpected following phrase %q", phrase)
+	}
+
+	// Terms at the start or end of a paragraph have nothing on that side
+	offset = strings.Index(string(prose), "Introduction")
+	if phrase := finder.Following(offset + len("Introduction")); phrase != "" {
+		t.Errorf("Expected no following phrase, got %q", phrase)
+	}
+	if phrase := finder.Preceding(strings.Index(string(prose), "Cases")); phrase != "" {
+		t.Errorf("Expected no preceding phrase, got %q", phrase)
+	}
+	if phrase := finder.Following(len(prose)); phrase != "" {
+		t.Errorf("Expected no following phrase at end of text, got %q", phrase)
+	}
+}
+
+func TestPhrasesClippedToLength(t *testing.T) {
+
+	// Lots of multi-byte characters, so clipping by bytes would split them
+	prose := []byte(strings.Repeat("naïve café ", 20) + "malaria " + strings.Repeat("über straße ", 20))
+	finder := newPhraseFinder(prose, 30)
+
+	offset := strings.Index(string(prose), "malaria")
+	preceding := finder.Preceding(offset)
+	following := finder.Following(offset + len("malaria"))
+
+	for _, phrase := range []string{preceding, following} {
+		if !utf8.ValidString(phrase) {
+			t.Errorf("Phrase %q is not valid UTF-8", phrase)
+		}
+		if utf8.RuneCountInString(phrase) > 30 {
+			t.Errorf("Phrase %q is longer than 30 characters", phrase)
+		}
+	}
+
+	// Clipped at word boundaries
+	if preceding != "café naïve café naïve café " {
+		t.Errorf("Unexpected preceding phrase %q", preceding)
+	}
+	if following != " über straße über straße über" {
+		t.Errorf("Unexpected following phrase %q", following)
+	}
+}
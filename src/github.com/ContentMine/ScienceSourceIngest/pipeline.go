@@ -0,0 +1,143 @@
+//   Copyright 2018 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"runtime"
+	"sync"
+)
+
+// Fetching and converting papers is limited by Europe PMC and the local CPU, whereas uploading
+// is limited by how fast the wiki lets us create items, so each stage gets its own pool of
+// workers, with papers handed from one stage to the next over channels. That way we can be
+// converting and annotating papers while earlier ones are still slowly uploading.
+
+const (
+	DefaultFetchWorkers  int = 4
+	DefaultUploadWorkers int = 1
+)
+
+var DefaultProcessWorkers int = runtime.NumCPU()
+
+type PipelineStage struct {
+	Name    string
+	Workers int
+	Run     func(paper Paper) error
+}
+
+// PipelineSummary counts what happened to the papers in a run. Papers that were never started,
+// or that stopped part way, because the run was interrupted count as interrupted rather than
+// failed, as they can be picked up again on the next run.
+type PipelineSummary struct {
+	Total       int
+	Completed   int
+	Failed      int
+	Interrupted int
+}
+
+func (summary PipelineSummary) String() string {
+	return fmt.Sprintf("%d papers: %d completed, %d failed, %d interrupted",
+		summary.Total, summary.Completed, summary.Failed, summary.Interrupted)
+}
+
+// runPipeline passes every paper through each stage in turn, logging rather than stopping on
+// failures. A paper that fails a stage isn't passed on to later stages. Once the context is
+// cancelled no new work is started, but work already running is left to finish.
+func runPipeline(ctx context.Context, library []Paper, stages []PipelineStage) PipelineSummary {
+
+	var lock sync.Mutex
+	summary := PipelineSummary{Total: len(library)}
+
+	papers := make(chan Paper)
+	go func() {
+		defer close(papers)
+		for _, paper := range library {
+			select {
+			case papers <- paper:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	input := papers
+	for _, stage := range stages {
+		input = runPipelineStage(ctx, stage, input, func() {
+			lock.Lock()
+			summary.Failed += 1
+			lock.Unlock()
+		})
+	}
+
+	for range input {
+		summary.Completed += 1
+	}
+
+	// Anything else was either never started or stopped part way by the interruption
+	summary.Interrupted = summary.Total - summary.Completed - summary.Failed
+
+	return summary
+}
+
+// runPipelineStage starts the workers for a stage, and returns the channel on which papers
+// that made it through the stage are passed on. The channel is closed once the input has
+// been closed and all the workers are done.
+func runPipelineStage(ctx context.Context, stage PipelineStage, input <-chan Paper, failed func()) chan Paper {
+
+	workers := stage.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	// Buffer enough that a fast stage isn't held up waiting for the next stage to pick up work
+	output := make(chan Paper, workers)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for paper := range input {
+				if ctx.Err() != nil {
+					continue
+				}
+
+				log.Printf("%s paper %s", stage.Name, paper.ID())
+
+				err := stage.Run(paper)
+				if err != nil {
+					if ctx.Err() != nil {
+						log.Printf("%s stage stopped for paper %s: %v", stage.Name, paper.ID(), err)
+					} else {
+						log.Printf("%s stage failed for paper %s: %v", stage.Name, paper.ID(), err)
+						failed()
+					}
+					continue
+				}
+				output <- paper
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(output)
+	}()
+
+	return output
+}
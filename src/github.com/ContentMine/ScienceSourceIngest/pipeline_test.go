@@ -0,0 +1,131 @@
+//   Copyright 2018 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// concurrencyCounter tracks the most calls that were running at once
+type concurrencyCounter struct {
+	lock    sync.Mutex
+	current int
+	max     int
+	seen    map[string][]string
+}
+
+func (c *concurrencyCounter) run(stage string, paper Paper) {
+	c.lock.Lock()
+	c.current += 1
+	if c.current > c.max {
+		c.max = c.current
+	}
+	c.seen[paper.ID()] = append(c.seen[paper.ID()], stage)
+	c.lock.Unlock()
+
+	time.Sleep(5 * time.Millisecond)
+
+	c.lock.Lock()
+	c.current -= 1
+	c.lock.Unlock()
+}
+
+func testLibrary(count int) []Paper {
+	library := make([]Paper, count)
+	for i := range library {
+		library[i] = Paper{PMCID: DataValue{Type: "literal", Value: fmt.Sprintf("PMC%d", i)}}
+	}
+	return library
+}
+
+func TestPipelineStagesInOrder(t *testing.T) {
+
+	library := testLibrary(20)
+	fetch := &concurrencyCounter{seen: make(map[string][]string)}
+	upload := &concurrencyCounter{seen: make(map[string][]string)}
+	var orderLock sync.Mutex
+	order := make(map[string][]string)
+
+	record := func(counter *concurrencyCounter, stage string) func(Paper) error {
+		return func(paper Paper) error {
+			orderLock.Lock()
+			order[paper.ID()] = append(order[paper.ID()], stage)
+			orderLock.Unlock()
+			counter.run(stage, paper)
+			if stage == "process" && paper.ID() == "PMC3" {
+				return fmt.Errorf("Test failure")
+			}
+			return nil
+		}
+	}
+
+	summary := runPipeline(context.Background(), library, []PipelineStage{
+		{Name: "fetch", Workers: 4, Run: record(fetch, "fetch")},
+		{Name: "process", Workers: 3, Run: record(fetch, "process")},
+		{Name: "upload", Workers: 1, Run: record(upload, "upload")},
+	})
+
+	if summary.Failed != 1 || summary.Completed != len(library)-1 || summary.Interrupted != 0 {
+		t.Errorf("Expected 1 failure and the rest completed, got %v", summary)
+	}
+	if upload.max != 1 {
+		t.Errorf("Expected uploads to run one at a time, got %d at once", upload.max)
+	}
+	if fetch.max < 2 {
+		t.Errorf("Expected fetching and processing to run concurrently, got %d at once", fetch.max)
+	}
+
+	for _, paper := range library {
+		expected := "[fetch process upload]"
+		if paper.ID() == "PMC3" {
+			expected = "[fetch process]"
+		}
+		if got := fmt.Sprintf("%v", order[paper.ID()]); got != expected {
+			t.Errorf("Expected paper %s to go through %s, got %s", paper.ID(), expected, got)
+		}
+	}
+}
+
+func TestPipelineInterrupted(t *testing.T) {
+
+	library := testLibrary(10)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var lock sync.Mutex
+	uploaded := 0
+	summary := runPipeline(ctx, library, []PipelineStage{
+		{Name: "upload", Workers: 1, Run: func(paper Paper) error {
+			lock.Lock()
+			defer lock.Unlock()
+			uploaded += 1
+			if uploaded == 3 {
+				cancel()
+				return ctx.Err()
+			}
+			return nil
+		}},
+	})
+
+	if summary.Completed != 2 || summary.Failed != 0 || summary.Interrupted != 8 {
+		t.Errorf("Expected 2 completed and 8 interrupted, got %v", summary)
+	}
+	if uploaded != 3 {
+		t.Errorf("Expected no papers to be started after the interruption, got %d", uploaded)
+	}
+}
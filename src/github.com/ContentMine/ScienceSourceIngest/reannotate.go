@@ -0,0 +1,282 @@
+//   Copyright 2018 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/ContentMine/wikibase"
+	"github.com/hashicorp/errwrap"
+)
+
+// Re-annotating papers when the dictionaries change. Each paper records the fingerprint of every
+// dictionary it was annotated with, so we can spot those annotated with older versions, find
+// their annotations again, and work out which anchor points and annotations have come and gone.
+//
+// A paper that has been uploaded keeps the wiki items for everything that is still found, gets
+// new items for anything new, and has the items for anything no longer found taken out of the
+// chain of anchor points and listed as retired. Uploading it again then updates the wiki.
+
+type DictionaryVersion struct {
+	Identifier  string `json:"id"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+func dictionaryVersions(dictionaries []Dictionary) []DictionaryVersion {
+	res := make([]DictionaryVersion, len(dictionaries))
+	for i, dictionary := range dictionaries {
+		res[i] = DictionaryVersion{Identifier: dictionary.Identifier, Fingerprint: dictionary.Fingerprint()}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Identifier < res[j].Identifier })
+	return res
+}
+
+// isAnnotatedWith tells us if the article's annotations came from exactly these dictionaries.
+// Articles annotated before we recorded dictionaries never are, as we can't know.
+func (article *ScienceSourceArticle) isAnnotatedWith(dictionaries []Dictionary) bool {
+	current := dictionaryVersions(dictionaries)
+	if len(current) != len(article.Dictionaries) {
+		return false
+	}
+	for i, version := range current {
+		if article.Dictionaries[i] != version {
+			return false
+		}
+	}
+	return true
+}
+
+// An anchor point is the same if it covers the same text, and an annotation on it is the same
+// if it links that text to the same entry in the same dictionary. The preferred label isn't part
+// of this, as papers annotated before we recorded labels don't have one.
+
+type anchorKey struct {
+	Offset int
+	Length int
+}
+
+type annotationKey struct {
+	anchorKey
+	Dictionary string
+	WikiData   string
+}
+
+func keyForAnchor(anchor ScienceSourceAnchorPoint) anchorKey {
+	return anchorKey{Offset: anchor.CharacterNumber, Length: anchor.Annotation.LengthOfTermFound}
+}
+
+func keyForAnnotation(anchor ScienceSourceAnchorPoint, annotation ScienceSourceAnnotation) annotationKey {
+	return annotationKey{
+		anchorKey:  keyForAnchor(anchor),
+		Dictionary: annotation.DictionaryName,
+		WikiData:   annotation.WikiDataItemCode,
+	}
+}
+
+// allAnnotations gives the main and additional annotations on an anchor point
+func (anchor *ScienceSourceAnchorPoint) allAnnotations() []*ScienceSourceAnnotation {
+	res := []*ScienceSourceAnnotation{&anchor.Annotation}
+	for i := range anchor.AdditionalAnnotations {
+		res = append(res, &anchor.AdditionalAnnotations[i])
+	}
+	return res
+}
+
+type AnnotationChange struct {
+	CharacterNumber  int                       `json:"character"`
+	Length           int                       `json:"length"`
+	TermFound        string                    `json:"term"`
+	PreferredLabel   string                    `json:"preferred_label,omitempty"`
+	DictionaryName   string                    `json:"dictionary"`
+	WikiDataItemCode string                    `json:"wikidata"`
+	ID               wikibase.ItemPropertyType `json:"item,omitempty"`
+}
+
+type AnnotationDiff struct {
+	Paper    string              `json:"paper"`
+	Previous []DictionaryVersion `json:"previous_dictionaries"`
+	Current  []DictionaryVersion `json:"current_dictionaries"`
+	Added    []AnnotationChange  `json:"added"`
+	Removed  []AnnotationChange  `json:"removed"`
+	// Whether the changes have been made to the paper's state, ready to be uploaded
+	Applied bool `json:"applied"`
+}
+
+func (diff AnnotationDiff) IsEmpty() bool {
+	return len(diff.Added) == 0 && len(diff.Removed) == 0
+}
+
+func (diff AnnotationDiff) String() string {
+	return fmt.Sprintf("%d annotations added, %d removed", len(diff.Added), len(diff.Removed))
+}
+
+// annotationChanges lists the annotations that aren't in the exclusions, using up one exclusion
+// for each annotation it matches
+func annotationChanges(anchors []ScienceSourceAnchorPoint, exclude map[annotationKey]int) []AnnotationChange {
+	res := make([]AnnotationChange, 0)
+	for i := range anchors {
+		for _, annotation := range anchors[i].allAnnotations() {
+			key := keyForAnnotation(anchors[i], *annotation)
+			if exclude[key] > 0 {
+				exclude[key] -= 1
+				continue
+			}
+			res = append(res, AnnotationChange{
+				CharacterNumber:  key.Offset,
+				Length:           annotation.LengthOfTermFound,
+				TermFound:        annotation.TermFound,
+				PreferredLabel:   hitPreferredLabel(*annotation),
+				DictionaryName:   annotation.DictionaryName,
+				WikiDataItemCode: annotation.WikiDataItemCode,
+				ID:               annotation.ID,
+			})
+		}
+	}
+	return res
+}
+
+func countAnnotations(anchors []ScienceSourceAnchorPoint) map[annotationKey]int {
+	res := make(map[annotationKey]int)
+	for i := range anchors {
+		for _, annotation := range anchors[i].allAnnotations() {
+			res[keyForAnnotation(anchors[i], *annotation)] += 1
+		}
+	}
+	return res
+}
+
+func diffAnnotations(previous []ScienceSourceAnchorPoint, current []ScienceSourceAnchorPoint) (added []AnnotationChange, removed []AnnotationChange) {
+	return annotationChanges(current, countAnnotations(previous)), annotationChanges(previous, countAnnotations(current))
+}
+
+// mergeAnnotations takes the newly found anchor points, and gives any that were there before the
+// items they already have on the wiki, along with the time they were first found. It returns the
+// IDs of the items that are left over.
+func mergeAnnotations(previous []ScienceSourceAnchorPoint, current []ScienceSourceAnchorPoint) []wikibase.ItemPropertyType {
+
+	// The keep-all overlap policy can give several anchor points for the same text, so these
+	// are queues rather than single items
+	anchors := make(map[anchorKey][]*ScienceSourceAnchorPoint)
+	annotations := make(map[annotationKey][]*ScienceSourceAnnotation)
+	for i := range previous {
+		anchors[keyForAnchor(previous[i])] = append(anchors[keyForAnchor(previous[i])], &previous[i])
+		for _, annotation := range previous[i].allAnnotations() {
+			key := keyForAnnotation(previous[i], *annotation)
+			annotations[key] = append(annotations[key], annotation)
+		}
+	}
+	used := make(map[wikibase.ItemPropertyType]bool)
+
+	for i := range current {
+		key := keyForAnchor(current[i])
+		if queue := anchors[key]; len(queue) > 0 {
+			current[i].ID = queue[0].ID
+			current[i].TimeCode = queue[0].TimeCode
+			used[queue[0].ID] = true
+			anchors[key] = queue[1:]
+		}
+		for _, annotation := range current[i].allAnnotations() {
+			key := keyForAnnotation(current[i], *annotation)
+			if queue := annotations[key]; len(queue) > 0 {
+				annotation.ID = queue[0].ID
+				annotation.TimeCode = queue[0].TimeCode
+				used[queue[0].ID] = true
+				annotations[key] = queue[1:]
+			}
+		}
+	}
+
+	retired := make([]wikibase.ItemPropertyType, 0)
+	for i := range previous {
+		if len(previous[i].ID) > 0 && !used[previous[i].ID] {
+			retired = append(retired, previous[i].ID)
+		}
+		for _, annotation := range previous[i].allAnnotations() {
+			if len(annotation.ID) > 0 && !used[annotation.ID] {
+				retired = append(retired, annotation.ID)
+			}
+		}
+	}
+	return retired
+}
+
+// ReannotatePaper finds the annotations again if the paper was annotated with different
+// dictionaries, and writes out the difference. If apply is set the paper's state is updated to
+// match, and if it had already been uploaded it is marked as needing uploading again. Returns nil
+// if the paper is not stale.
+func (processor PaperProcessor) ReannotatePaper(dictionaries []Dictionary, apply bool) (*AnnotationDiff, error) {
+
+	record, err := processor.loadRecord()
+	if err != nil {
+		return nil, errwrap.Wrapf("Failed to load paper record, has the paper been annotated? {{err}}", err)
+	}
+	if record.isAnnotatedWith(dictionaries) {
+		return nil, nil
+	}
+
+	// Papers annotated before we counted offsets in the current unit need converting before we
+	// can compare their annotations with the new ones
+	migrated, err := processor.convertRecordOffsets(record, processor.Annotation.offsetUnit())
+	if err != nil {
+		return nil, errwrap.Wrapf("Failed to convert offsets: {{err}}", err)
+	}
+
+	candidate := *record
+	err = processor.findAnnotations(dictionaries, &candidate, processor.Paper.Title.Value, processor.Paper.JournalLabel.Value)
+	if err != nil {
+		return nil, errwrap.Wrapf("Error when finding annotations: {{err}}", err)
+	}
+
+	diff := &AnnotationDiff{
+		Paper:    processor.Paper.ID(),
+		Previous: record.Dictionaries,
+		Current:  candidate.Dictionaries,
+		Applied:  apply,
+	}
+	diff.Added, diff.Removed = diffAnnotations(record.Annotations, candidate.Annotations)
+
+	if apply {
+		retired := mergeAnnotations(record.Annotations, candidate.Annotations)
+		if !diff.IsEmpty() {
+			record.Annotations = candidate.Annotations
+			record.RetiredItems = append(record.RetiredItems, retired...)
+		}
+		if !diff.IsEmpty() || migrated {
+			record.ClaimsUploaded = false
+		}
+		record.Dictionaries = candidate.Dictionaries
+
+		err = record.Save(processor.targetScienceSourceStateFileName())
+		if err != nil {
+			return nil, errwrap.Wrapf("Failed to save paper record: {{err}}", err)
+		}
+	}
+
+	data, err := json.MarshalIndent(diff, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	err = WriteFileAtomic(processor.targetAnnotationDiffFileName(), data)
+	if err != nil {
+		return nil, errwrap.Wrapf("Failed to save annotation diff: {{err}}", err)
+	}
+
+	log.Printf("Paper %s: %v", processor.Paper.ID(), diff)
+
+	return diff, nil
+}
@@ -0,0 +1,256 @@
+//   Copyright 2018 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path"
+	"testing"
+
+	"github.com/ContentMine/wikibase"
+)
+
+func TestDictionaryFingerprint(t *testing.T) {
+
+	dictionary := Dictionary{Identifier: "diseases", Entries: testEntries("malaria", "cholera")}
+	fingerprint := dictionary.Fingerprint()
+
+	dictionary.Log = append(dictionary.Log, DictionaryLog{Type: "wdqs", Query: "SELECT ?item"})
+	if dictionary.Fingerprint() != fingerprint {
+		t.Errorf("Expected the log not to change the fingerprint")
+	}
+
+	for _, changed := range []Dictionary{
+		{Identifier: "diseases", Entries: testEntries("malaria")},
+		{Identifier: "diseases", Entries: testEntries("malaria", "cholera"), Options: DictionaryMatchOptions{FoldCase: true}},
+		{Identifier: "illnesses", Entries: testEntries("malaria", "cholera")},
+	} {
+		if changed.Fingerprint() == fingerprint {
+			t.Errorf("Expected %v to have a different fingerprint", changed)
+		}
+	}
+}
+
+func TestReannotateUploadedPaper(t *testing.T) {
+
+	server := newFakeWikibaseServer()
+	defer server.Close()
+
+	processor, cleanup := newTestProcessor(t)
+	defer cleanup()
+
+	client := newTestScienceSourceClient(t, server, processor.TargetDirectory)
+
+	dictionaries, err := LoadDictionariesFromDirectory(path.Join("testdata", "dictionaries"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = processor.ProcessPaper(context.Background(), dictionaries, client)
+	if err != nil {
+		t.Fatalf("Failed to process paper: %v", err)
+	}
+	original, err := LoadScienceSourceArticle(processor.targetScienceSourceStateFileName())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff, err := processor.ReannotatePaper(dictionaries, true); err != nil || diff != nil {
+		t.Fatalf("Expected paper not to be stale, got %v, %v", diff, err)
+	}
+
+	// Swap pneumonia for children in the dictionary
+	updated := Dictionary{Identifier: dictionaries[0].Identifier, Entries: []DictionaryEntry{
+		dictionaries[0].Entries[0],
+		dictionaries[0].Entries[1],
+		{Name: "child", Term: "children", Identifiers: DictionaryEntryIdentifiers{WikiData: "Q7569"}},
+	}}
+	err = updated.prepareMatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without apply we only get told what would change
+	diff, err := processor.ReannotatePaper([]Dictionary{updated}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff == nil || len(diff.Added) != 1 || len(diff.Removed) != 1 {
+		t.Fatalf("Expected one annotation added and one removed, got %v", diff)
+	}
+	if diff.Added[0].TermFound != "children" || diff.Removed[0].TermFound != "pneumonia" || len(diff.Removed[0].ID) == 0 {
+		t.Errorf("Unexpected diff %v", diff)
+	}
+
+	data, err := ioutil.ReadFile(processor.targetAnnotationDiffFileName())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved AnnotationDiff
+	err = json.Unmarshal(data, &saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Applied || len(saved.Added) != 1 || saved.Current[0].Fingerprint != updated.Fingerprint() {
+		t.Errorf("Unexpected saved diff %v", saved)
+	}
+
+	unchanged, err := LoadScienceSourceArticle(processor.targetScienceSourceStateFileName())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !unchanged.ClaimsUploaded || len(unchanged.Annotations) != len(original.Annotations) {
+		t.Errorf("Expected the paper state to be left alone")
+	}
+
+	// Now apply it, and upload the changes
+	_, err = processor.ReannotatePaper([]Dictionary{updated}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	article, err := LoadScienceSourceArticle(processor.targetScienceSourceStateFileName())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if article.ClaimsUploaded {
+		t.Errorf("Expected the paper to need uploading again")
+	}
+
+	kept := make(map[wikibase.ItemPropertyType]bool)
+	for _, anchor := range article.Annotations {
+		kept[anchor.ID] = true
+		kept[anchor.Annotation.ID] = true
+	}
+	var pneumonia ScienceSourceAnchorPoint
+	for _, anchor := range original.Annotations {
+		if anchor.Annotation.TermFound == "pneumonia" {
+			pneumonia = anchor
+		} else if !kept[anchor.ID] || !kept[anchor.Annotation.ID] {
+			t.Errorf("Expected the items for %s at %d to be kept", anchor.Annotation.TermFound, anchor.CharacterNumber)
+		}
+	}
+	if len(article.RetiredItems) != 2 || article.RetiredItems[0] != pneumonia.ID || article.RetiredItems[1] != pneumonia.Annotation.ID {
+		t.Errorf("Expected the pneumonia items to be retired, got %v", article.RetiredItems)
+	}
+
+	entities := len(server.Entities)
+	err = processor.ProcessPaper(context.Background(), []Dictionary{updated}, client)
+	if err != nil {
+		t.Fatalf("Failed to upload changes: %v", err)
+	}
+	if len(server.Entities) != entities+2 {
+		t.Errorf("Expected an anchor point and annotation to be created, got %d new entities", len(server.Entities)-entities)
+	}
+
+	article, err = LoadScienceSourceArticle(processor.targetScienceSourceStateFileName())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !article.ClaimsUploaded {
+		t.Errorf("Expected the paper to be uploaded")
+	}
+	for i, anchor := range article.Annotations {
+		if anchor.Annotation.TermFound == "children" {
+			values := server.claimValues(string(anchor.Annotation.ID), "preferred label")
+			if len(values) != 1 || values[0] != "child" {
+				t.Errorf("Expected new annotation to have preferred label child, got %v", values)
+			}
+		}
+		// Kept items have had their claims set again, so it's the latest value that counts
+		if i > 0 {
+			values := server.claimValues(string(anchor.ID), "preceding anchor point")
+			if len(values) == 0 || values[len(values)-1] != string(article.Annotations[i-1].ID) {
+				t.Errorf("Expected anchor point %d to follow on from %s, got %v", i, article.Annotations[i-1].ID, values)
+			}
+		}
+	}
+
+	// The retired items are no longer linked into the article, but are still what they were
+	for _, id := range article.RetiredItems {
+		for _, property := range []string{"anchor point in", "preceding anchor point", "following anchor point", "anchors", "based on"} {
+			if values := server.claimValues(string(id), property); len(values) != 0 {
+				t.Errorf("Expected retired item %s to have no %s claims, got %v", id, property, values)
+			}
+		}
+		if values := server.claimValues(string(id), "instance of"); len(values) == 0 {
+			t.Errorf("Expected retired item %s to still say what it is", id)
+		}
+	}
+	for _, anchor := range article.Annotations {
+		values := server.claimValues(string(anchor.ID), "preceding anchor point")
+		if len(values) > 0 && values[len(values)-1] == string(pneumonia.ID) {
+			t.Errorf("Expected no anchor point to follow on from the retired one")
+		}
+	}
+
+	if problems := processor.Verify(); len(problems) != 0 {
+		t.Errorf("Verify found problems: %v", problems)
+	}
+}
+
+func TestReannotatePaperWithoutPreferredLabels(t *testing.T) {
+
+	processor, cleanup := newTestUploadedProcessor(t)
+	defer cleanup()
+
+	dictionaries, err := LoadDictionariesFromDirectory(path.Join("testdata", "dictionaries"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Make the record look like one from before we recorded preferred labels or dictionaries
+	original, err := LoadScienceSourceArticle(processor.targetScienceSourceStateFileName())
+	if err != nil {
+		t.Fatal(err)
+	}
+	original.Dictionaries = nil
+	for i := range original.Annotations {
+		for _, annotation := range original.Annotations[i].allAnnotations() {
+			annotation.PreferredLabel = nil
+		}
+	}
+	err = original.Save(processor.targetScienceSourceStateFileName())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diff, err := processor.ReannotatePaper(dictionaries, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff == nil || !diff.IsEmpty() {
+		t.Errorf("Expected no annotations to change, got %v", diff)
+	}
+
+	article, err := LoadScienceSourceArticle(processor.targetScienceSourceStateFileName())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(article.RetiredItems) != 0 {
+		t.Errorf("Expected no items to be retired, got %v", article.RetiredItems)
+	}
+	if len(article.Annotations) != len(original.Annotations) {
+		t.Fatalf("Expected %d annotations, got %d", len(original.Annotations), len(article.Annotations))
+	}
+	for i, anchor := range article.Annotations {
+		if anchor.ID != original.Annotations[i].ID || anchor.Annotation.ID != original.Annotations[i].Annotation.ID {
+			t.Errorf("Expected anchor point %d to keep its items", i)
+		}
+	}
+	if !article.ClaimsUploaded {
+		t.Errorf("Expected the paper not to need uploading again")
+	}
+}
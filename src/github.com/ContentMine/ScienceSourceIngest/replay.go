@@ -0,0 +1,174 @@
+//   Copyright 2018 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// RecordReplayTransport lets us capture real responses from Europe PMC into a fixtures
+// directory, and later serve them back without touching the network. Each response is stored
+// as two files: the body, so it is easy to inspect, and a small JSON file with the status code
+// and headers.
+
+type RecordReplayMode int
+
+const (
+	RecordMode RecordReplayMode = iota
+	ReplayMode
+)
+
+type RecordReplayTransport struct {
+	Mode      RecordReplayMode
+	Directory string
+
+	// Used to make the real requests when recording, defaults to http.DefaultTransport
+	Transport http.RoundTripper
+}
+
+type recordedResponse struct {
+	URL        string      `json:"url"`
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header"`
+}
+
+var fixtureNameUnsafe = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// fixtureName turns a request into a file name, using the last parts of the path, as for Europe
+// PMC that is the paper ID and resource type, e.g., PMC1234567_fullTextXML.
+func fixtureName(req *http.Request) string {
+	name := fixtureNameUnsafe.ReplaceAllString(strings.Trim(req.URL.Path, "/"), "_")
+	parts := strings.Split(name, "_")
+	if len(parts) > 2 {
+		name = strings.Join(parts[len(parts)-2:], "_")
+	}
+	if len(req.URL.RawQuery) > 0 {
+		name = fmt.Sprintf("%s_%x", name, sha1.Sum([]byte(req.URL.RawQuery)))
+	}
+	if req.Method != http.MethodGet {
+		name = req.Method + "_" + name
+	}
+	return name
+}
+
+// ReplayMissError is returned when replaying a request we have no recording of. Asking again
+// won't help, so this should not be retried.
+type ReplayMissError struct {
+	URL string
+}
+
+func (e *ReplayMissError) Error() string {
+	return fmt.Sprintf("No recorded response for %s", e.URL)
+}
+
+func (t *RecordReplayTransport) fixturePaths(req *http.Request) (string, string) {
+	name := fixtureName(req)
+	return path.Join(t.Directory, name+".body"), path.Join(t.Directory, name+".json")
+}
+
+func (t *RecordReplayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	switch t.Mode {
+	case RecordMode:
+		return t.record(req)
+	case ReplayMode:
+		return t.replay(req)
+	default:
+		return nil, fmt.Errorf("Unknown record/replay mode %d", t.Mode)
+	}
+}
+
+func (t *RecordReplayTransport) record(req *http.Request) (*http.Response, error) {
+
+	transport := t.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(t.Directory, 0755)
+	if err != nil {
+		return nil, err
+	}
+	bodyPath, metaPath := t.fixturePaths(req)
+	err = ioutil.WriteFile(bodyPath, body, 0644)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := json.MarshalIndent(recordedResponse{
+		URL:        req.URL.String(),
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+	}, "", "    ")
+	if err != nil {
+		return nil, err
+	}
+	err = ioutil.WriteFile(metaPath, meta, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
+
+func (t *RecordReplayTransport) replay(req *http.Request) (*http.Response, error) {
+
+	bodyPath, metaPath := t.fixturePaths(req)
+
+	data, err := ioutil.ReadFile(metaPath)
+	if err != nil {
+		return nil, &ReplayMissError{URL: req.URL.String()}
+	}
+	var meta recordedResponse
+	err = json.Unmarshal(data, &meta)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read recorded response %s: %v", metaPath, err)
+	}
+	body, err := ioutil.ReadFile(bodyPath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read recorded response %s: %v", bodyPath, err)
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", meta.StatusCode, http.StatusText(meta.StatusCode)),
+		StatusCode:    meta.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        meta.Header,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
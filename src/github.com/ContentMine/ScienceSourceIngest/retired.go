@@ -0,0 +1,174 @@
+//   Copyright 2018 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ContentMine/wikibase"
+)
+
+// When re-annotating drops an anchor point or annotation its items are left on the wiki, as
+// someone may have linked to them, but they still claim to be in the article and to precede and
+// follow other anchor points. So when uploading we remove any claims on retired items that point
+// at the article's items, or at each other, which takes them out of the article's graph while
+// leaving what they are an instance of alone.
+
+// linkedItemTargets is every item a retired item could link to as part of the article
+func (article *ScienceSourceArticle) linkedItemTargets(terminus wikibase.ItemPropertyType) map[wikibase.ItemPropertyType]bool {
+
+	targets := make(map[wikibase.ItemPropertyType]bool)
+	add := func(id wikibase.ItemPropertyType) {
+		if len(id) > 0 {
+			targets[id] = true
+		}
+	}
+
+	add(article.ID)
+	add(terminus)
+	for _, anchor := range article.Annotations {
+		add(anchor.ID)
+		for _, annotation := range anchor.allAnnotations() {
+			add(annotation.ID)
+		}
+	}
+	for _, id := range article.RetiredItems {
+		add(id)
+	}
+	return targets
+}
+
+// UnlinkRetiredItems removes the claims linking the article's retired items into its graph.
+// Removing claims that have already gone does nothing, so this can safely be run again.
+func (c *ScienceSourceClient) UnlinkRetiredItems(article *ScienceSourceArticle) error {
+
+	if len(article.RetiredItems) == 0 {
+		return nil
+	}
+
+	targets := article.linkedItemTargets(c.wikiBaseClient.ItemForLabel("terminus"))
+	for _, id := range article.RetiredItems {
+		err := c.wikiBaseClient.RemoveItemLinks(id, targets)
+		if err != nil {
+			return fmt.Errorf("Failed to unlink retired item %s: %v", id, err)
+		}
+	}
+	return nil
+}
+
+// The wikibase library doesn't remove claims, so we talk to the API directly for this
+
+type wikibaseAPIResponse struct {
+	Error *wikibase.APIError `json:"error"`
+}
+
+func (n networkWikibaseClient) call(post bool, args map[string]string, response interface{}) error {
+
+	args["format"] = "json"
+	var err error
+	var body io.ReadCloser
+	if post {
+		body, err = n.network.Post(args)
+	} else {
+		body, err = n.network.Get(args)
+	}
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	var raw json.RawMessage
+	err = json.NewDecoder(body).Decode(&raw)
+	if err != nil {
+		return err
+	}
+	var apiResponse wikibaseAPIResponse
+	if err := json.Unmarshal(raw, &apiResponse); err == nil && apiResponse.Error != nil {
+		return apiResponse.Error
+	}
+	return json.Unmarshal(raw, response)
+}
+
+// itemClaimValue is the value of a claim that refers to another item
+type itemClaimValue struct {
+	EntityType string `json:"entity-type"`
+	NumericID  int    `json:"numeric-id"`
+	ID         string `json:"id"`
+}
+
+func (value itemClaimValue) item() wikibase.ItemPropertyType {
+	if len(value.ID) > 0 {
+		return wikibase.ItemPropertyType(value.ID)
+	}
+	if value.NumericID > 0 {
+		return wikibase.ItemPropertyType(fmt.Sprintf("Q%d", value.NumericID))
+	}
+	return ""
+}
+
+func (n networkWikibaseClient) RemoveItemLinks(item wikibase.ItemPropertyType, targets map[wikibase.ItemPropertyType]bool) error {
+
+	var entities struct {
+		Entities map[string]struct {
+			Claims map[string][]struct {
+				ID       string `json:"id"`
+				MainSnak struct {
+					DataValue struct {
+						Value json.RawMessage `json:"value"`
+					} `json:"datavalue"`
+				} `json:"mainsnak"`
+			} `json:"claims"`
+		} `json:"entities"`
+	}
+	err := n.call(false, map[string]string{"action": "wbgetentities", "ids": string(item), "props": "claims"}, &entities)
+	if err != nil {
+		return err
+	}
+
+	claims := make([]string, 0)
+	for _, list := range entities.Entities[string(item)].Claims {
+		for _, claim := range list {
+			var value itemClaimValue
+			if json.Unmarshal(claim.MainSnak.DataValue.Value, &value) == nil && targets[value.item()] {
+				claims = append(claims, claim.ID)
+			}
+		}
+	}
+	if len(claims) == 0 {
+		return nil
+	}
+
+	var tokens struct {
+		Query struct {
+			Tokens struct {
+				CSRFToken string `json:"csrftoken"`
+			} `json:"tokens"`
+		} `json:"query"`
+	}
+	err = n.call(false, map[string]string{"action": "query", "meta": "tokens"}, &tokens)
+	if err != nil {
+		return err
+	}
+
+	var removed interface{}
+	return n.call(true, map[string]string{
+		"action": "wbremoveclaims",
+		"claim":  strings.Join(claims, "|"),
+		"token":  tokens.Query.Tokens.CSRFToken,
+	}, &removed)
+}
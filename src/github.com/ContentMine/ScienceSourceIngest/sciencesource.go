@@ -15,9 +15,10 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
-	"os"
 	"time"
 
 	"github.com/ContentMine/wikibase"
@@ -33,6 +34,7 @@ type ScienceSourceAnnotation struct {
 
 	// These fields we know beforehand
 	TermFound         string    `json:"term" property:"term found"`
+	PreferredLabel    *string   `json:"preferred_label,omitempty" property:"preferred label"`
 	LengthOfTermFound int       `json:"length" property:"length of term found"`
 	WikiDataItemCode  string    `json:"wikidata" property:"Wikidata item code"`
 	DictionaryName    string    `json:"dictionary" property:"dictionary name"`
@@ -54,13 +56,22 @@ type ScienceSourceAnchorPoint struct {
 	wikibase.ItemHeader `json:"item" item:"anchor point"`
 
 	// These fields we know beforehand
-	PrecedingPhrase     string    `json:"preceding_phrase" property:"preceding phrase"`
-	FollowingPhrase     string    `json:"following_phrase" property:"following phrase"`
+	PrecedingPhrase     *string   `json:"preceding_phrase,omitempty" property:"preceding phrase"`
+	FollowingPhrase     *string   `json:"following_phrase,omitempty" property:"following phrase"`
 	DistanceToPreceding *int      `json:"preceding_distance,omitempty" property:"distance to preceding"`
 	DistanceToFollowing *int      `json:"following_distance,omitempty" property:"distance to following"`
 	CharacterNumber     int       `json:"character" property:"character number"`
 	TimeCode            time.Time `json:"time" property:"time code1"`
 
+	// Where the term is on the uploaded page: the path from the page body to the block element
+	// it's in, and how far into that element's text it starts
+	HTMLPath   *string `json:"html_path,omitempty" property:"HTML path"`
+	HTMLOffset *int    `json:"html_offset,omitempty" property:"HTML offset"`
+
+	// The part of the paper the term is in, such as "abstract" or "methods", and its heading
+	SectionType    *string `json:"section_type,omitempty" property:"section type"`
+	SectionHeading *string `json:"section_heading,omitempty" property:"section heading"`
+
 	// These fields we only know from the science source instance
 	InstanceOf wikibase.ItemPropertyType `json:"instance_of" property:"instance of"`
 
@@ -77,6 +88,10 @@ type ScienceSourceAnchorPoint struct {
 
 	// Internal program management
 	Annotation ScienceSourceAnnotation `json:"annotation"`
+
+	// Other matches of exactly the same text, when the overlap policy merges them. These are
+	// based on this anchor point, but it only anchors the main annotation.
+	AdditionalAnnotations []ScienceSourceAnnotation `json:"additional_annotations,omitempty"`
 }
 
 type ScienceSourceArticle struct {
@@ -105,21 +120,86 @@ type ScienceSourceArticle struct {
 	FollowingAnchorPoint wikibase.ItemPropertyType `json:"following_anchor" property:"following anchor point,omitoncreate"`
 
 	// Internal program management
-	Annotations []ScienceSourceAnchorPoint `json:"annotations"`
+	Annotations    []ScienceSourceAnchorPoint `json:"annotations"`
+	ClaimsUploaded bool                       `json:"claims_uploaded,omitempty"`
+
+	// The versions of the dictionaries the annotations were found with
+	Dictionaries []DictionaryVersion `json:"dictionaries,omitempty"`
+	// Items on the wiki that re-annotating has taken out of the article's anchor point chain
+	RetiredItems []wikibase.ItemPropertyType `json:"retired_items,omitempty"`
+	// What the character numbers, lengths, and distances count, with none meaning bytes
+	OffsetUnit OffsetUnit `json:"offset_unit,omitempty"`
+	// The files unpacked from the paper's supplementary archive, if it was fetched
+	SupplementaryFiles []SupplementaryFile `json:"supplementary_files,omitempty"`
 }
 
 // terminus needs looking up too
 
+// WikibaseClient is the subset of the wikibase library we use, pulled out so that we can swap
+// in a stand-in for dry runs.
+type WikibaseClient interface {
+	MapPropertyAndItemConfiguration(item interface{}, createIfMissing bool) error
+	MapItemConfigurationByLabel(label string, createIfMissing bool) error
+	ItemForLabel(label string) wikibase.ItemPropertyType
+
+	CreateOrUpdateArticle(title string, body string) (int, error)
+	ProtectPageByID(pageID int) error
+
+	CreateItemInstance(label string, item interface{}) error
+	UploadClaimsForItem(item interface{}, create bool) error
+	// RemoveItemLinks removes the claims on an item whose values are any of the target items
+	RemoveItemLinks(item wikibase.ItemPropertyType, targets map[wikibase.ItemPropertyType]bool) error
+}
+
+// networkWikibaseClient adapts the wikibase library client to WikibaseClient
+type networkWikibaseClient struct {
+	client  *wikibase.Client
+	network wikibase.NetworkClientInterface
+}
+
+func (n networkWikibaseClient) MapPropertyAndItemConfiguration(item interface{}, createIfMissing bool) error {
+	return n.client.MapPropertyAndItemConfiguration(item, createIfMissing)
+}
+
+func (n networkWikibaseClient) MapItemConfigurationByLabel(label string, createIfMissing bool) error {
+	return n.client.MapItemConfigurationByLabel(label, createIfMissing)
+}
+
+func (n networkWikibaseClient) ItemForLabel(label string) wikibase.ItemPropertyType {
+	return n.client.ItemMap[label]
+}
+
+func (n networkWikibaseClient) CreateOrUpdateArticle(title string, body string) (int, error) {
+	return n.client.CreateOrUpdateArticle(title, body)
+}
+
+func (n networkWikibaseClient) ProtectPageByID(pageID int) error {
+	return n.client.ProtectPageByID(pageID)
+}
+
+func (n networkWikibaseClient) CreateItemInstance(label string, item interface{}) error {
+	return n.client.CreateItemInstance(label, item)
+}
+
+func (n networkWikibaseClient) UploadClaimsForItem(item interface{}, create bool) error {
+	return n.client.UploadClaimsForItem(item, create)
+}
+
 type ScienceSourceClient struct {
-	wikiBaseClient *wikibase.Client
+	wikiBaseClient WikibaseClient
 }
 
 func NewScienceSourceClient(oauthInfo wikibase.OAuthInformation, urlbase string) *ScienceSourceClient {
 
 	oauth_client := wikibase.NewOAuthNetworkClient(oauthInfo, urlbase)
 
+	return NewScienceSourceClientWithWikibase(networkWikibaseClient{client: wikibase.NewClient(oauth_client), network: oauth_client})
+}
+
+func NewScienceSourceClientWithWikibase(wikiBaseClient WikibaseClient) *ScienceSourceClient {
+
 	res := &ScienceSourceClient{
-		wikiBaseClient: wikibase.NewClient(oauth_client),
+		wikiBaseClient: wikiBaseClient,
 	}
 
 	return res
@@ -148,7 +228,11 @@ func (c *ScienceSourceClient) GetConfigurationFromServer() error {
 	return nil
 }
 
-func (c *ScienceSourceClient) UploadPaper(article *ScienceSourceArticle, htmlFileName string) error {
+func (c *ScienceSourceClient) UploadPaper(ctx context.Context, article *ScienceSourceArticle, htmlFileName string) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
 	data, err := ioutil.ReadFile(htmlFileName)
 	if err != nil {
@@ -171,6 +255,7 @@ func (c *ScienceSourceClient) UploadPaper(article *ScienceSourceArticle, htmlFil
 
 	article.PageID = page_id
 
+	// Once the page exists we want to protect it regardless, so don't check ctx here
 	return c.wikiBaseClient.ProtectPageByID(article.PageID)
 }
 
@@ -178,36 +263,114 @@ func (c *ScienceSourceClient) UploadPaper(article *ScienceSourceArticle, htmlFil
 
 func (article *ScienceSourceArticle) Save(filename string) error {
 
-	f, err := os.Create(filename)
+	f, err := CreateAtomic(filename)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
+	defer f.Abort()
 
-	return json.NewEncoder(f).Encode(article)
+	err = json.NewEncoder(f).Encode(article)
+	if err != nil {
+		return err
+	}
+
+	return f.Commit()
+}
+
+// CorruptStateError is returned when a state file exists but can't be trusted, as opposed to
+// one that just isn't there yet.
+type CorruptStateError struct {
+	Filename string
+	Err      error
+}
+
+func (e *CorruptStateError) Error() string {
+	return fmt.Sprintf("State file %s is corrupt: %v", e.Filename, e.Err)
+}
+
+func IsCorruptState(err error) bool {
+	_, ok := err.(*CorruptStateError)
+	return ok
+}
+
+// validate does some basic sanity checks on an article loaded from disk, so that we catch files
+// that are valid JSON but not something we wrote.
+func (article *ScienceSourceArticle) validate() error {
+
+	if len(article.ScienceSourceArticleTitle) == 0 {
+		return fmt.Errorf("Article has no title")
+	}
+
+	if len(article.OffsetUnit) > 0 {
+		if _, err := ParseOffsetUnit(string(article.OffsetUnit)); err != nil {
+			return err
+		}
+	}
+
+	for i, anchor := range article.Annotations {
+		if anchor.CharacterNumber < 0 {
+			return fmt.Errorf("Annotation %d has negative offset %d", i, anchor.CharacterNumber)
+		}
+		if len(anchor.Annotation.TermFound) == 0 || anchor.Annotation.LengthOfTermFound <= 0 {
+			return fmt.Errorf("Annotation %d has no term", i)
+		}
+		for _, annotation := range anchor.AdditionalAnnotations {
+			if len(annotation.TermFound) == 0 || annotation.LengthOfTermFound <= 0 {
+				return fmt.Errorf("Additional annotation on anchor point %d has no term", i)
+			}
+		}
+	}
+
+	if article.ClaimsUploaded && (article.PageID == 0 || len(article.ID) == 0) {
+		return fmt.Errorf("Article is marked as uploaded but has no page or item ID")
+	}
+
+	return nil
 }
 
 func LoadScienceSourceArticle(filename string) (*ScienceSourceArticle, error) {
 
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
 	var article ScienceSourceArticle
+	err = json.Unmarshal(data, &article)
+	if err != nil {
+		return nil, &CorruptStateError{Filename: filename, Err: err}
+	}
 
-	f, err := os.Open(filename)
+	err = article.validate()
 	if err != nil {
-		return nil, err
+		return nil, &CorruptStateError{Filename: filename, Err: err}
 	}
 
-	err = json.NewDecoder(f).Decode(&article)
-	return &article, err
+	return &article, nil
 }
 
 // Wiki base item related code
 
-func (c *ScienceSourceClient) CreateArticleItemTree(article *ScienceSourceArticle) error {
+// CreateArticleItemTree creates any items for the article that don't already exist. The wiki
+// calls can't be undone, so saveProgress is called after each item is created to record its
+// ID, and if ctx is cancelled we stop between items rather than part way through one.
+func (c *ScienceSourceClient) CreateArticleItemTree(ctx context.Context, article *ScienceSourceArticle, saveProgress func() error) error {
+
+	createItem := func(label string, item interface{}) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := c.wikiBaseClient.CreateItemInstance(label, item)
+		if err != nil {
+			return err
+		}
+		return saveProgress()
+	}
 
 	// Create the node for the article in the wiki base if necessary
-	article.InstanceOf = c.wikiBaseClient.ItemMap["article"]
+	article.InstanceOf = c.wikiBaseClient.ItemForLabel("article")
 	if len(article.ID) == 0 {
-		err := c.wikiBaseClient.CreateItemInstance("article instance", article)
+		err := createItem("article instance", article)
 		if err != nil {
 			return err
 		}
@@ -215,22 +378,33 @@ func (c *ScienceSourceClient) CreateArticleItemTree(article *ScienceSourceArticl
 
 	// Create an item for all the anchors and their articles
 	for i := 0; i < len(article.Annotations); i++ {
-		article.Annotations[i].InstanceOf = c.wikiBaseClient.ItemMap["anchor point"]
+		article.Annotations[i].InstanceOf = c.wikiBaseClient.ItemForLabel("anchor point")
 
 		if len(article.Annotations[i].ID) == 0 {
-			err := c.wikiBaseClient.CreateItemInstance("anchor instance", &(article.Annotations[i]))
+			err := createItem("anchor instance", &(article.Annotations[i]))
 			if err != nil {
 				return err
 			}
 		}
 
-		article.Annotations[i].Annotation.InstanceOf = c.wikiBaseClient.ItemMap["annotation"]
+		article.Annotations[i].Annotation.InstanceOf = c.wikiBaseClient.ItemForLabel("annotation")
 		if len(article.Annotations[i].Annotation.ID) == 0 {
-			err := c.wikiBaseClient.CreateItemInstance("annotation instance", &(article.Annotations[i].Annotation))
+			err := createItem("annotation instance", &(article.Annotations[i].Annotation))
 			if err != nil {
 				return err
 			}
 		}
+
+		for j := range article.Annotations[i].AdditionalAnnotations {
+			annotation := &(article.Annotations[i].AdditionalAnnotations[j])
+			annotation.InstanceOf = c.wikiBaseClient.ItemForLabel("annotation")
+			if len(annotation.ID) == 0 {
+				err := createItem("annotation instance", annotation)
+				if err != nil {
+					return err
+				}
+			}
+		}
 	}
 
 	return nil
@@ -240,7 +414,7 @@ func (c *ScienceSourceClient) ReconsileArticleItemTree(article *ScienceSourceArt
 
 	// Patch the article first
 	if len(article.Annotations) == 0 {
-		article.FollowingAnchorPoint = c.wikiBaseClient.ItemMap["terminus"]
+		article.FollowingAnchorPoint = c.wikiBaseClient.ItemForLabel("terminus")
 	} else {
 		article.FollowingAnchorPoint = article.Annotations[0].ID
 	}
@@ -256,34 +430,52 @@ func (c *ScienceSourceClient) ReconsileArticleItemTree(article *ScienceSourceArt
 		if i != len(article.Annotations)-1 {
 			article.Annotations[i].FollowingAnchorPoint = article.Annotations[i+1].ID
 		} else {
-			article.Annotations[i].FollowingAnchorPoint = c.wikiBaseClient.ItemMap["terminus"]
+			article.Annotations[i].FollowingAnchorPoint = c.wikiBaseClient.ItemForLabel("terminus")
 		}
 		article.Annotations[i].AnchorPoint = article.ID
 		article.Annotations[i].Anchors = article.Annotations[i].Annotation.ID
 
 		// Patch annotation second
 		article.Annotations[i].Annotation.BasedOn = article.Annotations[i].ID
+		for j := range article.Annotations[i].AdditionalAnnotations {
+			article.Annotations[i].AdditionalAnnotations[j].BasedOn = article.Annotations[i].ID
+		}
 	}
 
 	return nil
 }
 
-func (c *ScienceSourceClient) PopulateAritcleItemTree(article *ScienceSourceArticle) error {
+// PopulateAritcleItemTree uploads the claims for every item. Setting claims can safely be
+// repeated, so if ctx is cancelled we just stop and leave it all to be done again next time.
+func (c *ScienceSourceClient) PopulateAritcleItemTree(ctx context.Context, article *ScienceSourceArticle) error {
+
+	uploadClaims := func(item interface{}) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return c.wikiBaseClient.UploadClaimsForItem(item, false)
+	}
 
-	err := c.wikiBaseClient.UploadClaimsForItem(article, false)
+	err := uploadClaims(article)
 	if err != nil {
 		return err
 	}
 
 	for i := 0; i < len(article.Annotations); i++ {
-		err := c.wikiBaseClient.UploadClaimsForItem(&article.Annotations[i], false)
+		err := uploadClaims(&article.Annotations[i])
 		if err != nil {
 			return err
 		}
-		err = c.wikiBaseClient.UploadClaimsForItem(&(article.Annotations[i].Annotation), false)
+		err = uploadClaims(&(article.Annotations[i].Annotation))
 		if err != nil {
 			return err
 		}
+		for j := range article.Annotations[i].AdditionalAnnotations {
+			err = uploadClaims(&(article.Annotations[i].AdditionalAnnotations[j]))
+			if err != nil {
+				return err
+			}
+		}
 	}
 
 	return nil
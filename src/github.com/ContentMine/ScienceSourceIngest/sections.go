@@ -0,0 +1,223 @@
+//   Copyright 2018 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// paper.txt is one run of text, but a term in the title means something different to one in
+// the methods or a figure caption. When converting we work out which part of the paper each bit
+// of the text came from and save the boundaries, so anchor points can say which section they're
+// in and whole sections can be left out of the mining.
+
+// Section types we give to the parts of a paper. Body sections use their JATS sec-type instead
+// if they have one, such as "methods" or "results", inheriting it from the section they're in
+// if they don't.
+const (
+	SectionTitle           string = "title"
+	SectionAbstract        string = "abstract"
+	SectionFront           string = "front"
+	SectionBody            string = "body"
+	SectionSection         string = "section"
+	SectionFigure          string = "fig"
+	SectionTable           string = "table"
+	SectionAcknowledgement string = "ack"
+	SectionReferences      string = "ref-list"
+	SectionBack            string = "back"
+)
+
+// A TextSection is a run of paper.txt from one part of the paper
+type TextSection struct {
+	// Where the section is in paper.txt, in bytes
+	Offset  int    `json:"offset"`
+	Length  int    `json:"length"`
+	Type    string `json:"type"`
+	Heading string `json:"heading,omitempty"`
+
+	// The element the section is from, so we can tell neighbouring sections of the same type apart
+	element *jatsNode
+}
+
+type TextSections struct {
+	// The length of paper.txt in bytes, so we can tell if these are for a different version
+	TextLength int           `json:"text_length"`
+	Sections   []TextSection `json:"sections"`
+}
+
+// jatsLabel gets the label of a figure or table, falling back to the caption title
+func jatsLabel(n *jatsNode) string {
+	if label := n.firstChild("label"); label != nil {
+		return strings.TrimSpace(label.stringValue())
+	}
+	if caption := n.firstChild("caption"); caption != nil {
+		if title := caption.firstChild("title"); title != nil {
+			return strings.TrimSpace(title.stringValue())
+		}
+	}
+	return ""
+}
+
+// jatsSection finds which part of the paper a node is in, going by its innermost enclosing
+// section, figure, or table
+func jatsSection(n *jatsNode) TextSection {
+
+	for node := n; node != nil; node = node.Parent {
+		switch {
+		case node.is("fig"):
+			return TextSection{Type: SectionFigure, Heading: jatsLabel(node), element: node}
+		case node.is("table-wrap"):
+			return TextSection{Type: SectionTable, Heading: jatsLabel(node), element: node}
+		case node.is("sec"):
+			section := TextSection{Type: SectionSection, element: node}
+			if title := node.firstChild("title"); title != nil {
+				section.Heading = strings.TrimSpace(title.stringValue())
+			}
+			// Sections in the abstract are still the abstract
+			for sec := node; sec != nil; sec = sec.Parent {
+				if sec.is("sec") && len(sec.attrValue("sec-type")) > 0 {
+					section.Type = sec.attrValue("sec-type")
+					break
+				}
+				if sec.is("abstract") {
+					section.Type = SectionAbstract
+					break
+				}
+			}
+			return section
+		case node.is("abstract"):
+			heading := "Abstract"
+			if abstractType := node.attrValue("abstract-type"); len(abstractType) > 0 {
+				heading = abstractType
+			}
+			return TextSection{Type: SectionAbstract, Heading: heading, element: node}
+		case node.is("title-group") && node.parentIs("article-meta"):
+			return TextSection{Type: SectionTitle, element: node}
+		case node.is("ack"):
+			return TextSection{Type: SectionAcknowledgement, Heading: "Acknowledgements", element: node}
+		case node.is("ref-list"):
+			return TextSection{Type: SectionReferences, Heading: "References", element: node}
+		case node.is("front"):
+			return TextSection{Type: SectionFront, element: node}
+		case node.is("body"):
+			return TextSection{Type: SectionBody, element: node}
+		case node.is("back"):
+			return TextSection{Type: SectionBack, element: node}
+		}
+	}
+	return TextSection{Type: SectionFront}
+}
+
+// buildTextSections splits the text result up by the part of the paper each bit came from
+func buildTextSections(text *resultNode) TextSections {
+
+	sections := make([]TextSection, 0)
+	offset := 0
+
+	var walk func(n *resultNode)
+	walk = func(n *resultNode) {
+		if len(n.Text) > 0 {
+			section := jatsSection(n.Origin)
+			last := len(sections) - 1
+			if last >= 0 && sections[last].element == section.element && sections[last].Type == section.Type {
+				sections[last].Length += len(n.Text)
+			} else {
+				section.Offset = offset
+				section.Length = len(n.Text)
+				sections = append(sections, section)
+			}
+			offset += len(n.Text)
+		}
+		for _, child := range n.Children {
+			walk(child)
+		}
+	}
+	walk(text)
+
+	return TextSections{TextLength: offset, Sections: sections}
+}
+
+// at finds the section that the byte offset is in
+func (sections TextSections) at(offset int) *TextSection {
+	i := sort.Search(len(sections.Sections), func(i int) bool {
+		return sections.Sections[i].Offset+sections.Sections[i].Length > offset
+	})
+	if i == len(sections.Sections) || sections.Sections[i].Offset > offset {
+		return nil
+	}
+	return &sections.Sections[i]
+}
+
+func (sections TextSections) validFor(prose []byte) bool {
+	if sections.TextLength != len(prose) {
+		return false
+	}
+	for _, section := range sections.Sections {
+		if section.Offset < 0 || section.Offset+section.Length > len(prose) {
+			return false
+		}
+	}
+	return true
+}
+
+func (sections TextSections) Save(filename string) error {
+	data, err := json.Marshal(sections)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(filename, data)
+}
+
+func LoadTextSections(filename string) (*TextSections, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var sections TextSections
+	err = json.Unmarshal(data, &sections)
+	if err != nil {
+		return nil, err
+	}
+	return &sections, nil
+}
+
+// excludeSections drops matches that start in any of the given types of section
+func excludeSections(matches []DictionaryMatch, sections *TextSections, excluded []string) []DictionaryMatch {
+
+	if sections == nil || len(excluded) == 0 {
+		return matches
+	}
+
+	res := make([]DictionaryMatch, 0, len(matches))
+	for _, match := range matches {
+		section := sections.at(match.Offset)
+		skip := false
+		if section != nil {
+			for _, sectionType := range excluded {
+				if strings.EqualFold(section.Type, sectionType) {
+					skip = true
+					break
+				}
+			}
+		}
+		if !skip {
+			res = append(res, match)
+		}
+	}
+	return res
+}
@@ -0,0 +1,164 @@
+//   Copyright 2018 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"path"
+	"strings"
+	"testing"
+)
+
+func expectSection(t *testing.T, sections TextSections, prose string, term string, sectionType string, heading string) {
+	t.Helper()
+
+	offset := strings.LastIndex(prose, term)
+	if offset < 0 {
+		t.Fatalf("Expected %s in the text", term)
+	}
+	section := sections.at(offset)
+	if section == nil {
+		t.Errorf("Expected %s to be in a section", term)
+		return
+	}
+	if section.Type != sectionType || section.Heading != heading {
+		t.Errorf("Expected %s in %s %q, got %s %q", term, sectionType, heading, section.Type, section.Heading)
+	}
+}
+
+func TestTextSections(t *testing.T) {
+
+	filename := path.Join("testdata", "PMC1234567.xml")
+	converter := NativeConverter{}
+
+	var text bytes.Buffer
+	if err := converter.ConvertToText(filename, &text); err != nil {
+		t.Fatal(err)
+	}
+	sections, err := converter.SectionText(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sections.validFor(text.Bytes()) {
+		t.Fatalf("Expected sections to be valid for the text")
+	}
+
+	prose := text.String()
+	expectSection(t, sections, prose, "rural", SectionTitle, "")
+	expectSection(t, sections, prose, "pneumonia", SectionAbstract, "Abstract")
+	expectSection(t, sections, prose, "Introduction", "intro", "Introduction")
+	expectSection(t, sections, prose, "common", "intro", "Introduction")
+	expectSection(t, sections, prose, "cholera", SectionSection, "Methods")
+	expectSection(t, sections, prose, "aciclovir", SectionSection, "Methods")
+	expectSection(t, sections, prose, "cell", SectionTable, "")
+
+	// The sections cover all the text, in order
+	offset := 0
+	for _, section := range sections.Sections {
+		if section.Offset != offset {
+			t.Errorf("Expected section at %d, got %d", offset, section.Offset)
+		}
+		offset += section.Length
+	}
+	if offset != len(prose) {
+		t.Errorf("Expected sections to cover %d bytes, got %d", len(prose), offset)
+	}
+}
+
+func TestTextSectionsNested(t *testing.T) {
+
+	doc, err := parseJATSDocument(strings.NewReader(`<article><front><article-meta>
+<abstract abstract-type="summary"><sec><title>Background</title><p>Early text.</p></sec></abstract>
+</article-meta></front><body>
+<sec sec-type="results"><title>Results</title><p>Result text.</p>
+<sec><title>Subgroups</title><p>Nested text.</p>
+<fig><label>Figure 1</label><caption><p>Caption text.</p></caption></fig>
+</sec></sec>
+<sec sec-type="methods"><title>Methods</title><p>Method text.</p></sec>
+</body></article>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := newJATSTransformer(doc, true).transform()
+	sections := buildTextSections(text)
+	prose := text.textContent()
+
+	expectSection(t, sections, prose, "Early", SectionAbstract, "Background")
+	expectSection(t, sections, prose, "Result", "results", "Results")
+	expectSection(t, sections, prose, "Nested", "results", "Subgroups")
+	expectSection(t, sections, prose, "Caption", SectionFigure, "Figure 1")
+	expectSection(t, sections, prose, "Method", "methods", "Methods")
+}
+
+func TestAnnotationSections(t *testing.T) {
+
+	processor, cleanup := newTestProcessor(t)
+	defer cleanup()
+
+	dictionaries, err := LoadDictionariesFromDirectory(path.Join("testdata", "dictionaries"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = processor.ConvertPaper(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = processor.AnnotatePaper(dictionaries, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	article, err := LoadScienceSourceArticle(processor.targetScienceSourceStateFileName())
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := make(map[string]bool)
+	for _, anchor := range article.Annotations {
+		if anchor.SectionType == nil {
+			t.Errorf("Expected %s to have a section", anchor.Annotation.TermFound)
+			continue
+		}
+		found[*anchor.SectionType] = true
+		if anchor.Annotation.TermFound == "cholera" && *anchor.SectionType == SectionSection {
+			if anchor.SectionHeading == nil || *anchor.SectionHeading != "Methods" {
+				t.Errorf("Expected cholera in methods to have the heading Methods")
+			}
+		}
+	}
+	for _, sectionType := range []string{SectionTitle, SectionAbstract, "intro", SectionSection} {
+		if !found[sectionType] {
+			t.Errorf("Expected an annotation in %s", sectionType)
+		}
+	}
+
+	// Leaving out the abstract and the methods
+	processor.Annotation.ExcludeSections = []string{"Abstract", SectionSection}
+	err = processor.AnnotatePaper(dictionaries, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	article, err = LoadScienceSourceArticle(processor.targetScienceSourceStateFileName())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(article.Annotations) == 0 {
+		t.Fatalf("Expected some annotations to be left")
+	}
+	for _, anchor := range article.Annotations {
+		if anchor.SectionType != nil && (*anchor.SectionType == SectionAbstract || *anchor.SectionType == SectionSection) {
+			t.Errorf("Expected no annotations in %s, found %s", *anchor.SectionType, anchor.Annotation.TermFound)
+		}
+	}
+}
@@ -0,0 +1,660 @@
+//   Copyright 2018 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// SKOS vocabularies, in either Turtle or RDF/XML. Both are read into a list of triples, and each
+// concept with a label becomes an entry. The entry is named after its untagged or English
+// prefLabel if it has one, and all its other prefLabels, altLabels, and hiddenLabels are synonyms.
+// A skos:exactMatch or owl:sameAs to a Wikidata entity gives the entry's Wikidata ID.
+
+const (
+	rdfNamespace  string = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+	skosNamespace string = "http://www.w3.org/2004/02/skos/core#"
+	owlNamespace  string = "http://www.w3.org/2002/07/owl#"
+	xmlNamespace  string = "http://www.w3.org/XML/1998/namespace"
+)
+
+type rdfTerm struct {
+	Value    string
+	Language string
+	Literal  bool
+}
+
+type rdfTriple struct {
+	Subject   string
+	Predicate string
+	Object    rdfTerm
+}
+
+type skosConcept struct {
+	labels   []rdfTerm
+	synonyms []string
+	wikidata string
+	ignore   bool
+}
+
+func loadTurtleDictionary(filename string) (Dictionary, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return Dictionary{}, err
+	}
+	triples, err := parseTurtle(data)
+	if err != nil {
+		return Dictionary{}, err
+	}
+	return skosDictionary(dictionaryIdentifierFromFileName(filename), triples), nil
+}
+
+func loadRDFXMLDictionary(filename string) (Dictionary, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return Dictionary{}, err
+	}
+	triples, err := parseRDFXML(data)
+	if err != nil {
+		return Dictionary{}, err
+	}
+	return skosDictionary(dictionaryIdentifierFromFileName(filename), triples), nil
+}
+
+func isWikidataEntity(uri string) bool {
+	return strings.Contains(uri, "wikidata.org/entity/") || strings.Contains(uri, "wikidata.org/wiki/")
+}
+
+func skosDictionary(identifier string, triples []rdfTriple) Dictionary {
+
+	subjects := make([]string, 0)
+	concepts := make(map[string]*skosConcept)
+
+	for _, triple := range triples {
+		concept, prs := concepts[triple.Subject]
+		if !prs {
+			concept = &skosConcept{}
+			concepts[triple.Subject] = concept
+			subjects = append(subjects, triple.Subject)
+		}
+
+		switch triple.Predicate {
+		case skosNamespace + "prefLabel":
+			if triple.Object.Literal {
+				concept.labels = append(concept.labels, triple.Object)
+			}
+		case skosNamespace + "altLabel", skosNamespace + "hiddenLabel":
+			if triple.Object.Literal {
+				concept.synonyms = append(concept.synonyms, triple.Object.Value)
+			}
+		case skosNamespace + "exactMatch", owlNamespace + "sameAs":
+			if !triple.Object.Literal && isWikidataEntity(triple.Object.Value) {
+				concept.wikidata = wikidataIDFromURI(triple.Object.Value)
+			}
+		case rdfNamespace + "type":
+			// Schemes and collections can have labels too, but they're not things to annotate
+			switch triple.Object.Value {
+			case skosNamespace + "ConceptScheme", skosNamespace + "Collection", skosNamespace + "OrderedCollection":
+				concept.ignore = true
+			}
+		}
+	}
+
+	builder := newDictionaryBuilder(identifier)
+
+	for _, subject := range subjects {
+		concept := concepts[subject]
+		if concept.ignore {
+			continue
+		}
+
+		name := ""
+		for _, language := range []string{"", "en"} {
+			for _, label := range concept.labels {
+				if len(name) == 0 && strings.ToLower(label.Language) == language {
+					name = label.Value
+				}
+			}
+		}
+		terms := make([]string, 0, len(concept.labels)+len(concept.synonyms))
+		for _, label := range concept.labels {
+			terms = append(terms, label.Value)
+		}
+		terms = append(terms, concept.synonyms...)
+		if len(name) == 0 && len(terms) > 0 {
+			name = terms[0]
+		}
+		if len(strings.TrimSpace(name)) == 0 {
+			continue
+		}
+
+		builder.add(subject, DictionaryEntry{
+			Name:        name,
+			Term:        name,
+			Synonyms:    terms,
+			Identifiers: DictionaryEntryIdentifiers{WikiData: concept.wikidata},
+		})
+	}
+
+	return builder.dictionary
+}
+
+// Turtle
+
+// turtleParser reads enough of Turtle for vocabulary files: prefixes, IRIs, prefixed names,
+// blank nodes, literals, and predicate and object lists. Collections are parsed but their
+// members are dropped, as SKOS labels never use them.
+type turtleParser struct {
+	data     []byte
+	pos      int
+	line     int
+	base     string
+	prefixes map[string]string
+	blanks   int
+	triples  []rdfTriple
+}
+
+func parseTurtle(data []byte) ([]rdfTriple, error) {
+	parser := &turtleParser{data: data, line: 1, prefixes: make(map[string]string)}
+	err := parser.parse()
+	return parser.triples, err
+}
+
+func (p *turtleParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("Line %d: %s", p.line, fmt.Sprintf(format, args...))
+}
+
+func (p *turtleParser) peek() byte {
+	if p.pos >= len(p.data) {
+		return 0
+	}
+	return p.data[p.pos]
+}
+
+func (p *turtleParser) skipSpace() {
+	for p.pos < len(p.data) {
+		switch p.data[p.pos] {
+		case '\n':
+			p.line += 1
+			fallthrough
+		case ' ', '\t', '\r':
+			p.pos += 1
+		case '#':
+			for p.pos < len(p.data) && p.data[p.pos] != '\n' {
+				p.pos += 1
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (p *turtleParser) expect(c byte) error {
+	p.skipSpace()
+	if p.peek() != c {
+		return p.errorf("expected %q", c)
+	}
+	p.pos += 1
+	return nil
+}
+
+// word reads a bare token such as a prefixed name, keyword, or number. Dots can appear inside a
+// prefixed name but not at the end, where they end the statement.
+func (p *turtleParser) word() string {
+	start := p.pos
+	for p.pos < len(p.data) && !strings.ContainsRune(" \t\r\n<>\"';,()[]#", rune(p.data[p.pos])) {
+		if p.data[p.pos] == '\\' {
+			// A backslash at the very end escapes nothing, so leave it for the caller to reject
+			if p.pos+1 >= len(p.data) {
+				break
+			}
+			p.pos += 1
+		}
+		p.pos += 1
+	}
+	for p.pos > start && p.data[p.pos-1] == '.' {
+		p.pos -= 1
+	}
+	return string(p.data[start:p.pos])
+}
+
+func (p *turtleParser) parse() error {
+	for {
+		p.skipSpace()
+		if p.pos >= len(p.data) {
+			return nil
+		}
+
+		if p.peek() == '@' {
+			p.pos += 1
+			if err := p.directive(p.word()); err != nil {
+				return err
+			}
+			if err := p.expect('.'); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// SPARQL style directives have no @ or trailing dot
+		start := p.pos
+		if keyword := strings.ToLower(p.word()); keyword == "prefix" || keyword == "base" {
+			if err := p.directive(keyword); err != nil {
+				return err
+			}
+			continue
+		}
+		p.pos = start
+
+		subject, err := p.subject()
+		if err != nil {
+			return err
+		}
+		if err := p.predicateObjectList(subject); err != nil {
+			return err
+		}
+		if err := p.expect('.'); err != nil {
+			return err
+		}
+	}
+}
+
+func (p *turtleParser) directive(keyword string) error {
+	switch strings.ToLower(keyword) {
+	case "prefix":
+		p.skipSpace()
+		prefix := p.word()
+		if !strings.HasSuffix(prefix, ":") {
+			return p.errorf("bad prefix %q", prefix)
+		}
+		p.skipSpace()
+		iri, err := p.iri()
+		if err != nil {
+			return err
+		}
+		p.prefixes[strings.TrimSuffix(prefix, ":")] = iri
+	case "base":
+		p.skipSpace()
+		iri, err := p.iri()
+		if err != nil {
+			return err
+		}
+		p.base = iri
+	default:
+		return p.errorf("unknown directive %q", keyword)
+	}
+	return nil
+}
+
+func (p *turtleParser) iri() (string, error) {
+	if p.peek() != '<' {
+		return "", p.errorf("expected an IRI")
+	}
+	end := bytes.IndexByte(p.data[p.pos:], '>')
+	if end == -1 {
+		return "", p.errorf("unterminated IRI")
+	}
+	iri := string(p.data[p.pos+1 : p.pos+end])
+	p.pos += end + 1
+	if len(p.base) > 0 && !strings.Contains(iri, ":") {
+		iri = p.base + iri
+	}
+	return iri, nil
+}
+
+func (p *turtleParser) prefixedName(name string) (string, error) {
+	parts := strings.SplitN(name, ":", 2)
+	if len(parts) != 2 {
+		return "", p.errorf("unexpected %q", name)
+	}
+	namespace, prs := p.prefixes[parts[0]]
+	if !prs {
+		return "", p.errorf("unknown prefix %q", parts[0])
+	}
+	return namespace + strings.Replace(parts[1], "\\", "", -1), nil
+}
+
+func (p *turtleParser) newBlank() string {
+	p.blanks += 1
+	return fmt.Sprintf("_:b%d", p.blanks)
+}
+
+// resource reads anything that can be a subject or an object other than a literal
+func (p *turtleParser) resource() (string, error) {
+	p.skipSpace()
+	switch p.peek() {
+	case '<':
+		return p.iri()
+	case '[':
+		p.pos += 1
+		blank := p.newBlank()
+		if err := p.predicateObjectList(blank); err != nil {
+			return "", err
+		}
+		return blank, p.expect(']')
+	case '(':
+		p.pos += 1
+		for {
+			p.skipSpace()
+			if p.peek() == ')' {
+				p.pos += 1
+				return p.newBlank(), nil
+			}
+			if p.pos >= len(p.data) {
+				return "", p.errorf("unterminated collection")
+			}
+			if _, err := p.object(); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	name := p.word()
+	if len(name) == 0 {
+		return "", p.errorf("unexpected %q", p.peek())
+	}
+	if strings.HasPrefix(name, "_:") {
+		return name, nil
+	}
+	return p.prefixedName(name)
+}
+
+func (p *turtleParser) subject() (string, error) {
+	return p.resource()
+}
+
+func (p *turtleParser) predicate() (string, error) {
+	p.skipSpace()
+	start := p.pos
+	if p.word() == "a" {
+		return rdfNamespace + "type", nil
+	}
+	p.pos = start
+	return p.resource()
+}
+
+func (p *turtleParser) object() (rdfTerm, error) {
+	p.skipSpace()
+	switch c := p.peek(); {
+	case c == '"' || c == '\'':
+		return p.literal()
+	case c == '+' || c == '-' || (c >= '0' && c <= '9'):
+		return rdfTerm{Value: p.word(), Literal: true}, nil
+	}
+
+	start := p.pos
+	if word := p.word(); word == "true" || word == "false" {
+		return rdfTerm{Value: word, Literal: true}, nil
+	}
+	p.pos = start
+
+	value, err := p.resource()
+	return rdfTerm{Value: value}, err
+}
+
+func (p *turtleParser) predicateObjectList(subject string) error {
+	for {
+		p.skipSpace()
+		// Lists can end with a spare semicolon
+		if c := p.peek(); c == '.' || c == ']' || c == 0 {
+			return nil
+		}
+
+		predicate, err := p.predicate()
+		if err != nil {
+			return err
+		}
+		for {
+			object, err := p.object()
+			if err != nil {
+				return err
+			}
+			p.triples = append(p.triples, rdfTriple{Subject: subject, Predicate: predicate, Object: object})
+			p.skipSpace()
+			if p.peek() != ',' {
+				break
+			}
+			p.pos += 1
+		}
+
+		p.skipSpace()
+		if p.peek() != ';' {
+			return nil
+		}
+		for p.peek() == ';' {
+			p.pos += 1
+			p.skipSpace()
+		}
+	}
+}
+
+func (p *turtleParser) literal() (rdfTerm, error) {
+
+	quote := p.data[p.pos]
+	long := bytes.HasPrefix(p.data[p.pos:], []byte{quote, quote, quote})
+	if long {
+		p.pos += 3
+	} else {
+		p.pos += 1
+	}
+
+	var value bytes.Buffer
+	for {
+		if p.pos >= len(p.data) {
+			return rdfTerm{}, p.errorf("unterminated string")
+		}
+		c := p.data[p.pos]
+		if c == quote {
+			if !long {
+				p.pos += 1
+				break
+			}
+			if bytes.HasPrefix(p.data[p.pos:], []byte{quote, quote, quote}) {
+				p.pos += 3
+				break
+			}
+		}
+		if c == '\n' {
+			if !long {
+				return rdfTerm{}, p.errorf("newline in string")
+			}
+			p.line += 1
+		}
+		if c != '\\' {
+			value.WriteByte(c)
+			p.pos += 1
+			continue
+		}
+
+		if p.pos+1 >= len(p.data) {
+			return rdfTerm{}, p.errorf("unterminated string")
+		}
+		escape := p.data[p.pos+1]
+		p.pos += 2
+		switch escape {
+		case 't':
+			value.WriteByte('\t')
+		case 'n':
+			value.WriteByte('\n')
+		case 'r':
+			value.WriteByte('\r')
+		case 'b':
+			value.WriteByte('\b')
+		case 'f':
+			value.WriteByte('\f')
+		case 'u', 'U':
+			digits := 4
+			if escape == 'U' {
+				digits = 8
+			}
+			if p.pos+digits > len(p.data) {
+				return rdfTerm{}, p.errorf("bad escape")
+			}
+			code, err := strconv.ParseUint(string(p.data[p.pos:p.pos+digits]), 16, 32)
+			if err != nil || !utf8.ValidRune(rune(code)) {
+				return rdfTerm{}, p.errorf("bad escape")
+			}
+			value.WriteRune(rune(code))
+			p.pos += digits
+		default:
+			value.WriteByte(escape)
+		}
+	}
+
+	term := rdfTerm{Value: value.String(), Literal: true}
+
+	if p.peek() == '@' {
+		p.pos += 1
+		start := p.pos
+		for p.pos < len(p.data) && (isASCIIAlphanumeric(p.data[p.pos]) || p.data[p.pos] == '-') {
+			p.pos += 1
+		}
+		term.Language = string(p.data[start:p.pos])
+	} else if bytes.HasPrefix(p.data[p.pos:], []byte("^^")) {
+		p.pos += 2
+		if _, err := p.resource(); err != nil {
+			return rdfTerm{}, err
+		}
+	}
+
+	return term, nil
+}
+
+func isASCIIAlphanumeric(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// RDF/XML
+
+// rdfXMLFrame is an element we're inside, which is either a node describing a resource, or a
+// property of the node that encloses it.
+type rdfXMLFrame struct {
+	node     bool
+	subject  string
+	property string
+	language string
+	text     strings.Builder
+	// Set on properties whose value is a resource rather than the text
+	resource bool
+}
+
+// parseRDFXML reads the striped node/property syntax, including property attributes and
+// rdf:resource references, which is what vocabulary tools write.
+func parseRDFXML(data []byte) ([]rdfTriple, error) {
+
+	triples := make([]rdfTriple, 0)
+	stack := make([]*rdfXMLFrame, 0)
+	blanks := 0
+
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		switch token := token.(type) {
+		case xml.StartElement:
+			name := token.Name.Space + token.Name.Local
+
+			var parent *rdfXMLFrame
+			language := ""
+			if len(stack) > 0 {
+				parent = stack[len(stack)-1]
+				language = parent.language
+			}
+			attributes := make(map[string]string)
+			for _, attr := range token.Attr {
+				if attr.Name.Space == xmlNamespace && attr.Name.Local == "lang" {
+					language = attr.Value
+				} else if attr.Name.Space != "xmlns" && !(attr.Name.Space == "" && attr.Name.Local == "xmlns") {
+					attributes[attr.Name.Space+attr.Name.Local] = attr.Value
+				}
+			}
+
+			if name == rdfNamespace+"RDF" {
+				// The root holds nodes, like a property would
+				stack = append(stack, &rdfXMLFrame{language: language})
+				continue
+			}
+
+			if parent != nil && parent.node {
+				frame := &rdfXMLFrame{subject: parent.subject, property: name, language: language}
+				if resource, prs := attributes[rdfNamespace+"resource"]; prs {
+					triples = append(triples, rdfTriple{Subject: parent.subject, Predicate: name, Object: rdfTerm{Value: resource}})
+					frame.resource = true
+				}
+				stack = append(stack, frame)
+				continue
+			}
+
+			frame := &rdfXMLFrame{node: true, language: language}
+			if about, prs := attributes[rdfNamespace+"about"]; prs {
+				frame.subject = about
+			} else if id, prs := attributes[rdfNamespace+"ID"]; prs {
+				frame.subject = "#" + id
+			} else if id, prs := attributes[rdfNamespace+"nodeID"]; prs {
+				frame.subject = "_:" + id
+			} else {
+				blanks += 1
+				frame.subject = fmt.Sprintf("_:b%d", blanks)
+			}
+
+			if name != rdfNamespace+"Description" {
+				triples = append(triples, rdfTriple{Subject: frame.subject, Predicate: rdfNamespace + "type", Object: rdfTerm{Value: name}})
+			}
+			for attr, value := range attributes {
+				if !strings.HasPrefix(attr, rdfNamespace) {
+					triples = append(triples, rdfTriple{Subject: frame.subject, Predicate: attr, Object: rdfTerm{Value: value, Language: language, Literal: true}})
+				}
+			}
+			if parent != nil && len(parent.property) > 0 {
+				triples = append(triples, rdfTriple{Subject: parent.subject, Predicate: parent.property, Object: rdfTerm{Value: frame.subject}})
+				parent.resource = true
+			}
+			stack = append(stack, frame)
+
+		case xml.CharData:
+			if len(stack) > 0 && !stack[len(stack)-1].node {
+				stack[len(stack)-1].text.Write(token)
+			}
+
+		case xml.EndElement:
+			if len(stack) == 0 {
+				continue
+			}
+			frame := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if !frame.node && len(frame.property) > 0 && !frame.resource {
+				triples = append(triples, rdfTriple{
+					Subject:   frame.subject,
+					Predicate: frame.property,
+					Object:    rdfTerm{Value: strings.TrimSpace(frame.text.String()), Language: frame.language, Literal: true},
+				})
+			}
+		}
+	}
+
+	return triples, nil
+}
@@ -0,0 +1,251 @@
+//   Copyright 2018 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/ContentMine/wikibase"
+)
+
+type PaperStage int
+
+const (
+	PaperStageNew PaperStage = iota
+	PaperStageFetched
+	PaperStageConverted
+	PaperStageAnnotated
+	PaperStageUploading
+	PaperStageComplete
+)
+
+func (stage PaperStage) String() string {
+	switch stage {
+	case PaperStageNew:
+		return "new"
+	case PaperStageFetched:
+		return "fetched"
+	case PaperStageConverted:
+		return "converted"
+	case PaperStageAnnotated:
+		return "annotated"
+	case PaperStageUploading:
+		return "uploading"
+	case PaperStageComplete:
+		return "complete"
+	default:
+		return "unknown"
+	}
+}
+
+type PaperStatus struct {
+	Paper       Paper
+	Stage       PaperStage
+	Annotations int
+	PageID      int
+	Error       error
+}
+
+func (status PaperStatus) String() string {
+	res := fmt.Sprintf("%s\t%s", status.Paper.ID(), status.Stage)
+	if status.Stage >= PaperStageAnnotated {
+		res += fmt.Sprintf("\t%d annotations", status.Annotations)
+	}
+	if status.PageID != 0 {
+		res += fmt.Sprintf("\tpage %d", status.PageID)
+	}
+	if status.Error != nil {
+		res += fmt.Sprintf("\terror: %v", status.Error)
+	}
+	return res
+}
+
+// Status works out which stage a paper has got to based on what is in its folder.
+func (processor PaperProcessor) Status() PaperStatus {
+
+	status := PaperStatus{Paper: processor.Paper, Stage: PaperStageNew}
+
+	if fileExists(processor.targetScienceSourceStateFileName()) {
+		record, err := LoadScienceSourceArticle(processor.targetScienceSourceStateFileName())
+		if err != nil {
+			status.Error = err
+			return status
+		}
+		status.Annotations = len(record.Annotations)
+		status.PageID = record.PageID
+		switch {
+		case record.ClaimsUploaded:
+			status.Stage = PaperStageComplete
+		case record.PageID != 0 || len(record.ID) != 0:
+			status.Stage = PaperStageUploading
+		default:
+			status.Stage = PaperStageAnnotated
+		}
+	} else if fileExists(processor.targetHTMLFileName()) && fileExists(processor.targetTextFileName()) {
+		status.Stage = PaperStageConverted
+	} else if fileExists(processor.targetXMLFileName()) {
+		status.Stage = PaperStageFetched
+	}
+
+	return status
+}
+
+// Verify checks the files for a paper are consistent with each other, and returns a list of any
+// problems found.
+func (processor PaperProcessor) Verify() []string {
+
+	problems := make([]string, 0)
+
+	for _, filename := range []string{processor.targetXMLFileName(), processor.targetHTMLFileName(), processor.targetTextFileName()} {
+		if info, err := os.Stat(filename); err == nil && info.Size() == 0 {
+			problems = append(problems, fmt.Sprintf("%s is empty", filename))
+		}
+	}
+
+	if fileExists(processor.targetXMLFileName()) {
+		if _, err := loadJATSDocument(processor.targetXMLFileName()); err != nil {
+			problems = append(problems, fmt.Sprintf("%s is not valid XML: %v", processor.targetXMLFileName(), err))
+		}
+	}
+
+	if !fileExists(processor.targetScienceSourceStateFileName()) {
+		return problems
+	}
+
+	record, err := LoadScienceSourceArticle(processor.targetScienceSourceStateFileName())
+	if err != nil {
+		return append(problems, fmt.Sprintf("Failed to load %s: %v", processor.targetScienceSourceStateFileName(), err))
+	}
+
+	text, err := ioutil.ReadFile(processor.targetTextFileName())
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("Paper is annotated but text can not be read: %v", err))
+	} else {
+		if fileExists(processor.targetTextMapFileName()) {
+			if textMap, err := LoadTextHTMLMap(processor.targetTextMapFileName()); err != nil {
+				problems = append(problems, fmt.Sprintf("Failed to load %s: %v", processor.targetTextMapFileName(), err))
+			} else if !textMap.validFor(text) {
+				problems = append(problems, fmt.Sprintf("%s does not match the paper text", processor.targetTextMapFileName()))
+			}
+		}
+		if fileExists(processor.targetTextSectionsFileName()) {
+			if sections, err := LoadTextSections(processor.targetTextSectionsFileName()); err != nil {
+				problems = append(problems, fmt.Sprintf("Failed to load %s: %v", processor.targetTextSectionsFileName(), err))
+			} else if !sections.validFor(text) {
+				problems = append(problems, fmt.Sprintf("%s does not match the paper text", processor.targetTextSectionsFileName()))
+			}
+		}
+
+		offsets := newTextOffsets(text, record.offsetUnit())
+		for i, anchor := range record.Annotations {
+			start, end, ok := offsets.span(anchor.CharacterNumber, anchor.Annotation.LengthOfTermFound)
+			if !ok {
+				problems = append(problems, fmt.Sprintf("Annotation %d at %d is outside the paper text", i, anchor.CharacterNumber))
+			} else if string(text[start:end]) != anchor.Annotation.TermFound {
+				problems = append(problems, fmt.Sprintf("Annotation %d at %d is %q not %q", i, anchor.CharacterNumber, text[start:end], anchor.Annotation.TermFound))
+			}
+			for _, annotation := range anchor.AdditionalAnnotations {
+				if annotation.LengthOfTermFound != anchor.Annotation.LengthOfTermFound || annotation.TermFound != anchor.Annotation.TermFound {
+					problems = append(problems, fmt.Sprintf("Annotation %d has an additional annotation for different text %q", i, annotation.TermFound))
+				}
+			}
+			if i > 0 && record.Annotations[i-1].CharacterNumber > anchor.CharacterNumber {
+				problems = append(problems, fmt.Sprintf("Annotation %d is out of order", i))
+			}
+		}
+	}
+
+	for _, file := range record.SupplementaryFiles {
+		filename := path.Join(processor.targetSupplementaryDirectoryName(), file.Name)
+		if info, err := os.Stat(filename); err != nil {
+			problems = append(problems, fmt.Sprintf("Supplementary file %s is missing", file.Name))
+		} else if info.Size() != file.Size {
+			problems = append(problems, fmt.Sprintf("Supplementary file %s is %d bytes not %d", file.Name, info.Size(), file.Size))
+		}
+	}
+
+	if record.ClaimsUploaded {
+		problems = append(problems, record.verifyItemTree()...)
+	}
+
+	return problems
+}
+
+// verifyItemTree checks the links between items match those made by ReconsileArticleItemTree
+func (article *ScienceSourceArticle) verifyItemTree() []string {
+
+	problems := make([]string, 0)
+
+	if len(article.ID) == 0 {
+		problems = append(problems, "Article has no item ID")
+	}
+	if article.PageID == 0 {
+		problems = append(problems, "Article has no page ID")
+	}
+
+	retired := make(map[wikibase.ItemPropertyType]bool)
+	for _, id := range article.RetiredItems {
+		retired[id] = true
+	}
+
+	for i, anchor := range article.Annotations {
+		if len(anchor.ID) == 0 {
+			problems = append(problems, fmt.Sprintf("Anchor point %d has no item ID", i))
+		}
+		if retired[anchor.ID] || retired[anchor.Annotation.ID] {
+			problems = append(problems, fmt.Sprintf("Anchor point %d uses a retired item", i))
+		}
+		if len(anchor.Annotation.ID) == 0 {
+			problems = append(problems, fmt.Sprintf("Annotation %d has no item ID", i))
+		}
+		if anchor.AnchorPoint != article.ID {
+			problems = append(problems, fmt.Sprintf("Anchor point %d is not in article %s", i, article.ID))
+		}
+		if anchor.Anchors != anchor.Annotation.ID {
+			problems = append(problems, fmt.Sprintf("Anchor point %d does not anchor its annotation", i))
+		}
+		if anchor.Annotation.BasedOn != anchor.ID {
+			problems = append(problems, fmt.Sprintf("Annotation %d is not based on its anchor point", i))
+		}
+		for j, annotation := range anchor.AdditionalAnnotations {
+			if len(annotation.ID) == 0 {
+				problems = append(problems, fmt.Sprintf("Additional annotation %d on anchor point %d has no item ID", j, i))
+			}
+			if annotation.BasedOn != anchor.ID {
+				problems = append(problems, fmt.Sprintf("Additional annotation %d is not based on anchor point %d", j, i))
+			}
+		}
+		if i == 0 {
+			if article.FollowingAnchorPoint != anchor.ID {
+				problems = append(problems, "Article does not point to the first anchor point")
+			}
+			if anchor.PrecedingAnchorPoint != nil {
+				problems = append(problems, "First anchor point has a preceding anchor point")
+			}
+		} else {
+			if anchor.PrecedingAnchorPoint == nil || *anchor.PrecedingAnchorPoint != article.Annotations[i-1].ID {
+				problems = append(problems, fmt.Sprintf("Anchor point %d does not point back to anchor point %d", i, i-1))
+			}
+			if article.Annotations[i-1].FollowingAnchorPoint != anchor.ID {
+				problems = append(problems, fmt.Sprintf("Anchor point %d does not point on to anchor point %d", i-1, i))
+			}
+		}
+	}
+
+	return problems
+}
@@ -0,0 +1,203 @@
+//   Copyright 2018 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestPaperStatus(t *testing.T) {
+
+	annotated := &ScienceSourceArticle{
+		ScienceSourceArticleTitle: "Malaria and cholera in rural settings",
+		Annotations: []ScienceSourceAnchorPoint{
+			{CharacterNumber: 10, Annotation: ScienceSourceAnnotation{TermFound: "malaria", LengthOfTermFound: 7}},
+		},
+	}
+	uploading := *annotated
+	uploading.PageID = 12
+	complete := uploading
+	complete.ID = "Q1"
+	complete.ClaimsUploaded = true
+
+	tests := []struct {
+		name        string
+		files       []string
+		record      *ScienceSourceArticle
+		corrupt     bool
+		stage       PaperStage
+		annotations int
+		pageID      int
+	}{
+		{"new", nil, nil, false, PaperStageNew, 0, 0},
+		{"fetched", []string{"paper.xml"}, nil, false, PaperStageFetched, 0, 0},
+		{"half-converted", []string{"paper.xml", "paper.html"}, nil, false, PaperStageFetched, 0, 0},
+		{"converted", []string{"paper.xml", "paper.html", "paper.txt"}, nil, false, PaperStageConverted, 0, 0},
+		{"annotated", []string{"paper.xml", "paper.html", "paper.txt"}, annotated, false, PaperStageAnnotated, 1, 0},
+		{"uploading", []string{"paper.xml", "paper.html", "paper.txt"}, &uploading, false, PaperStageUploading, 1, 12},
+		{"complete", []string{"paper.xml", "paper.html", "paper.txt"}, &complete, false, PaperStageComplete, 1, 12},
+		{"corrupt", []string{"paper.xml", "paper.html", "paper.txt"}, nil, true, PaperStageNew, 0, 0},
+	}
+
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "sciencesourceingest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		processor := PaperProcessor{Paper: testPaper(), TargetDirectory: dir}
+		err = processor.createFolderIfRequired()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range test.files {
+			err = ioutil.WriteFile(path.Join(processor.folderName(), name), []byte("content"), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if test.record != nil {
+			err = test.record.Save(processor.targetScienceSourceStateFileName())
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if test.corrupt {
+			err = ioutil.WriteFile(processor.targetScienceSourceStateFileName(), []byte("{\"title\":"), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		status := processor.Status()
+		if status.Stage != test.stage || status.Annotations != test.annotations || status.PageID != test.pageID {
+			t.Errorf("%s: unexpected status %v", test.name, status)
+		}
+		if (status.Error != nil) != test.corrupt {
+			t.Errorf("%s: unexpected error %v", test.name, status.Error)
+		}
+		if !strings.HasPrefix(status.String(), processor.Paper.ID()+"\t"+test.stage.String()) {
+			t.Errorf("%s: unexpected status line %q", test.name, status.String())
+		}
+	}
+}
+
+// newTestUploadedProcessor makes a processor for a paper that has been through every stage, using
+// the dry run wikibase to make up item IDs
+func newTestUploadedProcessor(t *testing.T) (PaperProcessor, func()) {
+
+	processor, cleanup := newTestProcessor(t)
+
+	dictionaries, err := LoadDictionariesFromDirectory(path.Join("testdata", "dictionaries"))
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	client := NewScienceSourceClientWithWikibase(NewDryRunWikibase())
+	err = client.GetConfigurationFromServer()
+	if err == nil {
+		err = processor.ProcessPaper(context.Background(), dictionaries, client)
+	}
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+
+	return processor, cleanup
+}
+
+func TestVerify(t *testing.T) {
+
+	// Each test breaks an uploaded paper by changing its state, or by overwriting one of its files
+	tests := []struct {
+		name     string
+		change   func(article *ScienceSourceArticle)
+		file     string
+		content  string
+		expected string
+	}{
+		{"good", nil, "", "", ""},
+		{"empty-html", nil, "paper.html", "", "paper.html is empty"},
+		{"invalid-xml", nil, "paper.xml", "<article><body><p>malaria</body>", "is not valid XML"},
+		{"unreadable-state", nil, "scisource.json", "not json", "Failed to load"},
+		{"annotation-moved", func(article *ScienceSourceArticle) {
+			article.Annotations[0].CharacterNumber += 1
+		}, "", "", "Annotation 0 at"},
+		{"annotation-outside-text", func(article *ScienceSourceArticle) {
+			article.Annotations[1].CharacterNumber = 1000000
+		}, "", "", "Annotation 1 at 1000000 is outside the paper text"},
+		{"missing-item", func(article *ScienceSourceArticle) {
+			article.Annotations[0].Annotation.ID = ""
+		}, "", "", "Annotation 0 has no item ID"},
+		{"broken-chain-back", func(article *ScienceSourceArticle) {
+			article.Annotations[2].PrecedingAnchorPoint = nil
+		}, "", "", "Anchor point 2 does not point back to anchor point 1"},
+		{"broken-chain-on", func(article *ScienceSourceArticle) {
+			article.Annotations[2].FollowingAnchorPoint = article.Annotations[2].ID
+		}, "", "", "Anchor point 2 does not point on to anchor point 3"},
+		{"broken-chain-start", func(article *ScienceSourceArticle) {
+			article.FollowingAnchorPoint = article.Annotations[1].ID
+		}, "", "", "Article does not point to the first anchor point"},
+	}
+
+	for _, test := range tests {
+		processor, cleanup := newTestUploadedProcessor(t)
+		defer cleanup()
+
+		if test.change != nil {
+			article, err := LoadScienceSourceArticle(processor.targetScienceSourceStateFileName())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(article.Annotations) < 4 || !article.ClaimsUploaded {
+				t.Fatalf("Expected an uploaded paper with at least 4 annotations, got %d", len(article.Annotations))
+			}
+			test.change(article)
+			err = article.Save(processor.targetScienceSourceStateFileName())
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if len(test.file) > 0 {
+			err := ioutil.WriteFile(path.Join(processor.folderName(), test.file), []byte(test.content), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		problems := processor.Verify()
+		if len(test.expected) == 0 {
+			if len(problems) != 0 {
+				t.Errorf("%s: expected no problems, got %v", test.name, problems)
+			}
+			continue
+		}
+		found := false
+		for _, problem := range problems {
+			if strings.Contains(problem, test.expected) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("%s: expected a problem containing %q, got %v", test.name, test.expected, problems)
+		}
+	}
+}
@@ -0,0 +1,462 @@
+//   Copyright 2018 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/errwrap"
+)
+
+// Europe PMC gives us a paper's supplementary files as one zip archive. If asked to, we fetch it
+// along with the paper and unpack it into the paper's folder. We don't trust what's in the
+// archive, so any entry that would be written outside the folder, or an archive that unpacks to
+// more than we're willing to store, means none of it is unpacked. When annotating we list the
+// files in the paper's state file, and run the dictionaries over the ones we can get text from.
+
+const (
+	DefaultSupplementaryMaxSize  int64 = 200 * 1024 * 1024
+	DefaultSupplementaryMaxFiles int   = 1000
+)
+
+type SupplementaryOptions struct {
+	// Whether to fetch the supplementary files at all
+	Fetch bool
+	// Most bytes an archive can unpack to, or zero for the default
+	MaxSize int64
+	// Most files an archive can contain, or zero for the default
+	MaxFiles int
+}
+
+func (options SupplementaryOptions) maxSize() int64 {
+	if options.MaxSize <= 0 {
+		return DefaultSupplementaryMaxSize
+	}
+	return options.MaxSize
+}
+
+func (options SupplementaryOptions) maxFiles() int {
+	if options.MaxFiles <= 0 {
+		return DefaultSupplementaryMaxFiles
+	}
+	return options.MaxFiles
+}
+
+// Types of supplementary file, going by the file extension
+const (
+	SupplementaryText        string = "text"
+	SupplementaryCSV         string = "csv"
+	SupplementaryXML         string = "xml"
+	SupplementaryPDF         string = "pdf"
+	SupplementaryDocument    string = "document"
+	SupplementarySpreadsheet string = "spreadsheet"
+	SupplementaryImage       string = "image"
+	SupplementaryVideo       string = "video"
+	SupplementaryArchive     string = "archive"
+	SupplementaryOther       string = "other"
+)
+
+var supplementaryTypes = map[string]string{
+	".txt": SupplementaryText, ".text": SupplementaryText,
+	".csv": SupplementaryCSV, ".tsv": SupplementaryCSV,
+	".xml": SupplementaryXML, ".nxml": SupplementaryXML,
+	".pdf": SupplementaryPDF,
+	".doc": SupplementaryDocument, ".docx": SupplementaryDocument, ".odt": SupplementaryDocument, ".rtf": SupplementaryDocument,
+	".xls": SupplementarySpreadsheet, ".xlsx": SupplementarySpreadsheet, ".ods": SupplementarySpreadsheet,
+	".png": SupplementaryImage, ".jpg": SupplementaryImage, ".jpeg": SupplementaryImage, ".gif": SupplementaryImage,
+	".tif": SupplementaryImage, ".tiff": SupplementaryImage, ".eps": SupplementaryImage,
+	".mp4": SupplementaryVideo, ".avi": SupplementaryVideo, ".mov": SupplementaryVideo, ".mpg": SupplementaryVideo,
+	".zip": SupplementaryArchive, ".gz": SupplementaryArchive, ".tar": SupplementaryArchive,
+}
+
+func supplementaryType(name string) string {
+	if fileType, prs := supplementaryTypes[strings.ToLower(path.Ext(name))]; prs {
+		return fileType
+	}
+	return SupplementaryOther
+}
+
+// A SupplementaryFile is one of the files unpacked from a paper's supplementary archive
+type SupplementaryFile struct {
+	// Path within the archive, which is also where it is in the paper's supplementary folder
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Size int64  `json:"size"`
+
+	// Whether we could get text from the file to look for terms in
+	Mined bool                `json:"mined,omitempty"`
+	Terms []SupplementaryTerm `json:"terms,omitempty"`
+}
+
+// A SupplementaryTerm is a dictionary entry found in a supplementary file. These aren't on the
+// page we upload, so we can't make anchor points for them, but we do count them.
+type SupplementaryTerm struct {
+	DictionaryName   string `json:"dictionary"`
+	WikiDataItemCode string `json:"wikidata"`
+	TermFound        string `json:"term"`
+	Count            int    `json:"count"`
+}
+
+// SupplementaryRejectedError is returned for archives we won't unpack, as opposed to ones we
+// failed to unpack, so that we know not to try again
+type SupplementaryRejectedError struct {
+	Reason string
+}
+
+func (e *SupplementaryRejectedError) Error() string {
+	return e.Reason
+}
+
+func rejectArchive(format string, a ...interface{}) error {
+	return &SupplementaryRejectedError{Reason: fmt.Sprintf(format, a...)}
+}
+
+// supplementaryEntryPath works out where an archive entry goes within the directory it's unpacked
+// into, failing if the name would put it anywhere else
+func supplementaryEntryPath(name string) (string, error) {
+	if len(name) == 0 || strings.Contains(name, "\\") || strings.HasPrefix(name, "/") || strings.Contains(name, "\x00") {
+		return "", rejectArchive("Unsafe file name %q in archive", name)
+	}
+	cleaned := path.Clean(name)
+	if cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", rejectArchive("Unsafe file name %q in archive", name)
+	}
+	return cleaned, nil
+}
+
+// unpackSupplementaryArchive unpacks the zip file into directory, which must not exist yet. It is
+// unpacked into a temporary directory first, so either all of the archive is unpacked or none of
+// it is.
+func unpackSupplementaryArchive(filename string, directory string, options SupplementaryOptions) error {
+
+	archive, err := zip.OpenReader(filename)
+	if err != nil {
+		return rejectArchive("Failed to open archive: %v", err)
+	}
+	defer archive.Close()
+
+	files := 0
+	var declared uint64
+	for _, entry := range archive.File {
+		if _, err := supplementaryEntryPath(entry.Name); err != nil {
+			return err
+		}
+		if entry.Mode()&os.ModeSymlink != 0 {
+			return rejectArchive("Archive contains symbolic link %s", entry.Name)
+		}
+		if !entry.FileInfo().IsDir() {
+			files += 1
+			declared += entry.UncompressedSize64
+		}
+	}
+	if files > options.maxFiles() {
+		return rejectArchive("Archive has %d files, more than the limit of %d", files, options.maxFiles())
+	}
+	if declared > uint64(options.maxSize()) {
+		return rejectArchive("Archive unpacks to %d bytes, more than the limit of %d", declared, options.maxSize())
+	}
+
+	temp, err := ioutil.TempDir(path.Dir(directory), atomicTempPrefix+path.Base(directory)+"-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(temp)
+	if err := os.Chmod(temp, 0755); err != nil {
+		return err
+	}
+
+	// The sizes in the archive could be lies, so we also count what we actually write
+	remaining := options.maxSize()
+	for _, entry := range archive.File {
+		name, _ := supplementaryEntryPath(entry.Name)
+		target := filepath.Join(temp, filepath.FromSlash(name))
+
+		if entry.FileInfo().IsDir() {
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+
+		written, err := unpackSupplementaryEntry(entry, target, remaining)
+		if _, rejected := err.(*SupplementaryRejectedError); rejected {
+			return err
+		} else if err != nil {
+			return errwrap.Wrapf(fmt.Sprintf("Failed to unpack %s: {{err}}", entry.Name), err)
+		}
+		remaining -= written
+	}
+
+	return os.Rename(temp, directory)
+}
+
+func unpackSupplementaryEntry(entry *zip.File, target string, limit int64) (int64, error) {
+
+	r, err := entry.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	// O_EXCL so that two entries with the same name can't overwrite each other
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		return 0, rejectArchive("Archive has more than one %s", entry.Name)
+	} else if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	written, err := io.Copy(f, io.LimitReader(r, limit+1))
+	if err != nil {
+		return written, err
+	}
+	if written > limit {
+		return written, rejectArchive("Archive unpacks to more than the limit of %d bytes", limit)
+	}
+	return written, f.Close()
+}
+
+// extractSupplementaryText gets the text we can look for terms in from a file, returning false
+// if we don't know how to for that type of file
+func extractSupplementaryText(filename string, fileType string) ([]byte, bool, error) {
+
+	switch fileType {
+	case SupplementaryText, SupplementaryCSV, SupplementaryXML:
+	default:
+		return nil, false, nil
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, false, err
+	}
+
+	switch fileType {
+	case SupplementaryCSV:
+		data = csvText(data, strings.ToLower(path.Ext(filename)) == ".tsv")
+	case SupplementaryXML:
+		data = xmlText(data)
+	}
+	return bytes.ToValidUTF8(data, []byte("\uFFFD")), true, nil
+}
+
+// csvText puts each field on a line of its own, so terms can't run across fields. If the file
+// doesn't parse as CSV we use it as is.
+func csvText(data []byte, tabs bool) []byte {
+
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	if tabs {
+		reader.Comma = '\t'
+	}
+
+	var b bytes.Buffer
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return data
+		}
+		for _, field := range record {
+			b.WriteString(field)
+			b.WriteByte('\n')
+		}
+	}
+	return b.Bytes()
+}
+
+// xmlText is the character data of an XML document, with elements on lines of their own
+func xmlText(data []byte) []byte {
+
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	decoder.Strict = false
+	decoder.AutoClose = xml.HTMLAutoClose
+	decoder.Entity = xml.HTMLEntity
+
+	var b bytes.Buffer
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			break
+		}
+		switch token := token.(type) {
+		case xml.CharData:
+			b.Write(token)
+		case xml.StartElement, xml.EndElement:
+			b.WriteByte('\n')
+		}
+	}
+	return b.Bytes()
+}
+
+// countSupplementaryTerms finds dictionary terms in some text, resolving overlaps the same way as
+// for the paper text
+func countSupplementaryTerms(prose []byte, dictionaries []Dictionary, options AnnotationOptions) []SupplementaryTerm {
+
+	matches := make([]DictionaryMatch, 0)
+	for _, dictionary := range dictionaries {
+		found, _ := dictionary.FindMatches(prose)
+		matches = append(matches, found...)
+	}
+
+	counts := make(map[SupplementaryTerm]int)
+	for _, group := range resolveOverlaps(matches, dictionaries, options) {
+		for _, match := range group {
+			term := SupplementaryTerm{
+				DictionaryName:   match.Dictionary.Identifier,
+				WikiDataItemCode: match.Entry.Identifiers.WikiData,
+				TermFound:        string(prose[match.Offset : match.Offset+match.Length]),
+			}
+			counts[term] += 1
+		}
+	}
+
+	terms := make([]SupplementaryTerm, 0, len(counts))
+	for term, count := range counts {
+		term.Count = count
+		terms = append(terms, term)
+	}
+	sort.Slice(terms, func(i, j int) bool {
+		if terms[i].DictionaryName != terms[j].DictionaryName {
+			return terms[i].DictionaryName < terms[j].DictionaryName
+		}
+		if terms[i].WikiDataItemCode != terms[j].WikiDataItemCode {
+			return terms[i].WikiDataItemCode < terms[j].WikiDataItemCode
+		}
+		return terms[i].TermFound < terms[j].TermFound
+	})
+	return terms
+}
+
+// Pipeline steps for the paper's supplementary files
+
+func (processor PaperProcessor) targetSupplementaryDirectoryName() string {
+	return path.Join(processor.folderName(), "supplementary")
+}
+
+// targetSupplementaryRejectedFileName is where we say why we didn't unpack the archive
+func (processor PaperProcessor) targetSupplementaryRejectedFileName() string {
+	return path.Join(processor.folderName(), "supplementary-rejected.txt")
+}
+
+// fetchSupplementaryFiles fetches and unpacks the paper's supplementary archive if we were asked
+// to. Not all papers have supplementary files, so the archive not being there isn't an error.
+// Nor is an archive we won't unpack, as the paper itself is fine, so we note why and carry on
+// without its supplementary files.
+func (processor PaperProcessor) fetchSupplementaryFiles(ctx context.Context) error {
+
+	if !processor.Supplementary.Fetch {
+		return nil
+	}
+
+	if fileExists(processor.targetSupplementaryDirectoryName()) || fileExists(processor.targetSupplementaryRejectedFileName()) {
+		return nil
+	}
+
+	err := processor.fetchPaperSupplementaryFilesToDisk(ctx)
+	if err != nil {
+		if statusErr, ok := err.(*HTTPStatusError); ok && statusErr.StatusCode == http.StatusNotFound {
+			log.Printf("Paper %s has no supplementary files", processor.Paper.ID())
+			return nil
+		}
+		if _, tooLarge := err.(*TooLargeError); tooLarge {
+			return processor.rejectSupplementaryArchive(rejectArchive("Archive is larger than %d bytes", processor.Supplementary.maxSize()))
+		}
+		return errwrap.Wrapf("Failed to fetch archive: {{err}}", err)
+	}
+
+	err = unpackSupplementaryArchive(processor.targetSupplementaryArchiveFileName(), processor.targetSupplementaryDirectoryName(), processor.Supplementary)
+	if _, rejected := err.(*SupplementaryRejectedError); rejected {
+		return processor.rejectSupplementaryArchive(err)
+	} else if err != nil {
+		return errwrap.Wrapf("Failed to unpack archive: {{err}}", err)
+	}
+	return nil
+}
+
+// rejectSupplementaryArchive notes why we're not unpacking the paper's archive, so we don't try again
+func (processor PaperProcessor) rejectSupplementaryArchive(reason error) error {
+	log.Printf("Not unpacking supplementary files for paper %s: %v", processor.Paper.ID(), reason)
+	err := WriteFileAtomic(processor.targetSupplementaryRejectedFileName(), []byte(reason.Error()+"\n"))
+	if err != nil {
+		return errwrap.Wrapf("Failed to record rejected archive: {{err}}", err)
+	}
+	return nil
+}
+
+// indexSupplementaryFiles lists the files unpacked for the paper, looking for terms in any we can
+// get text from
+func (processor PaperProcessor) indexSupplementaryFiles(dictionaries []Dictionary) ([]SupplementaryFile, error) {
+
+	directory := processor.targetSupplementaryDirectoryName()
+	if !fileExists(directory) {
+		return nil, nil
+	}
+
+	res := make([]SupplementaryFile, 0)
+	err := filepath.Walk(directory, func(filename string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		name, err := filepath.Rel(directory, filename)
+		if err != nil {
+			return err
+		}
+
+		file := SupplementaryFile{
+			Name: filepath.ToSlash(name),
+			Type: supplementaryType(name),
+			Size: info.Size(),
+		}
+		prose, ok, err := extractSupplementaryText(filename, file.Type)
+		if err != nil {
+			return errwrap.Wrapf(fmt.Sprintf("Failed to read %s: {{err}}", file.Name), err)
+		}
+		if ok {
+			file.Mined = true
+			file.Terms = countSupplementaryTerms(prose, dictionaries, processor.Annotation)
+		}
+		res = append(res, file)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
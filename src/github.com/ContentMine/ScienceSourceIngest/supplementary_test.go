@@ -0,0 +1,333 @@
+//   Copyright 2018 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+type testZipEntry struct {
+	Name string
+	Body string
+}
+
+func makeTestZip(t *testing.T, entries []testZipEntry) []byte {
+	t.Helper()
+
+	var b bytes.Buffer
+	w := zip.NewWriter(&b)
+	for _, entry := range entries {
+		f, err := w.Create(entry.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte(entry.Body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+var testSupplementaryEntries = []testZipEntry{
+	{"S1_Table.csv", "country,disease,cases\nChad,cholera,10\nMali,\"malaria, severe\",20\n"},
+	{"data/S2_Text.txt", "Notes on pneumonia and malaria."},
+	{"data/S3_Data.xml", "<data><row><name>cholera</name></row></data>"},
+	{"S4_Fig.tif", "not really an image"},
+}
+
+func TestUnpackSupplementaryArchive(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "sciencesourceingest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		entries []testZipEntry
+		options SupplementaryOptions
+		ok      bool
+	}{
+		{"good", testSupplementaryEntries, SupplementaryOptions{}, true},
+		{"parent", []testZipEntry{{"ok.txt", "fine"}, {"../evil.txt", "escaped"}}, SupplementaryOptions{}, false},
+		{"nested-parent", []testZipEntry{{"a/../../evil.txt", "escaped"}}, SupplementaryOptions{}, false},
+		{"absolute", []testZipEntry{{"/tmp/evil.txt", "escaped"}}, SupplementaryOptions{}, false},
+		{"backslash", []testZipEntry{{"..\\evil.txt", "escaped"}}, SupplementaryOptions{}, false},
+		{"duplicate", []testZipEntry{{"a.txt", "one"}, {"a.txt", "two"}}, SupplementaryOptions{}, false},
+		{"too-big", []testZipEntry{{"big.txt", strings.Repeat("x", 100)}}, SupplementaryOptions{MaxSize: 99}, false},
+		{"too-many", []testZipEntry{{"a.txt", "a"}, {"b.txt", "b"}}, SupplementaryOptions{MaxFiles: 1}, false},
+	}
+
+	for _, test := range tests {
+		archive := path.Join(dir, test.name+".zip")
+		if err := ioutil.WriteFile(archive, makeTestZip(t, test.entries), 0644); err != nil {
+			t.Fatal(err)
+		}
+		target := path.Join(dir, test.name)
+
+		err := unpackSupplementaryArchive(archive, target, test.options)
+		if test.ok && err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		}
+		if !test.ok {
+			if _, rejected := err.(*SupplementaryRejectedError); !rejected {
+				t.Errorf("%s: expected archive to be rejected, got %v", test.name, err)
+			}
+			if fileExists(target) {
+				t.Errorf("%s: expected nothing to be unpacked", test.name)
+			}
+		}
+	}
+
+	if fileExists(path.Join(dir, "evil.txt")) || fileExists("/tmp/evil.txt") {
+		t.Errorf("Archive escaped the directory it was unpacked into")
+	}
+	data, err := ioutil.ReadFile(path.Join(dir, "good", "data", "S2_Text.txt"))
+	if err != nil || string(data) != "Notes on pneumonia and malaria." {
+		t.Errorf("Unexpected unpacked file %q, %v", data, err)
+	}
+
+	// Temporary directories are tidied up, even after failures
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), atomicTempPrefix) {
+			t.Errorf("Temporary directory %s left behind", f.Name())
+		}
+	}
+}
+
+func TestSupplementaryText(t *testing.T) {
+
+	csv := string(csvText([]byte("a,\"b, c\"\nd,e\n"), false))
+	if csv != "a\nb, c\nd\ne\n" {
+		t.Errorf("Unexpected CSV text %q", csv)
+	}
+	tsv := string(csvText([]byte("a\tb c\n"), true))
+	if tsv != "a\nb c\n" {
+		t.Errorf("Unexpected TSV text %q", tsv)
+	}
+	xml := string(xmlText([]byte("<a><b>one</b><c>two &amp; three</c></a>")))
+	if strings.TrimSpace(strings.Replace(xml, "\n", " ", -1)) != "one  two & three" {
+		t.Errorf("Unexpected XML text %q", xml)
+	}
+
+	if _, ok, err := extractSupplementaryText("S4_Fig.tif", SupplementaryImage); ok || err != nil {
+		t.Errorf("Expected no text from an image, got %v, %v", ok, err)
+	}
+}
+
+func TestFetchSupplementaryFiles(t *testing.T) {
+
+	server, _ := newTestEuropePMCServer(t)
+	defer server.Close()
+	server.Resources["/PMC1234567/supplementaryFiles"] = makeTestZip(t, testSupplementaryEntries)
+
+	processor, cleanup := newTestFetchProcessor(t, NewEuropePMCClient(server.URL, nil))
+	defer cleanup()
+	processor.Converter = NativeConverter{}
+
+	// Not fetched unless asked for
+	err := processor.FetchPaper(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count := server.requestCount("/PMC1234567/supplementaryFiles"); count != 0 {
+		t.Errorf("Expected no supplementary requests, got %d", count)
+	}
+
+	processor.Supplementary.Fetch = true
+	err = processor.FetchPaper(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dictionaries, err := LoadDictionariesFromDirectory(path.Join("testdata", "dictionaries"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = processor.ConvertPaper(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = processor.AnnotatePaper(dictionaries, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	article, err := LoadScienceSourceArticle(processor.targetScienceSourceStateFileName())
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]SupplementaryFile)
+	for _, file := range article.SupplementaryFiles {
+		files[file.Name] = file
+	}
+	if len(files) != len(testSupplementaryEntries) {
+		t.Fatalf("Expected %d supplementary files, got %v", len(testSupplementaryEntries), article.SupplementaryFiles)
+	}
+
+	expected := map[string]struct {
+		fileType string
+		mined    bool
+		terms    []string
+	}{
+		"S1_Table.csv":     {SupplementaryCSV, true, []string{"cholera", "malaria"}},
+		"data/S2_Text.txt": {SupplementaryText, true, []string{"malaria", "pneumonia"}},
+		"data/S3_Data.xml": {SupplementaryXML, true, []string{"cholera"}},
+		"S4_Fig.tif":       {SupplementaryImage, false, nil},
+	}
+	for name, expect := range expected {
+		file := files[name]
+		if file.Type != expect.fileType || file.Mined != expect.mined || file.Size == 0 {
+			t.Errorf("Unexpected supplementary file %s: %v", name, file)
+		}
+		found := make([]string, 0)
+		for _, term := range file.Terms {
+			if term.Count != 1 {
+				t.Errorf("Expected %s once in %s, got %d", term.TermFound, name, term.Count)
+			}
+			found = append(found, term.TermFound)
+		}
+		if strings.Join(found, ",") != strings.Join(expect.terms, ",") {
+			t.Errorf("Expected %v in %s, got %v", expect.terms, name, found)
+		}
+	}
+
+	if problems := processor.Verify(); len(problems) != 0 {
+		t.Errorf("Verify found problems: %v", problems)
+	}
+	if err := os.Remove(path.Join(processor.targetSupplementaryDirectoryName(), "S4_Fig.tif")); err != nil {
+		t.Fatal(err)
+	}
+	if problems := processor.Verify(); len(problems) != 1 {
+		t.Errorf("Expected Verify to find the missing file, got %v", problems)
+	}
+}
+
+func TestFetchMissingSupplementaryFiles(t *testing.T) {
+
+	server, _ := newTestEuropePMCServer(t)
+	defer server.Close()
+
+	processor, cleanup := newTestFetchProcessor(t, NewEuropePMCClient(server.URL, nil))
+	defer cleanup()
+	processor.Supplementary.Fetch = true
+
+	// Papers without supplementary files are fine
+	err := processor.FetchPaper(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fileExists(processor.targetSupplementaryArchiveFileName()) || fileExists(processor.targetSupplementaryDirectoryName()) {
+		t.Errorf("Expected no supplementary files")
+	}
+
+	// Nor are ones we won't unpack, which are noted and then left alone
+	server.Resources["/PMC1234567/supplementaryFiles"] = makeTestZip(t, []testZipEntry{{"../evil.txt", "escaped"}})
+	err = processor.FetchPaper(context.Background())
+	if err != nil {
+		t.Fatalf("Expected unsafe archive to be skipped, got %v", err)
+	}
+	if fileExists(processor.targetSupplementaryDirectoryName()) {
+		t.Errorf("Expected nothing to be unpacked")
+	}
+	reason, err := ioutil.ReadFile(processor.targetSupplementaryRejectedFileName())
+	if err != nil || !strings.Contains(string(reason), "evil.txt") {
+		t.Errorf("Expected the rejection to be recorded, got %q, %v", reason, err)
+	}
+
+	requests := server.requestCount("/PMC1234567/supplementaryFiles")
+	err = processor.FetchPaper(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count := server.requestCount("/PMC1234567/supplementaryFiles"); count != requests {
+		t.Errorf("Expected the archive not to be fetched again, got %d requests", count-requests)
+	}
+	if fileExists(processor.targetSupplementaryDirectoryName()) {
+		t.Errorf("Expected a rejected archive not to be unpacked on a later run")
+	}
+
+	// The paper carries on without its supplementary files
+	processor.Converter = NativeConverter{}
+	err = processor.ConvertPaper(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = processor.AnnotatePaper(nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	article, err := LoadScienceSourceArticle(processor.targetScienceSourceStateFileName())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(article.SupplementaryFiles) != 0 {
+		t.Errorf("Expected no supplementary files, got %v", article.SupplementaryFiles)
+	}
+}
+
+func TestFetchTooLargeSupplementaryFiles(t *testing.T) {
+
+	archive := makeTestZip(t, testSupplementaryEntries)
+
+	// Archives that say how big they are up front are turned away before we read them, and ones
+	// that don't are cut off once they get too big
+	for _, streamed := range []bool{false, true} {
+		server, _ := newTestEuropePMCServer(t)
+		defer server.Close()
+		server.Resources["/PMC1234567/supplementaryFiles"] = archive
+		server.Streamed = streamed
+
+		processor, cleanup := newTestFetchProcessor(t, NewEuropePMCClient(server.URL, nil))
+		defer cleanup()
+		processor.Supplementary = SupplementaryOptions{Fetch: true, MaxSize: int64(len(archive) - 1)}
+
+		err := processor.FetchPaper(context.Background())
+		if err != nil {
+			t.Fatalf("streamed %v: expected large archive to be skipped, got %v", streamed, err)
+		}
+		if fileExists(processor.targetSupplementaryArchiveFileName()) || fileExists(processor.targetSupplementaryDirectoryName()) {
+			t.Errorf("streamed %v: expected the archive not to be saved or unpacked", streamed)
+		}
+		reason, err := ioutil.ReadFile(processor.targetSupplementaryRejectedFileName())
+		if err != nil || !strings.Contains(string(reason), "larger than") {
+			t.Errorf("streamed %v: expected the rejection to be recorded, got %q, %v", streamed, reason, err)
+		}
+
+		// Asking again won't make it any smaller
+		err = processor.FetchPaper(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count := server.requestCount("/PMC1234567/supplementaryFiles"); count != 1 {
+			t.Errorf("streamed %v: expected the archive to be requested once, got %d", streamed, count)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+//   Copyright 2018 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"unicode/utf16"
+)
+
+// We find annotations in paper.txt but upload paper.html, and the two don't line up: the HTML
+// has headings and back matter the text doesn't, and the front matter is laid out differently.
+// Both are made from the same paper XML though, so for each text node of the XML we can say
+// where it ended up in each of them. That lets us give each anchor point a locator into the
+// uploaded page: the path from the page body to the block element (paragraph, heading, table
+// cell, and so on) the term is in, and how far into that element's text it starts, which is
+// what a script in the browser needs to find and highlight it.
+
+// unitOffsets is a position counted in each of the offset units, so we can give locators in
+// whichever unit the annotations use
+type unitOffsets struct {
+	Bytes      int `json:"byte"`
+	CodePoints int `json:"codepoint"`
+	UTF16      int `json:"utf16"`
+}
+
+func measureUnits(text string) unitOffsets {
+	res := unitOffsets{Bytes: len(text)}
+	for _, r := range text {
+		res.CodePoints += 1
+		res.UTF16 += utf16.RuneLen(r)
+	}
+	return res
+}
+
+func (offsets unitOffsets) add(other unitOffsets) unitOffsets {
+	return unitOffsets{
+		Bytes:      offsets.Bytes + other.Bytes,
+		CodePoints: offsets.CodePoints + other.CodePoints,
+		UTF16:      offsets.UTF16 + other.UTF16,
+	}
+}
+
+func (offsets unitOffsets) sub(other unitOffsets) unitOffsets {
+	return unitOffsets{
+		Bytes:      offsets.Bytes - other.Bytes,
+		CodePoints: offsets.CodePoints - other.CodePoints,
+		UTF16:      offsets.UTF16 - other.UTF16,
+	}
+}
+
+func (offsets unitOffsets) in(unit OffsetUnit) int {
+	switch unit {
+	case OffsetUnitBytes:
+		return offsets.Bytes
+	case OffsetUnitUTF16:
+		return offsets.UTF16
+	}
+	return offsets.CodePoints
+}
+
+// A TextHTMLSegment is a run of paper.txt that is also in paper.html
+type TextHTMLSegment struct {
+	// Where the run is in paper.txt, in bytes
+	Offset int `json:"offset"`
+	Length int `json:"length"`
+
+	// The block element the run is in, as a path from the body of paper.html such as
+	// "body/section[3]/p[1]", and how far into the element's text content the run starts
+	Path          string      `json:"path"`
+	ElementOffset unitOffsets `json:"element_offset"`
+}
+
+type TextHTMLMap struct {
+	// The length of paper.txt in bytes, so we can tell if the map is for a different version
+	TextLength int               `json:"text_length"`
+	Segments   []TextHTMLSegment `json:"segments"`
+}
+
+// Elements that flow within a block, so that we locate text by the block they're in
+var htmlInlineElements = map[string]bool{
+	"a": true, "b": true, "i": true, "tt": true, "sup": true, "sub": true, "span": true, "cite": true,
+}
+
+// textHTMLMapper lays out the HTML result the way writeResultAsHTML does, matching up text
+// nodes with where they are in the text result
+type textHTMLMapper struct {
+	textOffsets map[*jatsNode]int
+	seen        map[*jatsNode]bool
+	position    unitOffsets
+	segments    []TextHTMLSegment
+}
+
+func (mapper *textHTMLMapper) text(n *resultNode, locator string, start unitOffsets) {
+	if offset, prs := mapper.textOffsets[n.Source]; prs && !mapper.seen[n.Source] {
+		mapper.seen[n.Source] = true
+		mapper.segments = append(mapper.segments, TextHTMLSegment{
+			Offset:        offset,
+			Length:        len(n.Text),
+			Path:          locator,
+			ElementOffset: mapper.position.sub(start),
+		})
+	}
+	mapper.position = mapper.position.add(measureUnits(n.Text))
+}
+
+func (mapper *textHTMLMapper) newline() {
+	mapper.position = mapper.position.add(unitOffsets{1, 1, 1})
+}
+
+// element walks the contents of an element at the given path, with text being located relative
+// to the block element at locator, whose text content started at start
+func (mapper *textHTMLMapper) element(n *resultNode, path string, locator string, start unitOffsets) {
+
+	if htmlVoidElements[n.Tag] {
+		mapper.newline()
+		return
+	}
+	if n.breaksAfterOpening() {
+		mapper.newline()
+	}
+
+	counts := make(map[string]int)
+	for _, child := range n.Children {
+		if len(child.Tag) == 0 {
+			mapper.text(child, locator, start)
+			continue
+		}
+		counts[child.Tag] += 1
+		childPath := fmt.Sprintf("%s/%s[%d]", path, child.Tag, counts[child.Tag])
+		if htmlInlineElements[child.Tag] {
+			mapper.element(child, childPath, locator, start)
+		} else {
+			mapper.element(child, childPath, childPath, mapper.position)
+		}
+	}
+
+	if htmlBlockElements[n.Tag] {
+		mapper.newline()
+	}
+}
+
+// buildTextHTMLMap lines up the results of transforming the same document to text and HTML
+func buildTextHTMLMap(text *resultNode, html *resultNode) TextHTMLMap {
+
+	mapper := textHTMLMapper{
+		textOffsets: make(map[*jatsNode]int),
+		seen:        make(map[*jatsNode]bool),
+	}
+
+	offset := 0
+	var walkText func(n *resultNode)
+	walkText = func(n *resultNode) {
+		if n.Source != nil {
+			if _, prs := mapper.textOffsets[n.Source]; !prs {
+				mapper.textOffsets[n.Source] = offset
+			}
+		}
+		offset += len(n.Text)
+		for _, child := range n.Children {
+			walkText(child)
+		}
+	}
+	walkText(text)
+
+	for _, page := range html.Children {
+		if page.Tag != "html" {
+			continue
+		}
+		for _, body := range page.Children {
+			if body.Tag == "body" {
+				mapper.element(body, "body", "body", mapper.position)
+			}
+		}
+	}
+
+	sort.Slice(mapper.segments, func(i, j int) bool {
+		return mapper.segments[i].Offset < mapper.segments[j].Offset
+	})
+
+	return TextHTMLMap{TextLength: offset, Segments: mapper.segments}
+}
+
+// locate finds where the text at a byte offset in paper.txt is in paper.html, giving the offset
+// into the element in the given unit
+func (textMap TextHTMLMap) locate(prose []byte, offset int, unit OffsetUnit) (string, int, bool) {
+
+	segments := textMap.Segments
+	i := sort.Search(len(segments), func(i int) bool {
+		return segments[i].Offset+segments[i].Length > offset
+	})
+	if i == len(segments) || segments[i].Offset > offset || offset > len(prose) {
+		return "", 0, false
+	}
+	segment := segments[i]
+	within := measureUnits(string(prose[segment.Offset:offset]))
+
+	return segment.Path, segment.ElementOffset.add(within).in(unit), true
+}
+
+// locateInHTML sets where each of the article's anchor points is on the uploaded page, or clears
+// it if there's no map. It returns whether any locators changed.
+func (article *ScienceSourceArticle) locateInHTML(prose []byte, textMap *TextHTMLMap) bool {
+
+	offsets := newTextOffsets(prose, article.offsetUnit())
+	changed := false
+
+	for i := range article.Annotations {
+		anchor := &article.Annotations[i]
+
+		var htmlPath *string
+		var htmlOffset *int
+		if start, ok := offsets.toBytes(anchor.CharacterNumber); ok && textMap != nil {
+			if p, o, ok := textMap.locate(prose, start, article.offsetUnit()); ok {
+				htmlPath, htmlOffset = &p, &o
+			}
+		}
+
+		if (htmlPath == nil) != (anchor.HTMLPath == nil) ||
+			(htmlPath != nil && (*htmlPath != *anchor.HTMLPath || *htmlOffset != *anchor.HTMLOffset)) {
+			changed = true
+		}
+		anchor.HTMLPath, anchor.HTMLOffset = htmlPath, htmlOffset
+	}
+
+	return changed
+}
+
+func (textMap TextHTMLMap) Save(filename string) error {
+	data, err := json.Marshal(textMap)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(filename, data)
+}
+
+func LoadTextHTMLMap(filename string) (*TextHTMLMap, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var textMap TextHTMLMap
+	err = json.Unmarshal(data, &textMap)
+	if err != nil {
+		return nil, err
+	}
+	return &textMap, nil
+}
+
+// validFor checks the map was made with the given text
+func (textMap TextHTMLMap) validFor(prose []byte) bool {
+	if textMap.TextLength != len(prose) {
+		return false
+	}
+	for _, segment := range textMap.Segments {
+		if segment.Offset < 0 || segment.Offset+segment.Length > len(prose) {
+			return false
+		}
+	}
+	return true
+}
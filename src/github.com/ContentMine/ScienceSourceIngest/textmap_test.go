@@ -0,0 +1,219 @@
+//   Copyright 2018 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+)
+
+// testDOMNode is just enough of a DOM to check locators against the HTML we write, the way a
+// browser would see it
+type testDOMNode struct {
+	Tag      string
+	Text     string
+	Children []*testDOMNode
+}
+
+func (n *testDOMNode) textContent() string {
+	var b strings.Builder
+	b.WriteString(n.Text)
+	for _, child := range n.Children {
+		b.WriteString(child.textContent())
+	}
+	return b.String()
+}
+
+func parseTestDOM(t *testing.T, html []byte) *testDOMNode {
+	t.Helper()
+
+	decoder := xml.NewDecoder(bytes.NewReader(html))
+	decoder.Strict = false
+	decoder.AutoClose = xml.HTMLAutoClose
+	decoder.Entity = xml.HTMLEntity
+
+	root := &testDOMNode{}
+	stack := []*testDOMNode{root}
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		top := stack[len(stack)-1]
+		switch token := token.(type) {
+		case xml.StartElement:
+			child := &testDOMNode{Tag: token.Name.Local}
+			top.Children = append(top.Children, child)
+			stack = append(stack, child)
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			top.Children = append(top.Children, &testDOMNode{Text: string(token)})
+		}
+	}
+	return root
+}
+
+// find follows a path such as "body/section[2]/p[1]" from the html element
+func (n *testDOMNode) find(locator string) *testDOMNode {
+
+	var current *testDOMNode
+	for _, child := range n.Children {
+		if child.Tag == "html" {
+			current = child
+		}
+	}
+
+	for _, step := range strings.Split(locator, "/") {
+		if current == nil {
+			return nil
+		}
+		tag, index := step, 1
+		if i := strings.Index(step, "["); i >= 0 {
+			tag = step[:i]
+			fmt.Sscanf(step[i:], "[%d]", &index)
+		}
+		var next *testDOMNode
+		count := 0
+		for _, child := range current.Children {
+			if child.Tag == tag {
+				count += 1
+				if count == index {
+					next = child
+					break
+				}
+			}
+		}
+		current = next
+	}
+	return current
+}
+
+// expectLocated checks the term is at the locator in the HTML, with the offset in code points
+func expectLocated(t *testing.T, dom *testDOMNode, htmlPath string, htmlOffset int, term string) {
+	t.Helper()
+
+	element := dom.find(htmlPath)
+	if element == nil {
+		t.Errorf("No element at %s for %s", htmlPath, term)
+		return
+	}
+	text := []rune(element.textContent())
+	if htmlOffset+len([]rune(term)) > len(text) || string(text[htmlOffset:htmlOffset+len([]rune(term))]) != term {
+		t.Errorf("Expected %s at %d in %s, which is %q", term, htmlOffset, htmlPath, string(text))
+	}
+}
+
+func TestTextHTMLMap(t *testing.T) {
+
+	filename := path.Join("testdata", "PMC1234567.xml")
+	converter := NativeConverter{}
+
+	var text, html bytes.Buffer
+	if err := converter.ConvertToText(filename, &text); err != nil {
+		t.Fatal(err)
+	}
+	if err := converter.ConvertToHTML(filename, &html); err != nil {
+		t.Fatal(err)
+	}
+	textMap, err := converter.MapTextToHTML(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !textMap.validFor(text.Bytes()) {
+		t.Fatalf("Expected map to be valid for the text")
+	}
+
+	prose := text.Bytes()
+	dom := parseTestDOM(t, html.Bytes())
+
+	cholera := strings.LastIndex(string(prose), "cholera")
+	htmlPath, htmlOffset, ok := textMap.locate(prose, cholera, OffsetUnitCodePoints)
+	if !ok || htmlPath != "body/section[4]/p[1]" || htmlOffset != 11 {
+		t.Errorf("Unexpected location for cholera in methods: %s, %d, %v", htmlPath, htmlOffset, ok)
+	}
+
+	// Terms in headings, inline elements, and all through the paper
+	for _, term := range []string{"Malaria", "rural", "settings", "pneumonia", "common", "here", "aciclovir", "Introduction", "cell"} {
+		offset := strings.Index(string(prose), term)
+		htmlPath, htmlOffset, ok := textMap.locate(prose, offset, OffsetUnitCodePoints)
+		if !ok {
+			t.Errorf("Expected %s to be located", term)
+			continue
+		}
+		expectLocated(t, dom, htmlPath, htmlOffset, term)
+	}
+
+	// The journal title is generated rather than copied, so isn't found
+	if _, _, ok := textMap.locate(prose, strings.Index(string(prose), "PLoS"), OffsetUnitCodePoints); ok {
+		t.Errorf("Expected generated text not to be located")
+	}
+}
+
+func TestAnchorPointsLocatedInPage(t *testing.T) {
+
+	processor, cleanup := newTestProcessor(t)
+	defer cleanup()
+
+	dictionaries, err := LoadDictionariesFromDirectory(path.Join("testdata", "dictionaries"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = processor.ConvertPaper(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = processor.AnnotatePaper(dictionaries, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	article, err := LoadScienceSourceArticle(processor.targetScienceSourceStateFileName())
+	if err != nil {
+		t.Fatal(err)
+	}
+	html, err := ioutil.ReadFile(processor.targetHTMLFileName())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dom := parseTestDOM(t, html)
+
+	for i, anchor := range article.Annotations {
+		if anchor.HTMLPath == nil || anchor.HTMLOffset == nil {
+			t.Errorf("Expected anchor point %d to be located in the page", i)
+			continue
+		}
+		expectLocated(t, dom, *anchor.HTMLPath, *anchor.HTMLOffset, anchor.Annotation.TermFound)
+	}
+
+	// Converting with something that can't map the text leaves no stale map behind
+	processor.Converter = &XSLTConverter{}
+	err = processor.processTextToHTMLMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fileExists(processor.targetTextMapFileName()) {
+		t.Errorf("Expected map to be removed")
+	}
+}
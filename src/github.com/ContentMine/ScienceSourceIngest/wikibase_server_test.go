@@ -0,0 +1,587 @@
+//   Copyright 2018 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// fakeWikibaseServer implements just enough of the MediaWiki and Wikibase action APIs for the
+// wikibase client library to do everything ProcessPaper needs, storing everything in memory so
+// tests can inspect what was created. Requests are dispatched on the action parameter alone, so
+// it doesn't matter what path the client uses for api.php.
+
+type fakeClaim struct {
+	ID       string
+	Property string
+	Value    json.RawMessage
+}
+
+type fakeEntity struct {
+	ID       string
+	Type     string
+	Label    string
+	DataType string
+	Claims   []*fakeClaim
+}
+
+type fakePage struct {
+	ID        int
+	Title     string
+	Text      string
+	Protected bool
+}
+
+type fakeWikibaseServer struct {
+	*httptest.Server
+
+	lock sync.Mutex
+
+	nextItemID     int
+	nextPropertyID int
+	nextPageID     int
+	nextClaimID    int
+
+	Entities map[string]*fakeEntity
+	Pages    map[string]*fakePage
+	Actions  map[string]int
+}
+
+const fakeCSRFToken string = "fake+\\"
+
+func newFakeWikibaseServer() *fakeWikibaseServer {
+
+	server := &fakeWikibaseServer{
+		nextItemID:     1,
+		nextPropertyID: 1,
+		nextPageID:     1,
+		nextClaimID:    1,
+		Entities:       make(map[string]*fakeEntity),
+		Pages:          make(map[string]*fakePage),
+		Actions:        make(map[string]int),
+	}
+	server.Server = httptest.NewServer(http.HandlerFunc(server.handle))
+
+	return server
+}
+
+func (server *fakeWikibaseServer) handle(w http.ResponseWriter, r *http.Request) {
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		if err := r.ParseMultipartForm(32 << 20); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	action := r.Form.Get("action")
+	server.Actions[action] += 1
+
+	var response interface{}
+	var err *fakeAPIError
+
+	switch action {
+	case "query":
+		response, err = server.query(r)
+	case "wbsearchentities":
+		response, err = server.searchEntities(r)
+	case "wbgetentities":
+		response, err = server.getEntities(r)
+	case "wbeditentity":
+		response, err = server.editEntity(r)
+	case "wbcreateclaim":
+		response, err = server.createClaim(r)
+	case "wbsetclaim":
+		response, err = server.setClaim(r)
+	case "wbsetclaimvalue":
+		response, err = server.setClaimValue(r)
+	case "wbremoveclaims":
+		response, err = server.removeClaims(r)
+	case "edit":
+		response, err = server.edit(r)
+	case "protect":
+		response, err = server.protect(r)
+	default:
+		err = &fakeAPIError{"badvalue", fmt.Sprintf("Unrecognized value for parameter \"action\": %s.", action)}
+	}
+
+	if err != nil {
+		response = map[string]interface{}{"error": err}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(response)
+}
+
+type fakeAPIError struct {
+	Code string `json:"code"`
+	Info string `json:"info"`
+}
+
+func (server *fakeWikibaseServer) checkToken(r *http.Request) *fakeAPIError {
+	if r.Form.Get("token") != fakeCSRFToken {
+		return &fakeAPIError{"badtoken", "Invalid CSRF token."}
+	}
+	return nil
+}
+
+// Must be called with the lock held
+func (server *fakeWikibaseServer) entityByLabel(entityType string, label string) *fakeEntity {
+	for _, entity := range server.Entities {
+		if entity.Type == entityType && entity.Label == label {
+			return entity
+		}
+	}
+	return nil
+}
+
+// Must be called with the lock held
+func (server *fakeWikibaseServer) newClaim(entity *fakeEntity, property string, value json.RawMessage) *fakeClaim {
+	claim := &fakeClaim{
+		ID:       fmt.Sprintf("%s$%08d-0000-0000-0000-000000000000", entity.ID, server.nextClaimID),
+		Property: property,
+		Value:    value,
+	}
+	server.nextClaimID += 1
+	entity.Claims = append(entity.Claims, claim)
+	return claim
+}
+
+func (claim *fakeClaim) toJSON() map[string]interface{} {
+	return map[string]interface{}{
+		"id":   claim.ID,
+		"type": "statement",
+		"rank": "normal",
+		"mainsnak": map[string]interface{}{
+			"snaktype": "value",
+			"property": claim.Property,
+			"datavalue": map[string]interface{}{
+				"value": claim.Value,
+			},
+		},
+	}
+}
+
+func (entity *fakeEntity) toJSON() map[string]interface{} {
+	claims := make(map[string][]interface{})
+	for _, claim := range entity.Claims {
+		claims[claim.Property] = append(claims[claim.Property], claim.toJSON())
+	}
+	res := map[string]interface{}{
+		"id":   entity.ID,
+		"type": entity.Type,
+		"labels": map[string]interface{}{
+			"en": map[string]string{"language": "en", "value": entity.Label},
+		},
+		"claims": claims,
+	}
+	if len(entity.DataType) > 0 {
+		res["datatype"] = entity.DataType
+	}
+	return res
+}
+
+// checkValue rejects snak values that aren't JSON, and empty strings, which Wikibase won't store
+func checkValue(value json.RawMessage) *fakeAPIError {
+	if !json.Valid(value) {
+		return &fakeAPIError{"invalid-snak", "Invalid value for snak."}
+	}
+	var text string
+	if json.Unmarshal(value, &text) == nil && len(text) == 0 {
+		return &fakeAPIError{"modification-failed", "Must be at least one character long."}
+	}
+	return nil
+}
+
+// API actions
+
+func (server *fakeWikibaseServer) query(r *http.Request) (interface{}, *fakeAPIError) {
+	if r.Form.Get("meta") != "tokens" {
+		return nil, &fakeAPIError{"badvalue", "Only token queries are supported."}
+	}
+	return map[string]interface{}{
+		"batchcomplete": "",
+		"query": map[string]interface{}{
+			"tokens": map[string]string{
+				"csrftoken": fakeCSRFToken,
+			},
+		},
+	}, nil
+}
+
+func (server *fakeWikibaseServer) searchEntities(r *http.Request) (interface{}, *fakeAPIError) {
+
+	entityType := r.Form.Get("type")
+	if len(entityType) == 0 {
+		entityType = "item"
+	}
+	search := r.Form.Get("search")
+
+	results := make([]interface{}, 0)
+	for _, entity := range server.Entities {
+		if entity.Type == entityType && entity.Label == search {
+			results = append(results, map[string]interface{}{
+				"id":    entity.ID,
+				"title": entity.ID,
+				"label": entity.Label,
+				"match": map[string]string{"type": "label", "language": "en", "text": entity.Label},
+			})
+		}
+	}
+
+	return map[string]interface{}{
+		"searchinfo": map[string]string{"search": search},
+		"search":     results,
+		"success":    1,
+	}, nil
+}
+
+func (server *fakeWikibaseServer) getEntities(r *http.Request) (interface{}, *fakeAPIError) {
+
+	entities := make(map[string]interface{})
+	for _, id := range strings.Split(r.Form.Get("ids"), "|") {
+		if entity, prs := server.Entities[id]; prs {
+			entities[id] = entity.toJSON()
+		} else {
+			entities[id] = map[string]interface{}{"id": id, "missing": ""}
+		}
+	}
+
+	return map[string]interface{}{
+		"entities": entities,
+		"success":  1,
+	}, nil
+}
+
+type fakeEntityData struct {
+	Labels   map[string]struct{ Value string } `json:"labels"`
+	DataType string                            `json:"datatype"`
+	Claims   json.RawMessage                   `json:"claims"`
+}
+
+type fakeClaimData struct {
+	ID       string `json:"id"`
+	MainSnak struct {
+		Property  string `json:"property"`
+		DataValue struct {
+			Value json.RawMessage `json:"value"`
+		} `json:"datavalue"`
+	} `json:"mainsnak"`
+}
+
+func (server *fakeWikibaseServer) editEntity(r *http.Request) (interface{}, *fakeAPIError) {
+
+	if err := server.checkToken(r); err != nil {
+		return nil, err
+	}
+
+	var data fakeEntityData
+	if err := json.Unmarshal([]byte(r.Form.Get("data")), &data); err != nil {
+		return nil, &fakeAPIError{"invalid-json", err.Error()}
+	}
+
+	var entity *fakeEntity
+	if newType := r.Form.Get("new"); len(newType) > 0 {
+		entity = &fakeEntity{Type: newType, DataType: data.DataType}
+		switch newType {
+		case "item":
+			entity.ID = fmt.Sprintf("Q%d", server.nextItemID)
+			server.nextItemID += 1
+		case "property":
+			entity.ID = fmt.Sprintf("P%d", server.nextPropertyID)
+			server.nextPropertyID += 1
+		default:
+			return nil, &fakeAPIError{"badvalue", fmt.Sprintf("Unknown entity type %s", newType)}
+		}
+		server.Entities[entity.ID] = entity
+	} else {
+		var prs bool
+		entity, prs = server.Entities[r.Form.Get("id")]
+		if !prs {
+			return nil, &fakeAPIError{"no-such-entity", fmt.Sprintf("Could not find an entity with the ID \"%s\".", r.Form.Get("id"))}
+		}
+	}
+
+	if label, prs := data.Labels["en"]; prs {
+		// Wikibase only insists on unique labels for properties
+		existing := server.entityByLabel(entity.Type, label.Value)
+		if entity.Type == "property" && existing != nil && existing != entity {
+			return nil, &fakeAPIError{"modification-failed", fmt.Sprintf("Label \"%s\" already used by %s", label.Value, existing.ID)}
+		}
+		entity.Label = label.Value
+	}
+
+	// Claims can either be a list or a map of property to list
+	if len(data.Claims) > 0 {
+		claims := make([]fakeClaimData, 0)
+		if err := json.Unmarshal(data.Claims, &claims); err != nil {
+			byProperty := make(map[string][]fakeClaimData)
+			if err := json.Unmarshal(data.Claims, &byProperty); err != nil {
+				return nil, &fakeAPIError{"invalid-json", err.Error()}
+			}
+			for _, list := range byProperty {
+				claims = append(claims, list...)
+			}
+		}
+		for _, claim := range claims {
+			server.newClaim(entity, claim.MainSnak.Property, claim.MainSnak.DataValue.Value)
+		}
+	}
+
+	return map[string]interface{}{
+		"entity":  entity.toJSON(),
+		"success": 1,
+	}, nil
+}
+
+func (server *fakeWikibaseServer) createClaim(r *http.Request) (interface{}, *fakeAPIError) {
+
+	if err := server.checkToken(r); err != nil {
+		return nil, err
+	}
+
+	entity, prs := server.Entities[r.Form.Get("entity")]
+	if !prs {
+		return nil, &fakeAPIError{"no-such-entity", fmt.Sprintf("Could not find an entity with the ID \"%s\".", r.Form.Get("entity"))}
+	}
+	property := r.Form.Get("property")
+	if _, prs := server.Entities[property]; !prs {
+		return nil, &fakeAPIError{"no-such-entity", fmt.Sprintf("Could not find a property with the ID \"%s\".", property)}
+	}
+	value := json.RawMessage(r.Form.Get("value"))
+	if err := checkValue(value); err != nil {
+		return nil, err
+	}
+
+	claim := server.newClaim(entity, property, value)
+
+	return map[string]interface{}{
+		"pageinfo": map[string]int{"lastrevid": server.nextClaimID},
+		"success":  1,
+		"claim":    claim.toJSON(),
+	}, nil
+}
+
+func (server *fakeWikibaseServer) findClaim(id string) (*fakeEntity, *fakeClaim) {
+	entityID := strings.Split(id, "$")[0]
+	entity, prs := server.Entities[entityID]
+	if !prs {
+		return nil, nil
+	}
+	for _, claim := range entity.Claims {
+		if claim.ID == id {
+			return entity, claim
+		}
+	}
+	return entity, nil
+}
+
+func (server *fakeWikibaseServer) removeClaims(r *http.Request) (interface{}, *fakeAPIError) {
+
+	if err := server.checkToken(r); err != nil {
+		return nil, err
+	}
+
+	ids := strings.Split(r.Form.Get("claim"), "|")
+	for _, id := range ids {
+		entity, claim := server.findClaim(id)
+		if claim == nil {
+			return nil, &fakeAPIError{"invalid-guid", fmt.Sprintf("Could not find a claim with the ID \"%s\".", id)}
+		}
+		for i, existing := range entity.Claims {
+			if existing == claim {
+				entity.Claims = append(entity.Claims[:i], entity.Claims[i+1:]...)
+				break
+			}
+		}
+	}
+
+	return map[string]interface{}{
+		"pageinfo": map[string]int{"lastrevid": server.nextClaimID},
+		"success":  1,
+		"claims":   ids,
+	}, nil
+}
+
+func (server *fakeWikibaseServer) setClaim(r *http.Request) (interface{}, *fakeAPIError) {
+
+	if err := server.checkToken(r); err != nil {
+		return nil, err
+	}
+
+	var data fakeClaimData
+	if err := json.Unmarshal([]byte(r.Form.Get("claim")), &data); err != nil {
+		return nil, &fakeAPIError{"invalid-json", err.Error()}
+	}
+
+	entity, claim := server.findClaim(data.ID)
+	if entity == nil {
+		return nil, &fakeAPIError{"invalid-guid", "The given GUID is not valid."}
+	}
+	if claim == nil {
+		claim = server.newClaim(entity, data.MainSnak.Property, data.MainSnak.DataValue.Value)
+	} else {
+		claim.Property = data.MainSnak.Property
+		claim.Value = data.MainSnak.DataValue.Value
+	}
+
+	return map[string]interface{}{
+		"success": 1,
+		"claim":   claim.toJSON(),
+	}, nil
+}
+
+func (server *fakeWikibaseServer) setClaimValue(r *http.Request) (interface{}, *fakeAPIError) {
+
+	if err := server.checkToken(r); err != nil {
+		return nil, err
+	}
+
+	_, claim := server.findClaim(r.Form.Get("claim"))
+	if claim == nil {
+		return nil, &fakeAPIError{"invalid-guid", "The given GUID is not valid."}
+	}
+	value := json.RawMessage(r.Form.Get("value"))
+	if err := checkValue(value); err != nil {
+		return nil, err
+	}
+	claim.Value = value
+
+	return map[string]interface{}{
+		"success": 1,
+		"claim":   claim.toJSON(),
+	}, nil
+}
+
+func (server *fakeWikibaseServer) edit(r *http.Request) (interface{}, *fakeAPIError) {
+
+	if err := server.checkToken(r); err != nil {
+		return nil, err
+	}
+
+	title := r.Form.Get("title")
+	page, prs := server.Pages[title]
+	if prs && len(r.Form["createonly"]) > 0 {
+		return nil, &fakeAPIError{"articleexists", "The article you tried to create has been created already."}
+	}
+	if !prs {
+		page = &fakePage{ID: server.nextPageID, Title: title}
+		server.nextPageID += 1
+		server.Pages[title] = page
+	}
+	page.Text = r.Form.Get("text")
+
+	return map[string]interface{}{
+		"edit": map[string]interface{}{
+			"result":   "Success",
+			"pageid":   page.ID,
+			"title":    page.Title,
+			"new":      "",
+			"newrevid": page.ID,
+		},
+	}, nil
+}
+
+func (server *fakeWikibaseServer) protect(r *http.Request) (interface{}, *fakeAPIError) {
+
+	if err := server.checkToken(r); err != nil {
+		return nil, err
+	}
+
+	var page *fakePage
+	if pageID, err := strconv.Atoi(r.Form.Get("pageid")); err == nil {
+		for _, candidate := range server.Pages {
+			if candidate.ID == pageID {
+				page = candidate
+			}
+		}
+	} else {
+		page = server.Pages[r.Form.Get("title")]
+	}
+	if page == nil {
+		return nil, &fakeAPIError{"missingtitle", "The page you specified doesn't exist."}
+	}
+	page.Protected = true
+
+	return map[string]interface{}{
+		"protect": map[string]interface{}{
+			"title":       page.Title,
+			"reason":      r.Form.Get("reason"),
+			"protections": []map[string]string{{"edit": "sysop", "expiry": "infinite"}},
+		},
+	}, nil
+}
+
+// Helpers for tests to inspect what was created
+
+func (server *fakeWikibaseServer) entityID(entityType string, label string) string {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	if entity := server.entityByLabel(entityType, label); entity != nil {
+		return entity.ID
+	}
+	return ""
+}
+
+// claimValues returns the values of all claims for the given property label on an entity. Item
+// values are returned as their Q ID.
+func (server *fakeWikibaseServer) claimValues(entityID string, propertyLabel string) []string {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	property := server.entityByLabel("property", propertyLabel)
+	entity, prs := server.Entities[entityID]
+	if property == nil || !prs {
+		return nil
+	}
+
+	res := make([]string, 0)
+	for _, claim := range entity.Claims {
+		if claim.Property != property.ID {
+			continue
+		}
+
+		var item struct {
+			ID        string `json:"id"`
+			NumericID int    `json:"numeric-id"`
+		}
+		var str string
+		switch {
+		case json.Unmarshal(claim.Value, &str) == nil:
+			res = append(res, str)
+		case json.Unmarshal(claim.Value, &item) == nil && len(item.ID) > 0:
+			res = append(res, item.ID)
+		case json.Unmarshal(claim.Value, &item) == nil && item.NumericID > 0:
+			res = append(res, fmt.Sprintf("Q%d", item.NumericID))
+		default:
+			res = append(res, string(claim.Value))
+		}
+	}
+
+	return res
+}
@@ -0,0 +1,110 @@
+//   Copyright 2018 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// Dictionary terms should only match whole words, otherwise "flu" is found in "fluid". This
+// implements the parts of the Unicode word boundary rules (https://unicode.org/reports/tr29/)
+// that matter for telling whether a match starts or ends part way through a word: letters,
+// digits, combining marks, and underscores stick together, as do letters either side of an
+// apostrophe or full stop ("can't", "e.g") and digits either side of a comma or full stop
+// ("3.14", "1,000"). Ideographs are words on their own.
+
+func isWordRune(r rune) bool {
+	if unicode.In(r, unicode.Han, unicode.Hiragana) {
+		return false
+	}
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r) || r == '_'
+}
+
+func isWordLetter(r rune) bool {
+	return isWordRune(r) && !unicode.IsDigit(r)
+}
+
+// MidNumLet from the Unicode rules, which can appear in the middle of words and numbers
+func isMidNumLet(r rune) bool {
+	switch r {
+	case '.', '\'', '\u2018', '\u2019', '\u2024', '\uFE52', '\uFF07', '\uFF0E':
+		return true
+	}
+	return false
+}
+
+func isMidLetter(r rune) bool {
+	switch r {
+	case ':', '\u00B7', '\u0387', '\u05F4', '\u2027', '\uFE13', '\uFE55', '\uFF1A':
+		return true
+	}
+	return isMidNumLet(r)
+}
+
+func isMidNum(r rune) bool {
+	switch r {
+	case ',', ';', '\u037E', '\u0589', '\u060C', '\u060D', '\u066C', '\u07F8', '\u2044', '\uFE10', '\uFE14', '\uFE50', '\uFE54', '\uFF0C', '\uFF1B':
+		return true
+	}
+	return isMidNumLet(r)
+}
+
+// joinedAcross tells us if a, mid, b form a single word, as in "can't" or "3.14". Unlike the
+// Unicode rules we split "end.Start", as the paper text runs paragraphs together and so is
+// full of sentences that end up looking like that.
+func joinedAcross(a rune, mid rune, b rune) bool {
+	if (mid == '.' || mid == '\uFF0E') && unicode.IsLower(a) && unicode.IsUpper(b) {
+		return false
+	}
+	return (isWordLetter(a) && isMidLetter(mid) && isWordLetter(b)) ||
+		(unicode.IsDigit(a) && isMidNum(mid) && unicode.IsDigit(b))
+}
+
+// isWordBoundary tells us whether offset in text falls between two words rather than inside one
+func isWordBoundary(text []byte, offset int) bool {
+
+	if offset <= 0 || offset >= len(text) {
+		return true
+	}
+
+	before, beforeSize := utf8.DecodeLastRune(text[:offset])
+	after, afterSize := utf8.DecodeRune(text[offset:])
+
+	if isWordRune(before) && (isWordRune(after) || unicode.IsMark(after)) {
+		return false
+	}
+
+	if isWordRune(after) && offset-beforeSize > 0 {
+		beforeBefore, _ := utf8.DecodeLastRune(text[:offset-beforeSize])
+		if joinedAcross(beforeBefore, before, after) {
+			return false
+		}
+	}
+
+	if isWordRune(before) && offset+afterSize < len(text) {
+		afterAfter, _ := utf8.DecodeRune(text[offset+afterSize:])
+		if joinedAcross(before, after, afterAfter) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isWholeWord checks the span starts and ends on word boundaries
+func isWholeWord(text []byte, start int, end int) bool {
+	return isWordBoundary(text, start) && isWordBoundary(text, end)
+}
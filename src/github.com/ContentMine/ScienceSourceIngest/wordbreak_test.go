@@ -0,0 +1,74 @@
+//   Copyright 2018 Content Mine Ltd
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIsWholeWord(t *testing.T) {
+
+	tests := []struct {
+		text     string
+		term     string
+		expected bool
+	}{
+		{"the flu season", "flu", true},
+		{"flu", "flu", true},
+		{"(flu)", "flu", true},
+		{"flu, fever", "flu", true},
+		{"cerebral fluid", "flu", false},
+		{"an influence", "flu", false},
+		{"avian-flu", "flu", true},
+		{"flu_like", "flu", false},
+		{"can't", "can", false},
+		{"in 3.14 cases", "3", false},
+		{"in 3, cases", "3", true},
+		{"with malaria.Cholera next", "malaria", true},
+		{"with malaria.Cholera next", "Cholera", true},
+		{"e.g. this", "e", false},
+		{"café", "caf", false},
+		{"nai\u0308ve", "nai", false},
+		{"疟疾和霍乱", "霍乱", true},
+	}
+
+	for _, test := range tests {
+		start := strings.Index(test.text, test.term)
+		if start == -1 {
+			t.Fatalf("Bad test, %q not in %q", test.term, test.text)
+		}
+		if got := isWholeWord([]byte(test.text), start, start+len(test.term)); got != test.expected {
+			t.Errorf("Expected %q in %q to be whole word %v, got %v", test.term, test.text, test.expected, got)
+		}
+	}
+}
+
+func TestFindMatchesWordBoundaries(t *testing.T) {
+
+	prose := []byte("Flu and fluid, influenza and flu.")
+
+	whole := loadTestDictionary(t, Dictionary{Identifier: "whole", Options: DictionaryMatchOptions{FoldCase: true}, Entries: testEntries("flu")})
+	matches, stats := whole.FindMatches(prose)
+	if len(matches) != 2 || stats.Hits != 4 || stats.RejectedWithinWords != 2 {
+		t.Errorf("Expected 2 of 4 hits to be kept, got %v with %+v", matchedText(prose, matches), stats)
+	}
+
+	within := loadTestDictionary(t, Dictionary{Identifier: "within", Options: DictionaryMatchOptions{FoldCase: true, MatchWithinWords: true}, Entries: testEntries("flu")})
+	matches, stats = within.FindMatches(prose)
+	if len(matches) != 4 || stats.RejectedWithinWords != 0 {
+		t.Errorf("Expected all 4 hits to be kept, got %v with %+v", matchedText(prose, matches), stats)
+	}
+}